@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"math"
 	"time"
 )
@@ -209,9 +210,148 @@ func AHRSupdate(gx, gy, gz, ax, ay, az, mx, my, mz float64) {
 }
 
 func isAHRSValid() bool {
-	return stratuxClock.Since(mySituation.LastAttitudeTime) < 1*time.Second // If attitude information gets to be over 1 second old, declare invalid.
+	// If attitude information gets to be over 1 second old, or the IMU has stopped delivering samples for longer than
+	//  the glitch hold time, declare invalid. Isolated read errors only drop samples, and the last attitude is held.
+	//  LastAttitudeTime is refreshed by attitudeReaderSender() whether or not there are samples, so lastIMUReadTime
+	//  decides. The hold is capped at imuStallTime: by then imuWatchdog() has given up on the reader.
+	hold := time.Duration(globalSettings.AHRS_GlitchHoldTime) * time.Millisecond
+	if hold <= 0 {
+		hold = 1 * time.Second
+	} else if hold > imuStallTime {
+		hold = imuStallTime
+	}
+	return stratuxClock.Since(mySituation.LastAttitudeTime) < 1*time.Second && stratuxClock.Since(lastIMUReadTime) < hold
 }
 
 func invSqrt(x float64) float64 {
 	return 1.0 / math.Sqrt(x)
 }
+
+/*
+	updateAircraftMoving().
+		Fuses GPS groundspeed and the IMU stationary state into a single "aircraft moving" determination.
+		 GPS groundspeed is the primary source when the fix is valid; at rest GPS noise is suppressed by
+		 suppressGPSNoiseAtRest(), so a parked aircraft reads 0 kts. An unaccelerated aircraft in smooth
+		 air also looks still to the IMU, so the IMU state is only trusted on its own when there's no
+		 valid GPS fix, and is ignored above aircraftMovingSpeed.
+
+		Conversely GPS motion validates the IMU: taxiing, turns and turbulence all move it, so if GPS has
+		 shown motion for ahrsMotionCheckTime and the IMU has reported stationary throughout, it is
+		 probably stuck. This sets AHRSMotionMismatch and is logged.
+*/
+
+const (
+	aircraftMovingSpeed = 5 // kts
+	ahrsMotionCheckTime = 5 * time.Minute
+)
+
+var gpsMovingSince time.Time // stratuxClock time since which GPS has continuously shown motion. Zero when not moving.
+var imuMovedSinceGPS bool    // IMU has reported motion since gpsMovingSince.
+
+func updateAircraftMoving() {
+	if isGPSValid() {
+		mySituation.Moving = mySituation.GroundSpeed >= aircraftMovingSpeed
+	} else if isAHRSValid() {
+		mySituation.Moving = !mySituation.AHRSStationary
+	} else {
+		mySituation.Moving = false
+	}
+
+	if !isGPSValid() || mySituation.GroundSpeed < aircraftMovingSpeed || !isAHRSValid() {
+		gpsMovingSince = time.Time{}
+		mySituation.AHRSMotionMismatch = false
+		return
+	}
+	if gpsMovingSince.IsZero() {
+		gpsMovingSince = stratuxClock.Time
+		imuMovedSinceGPS = false
+	}
+	if !mySituation.AHRSStationary { // Stationary needs a few seconds of stillness, so any motion is seen at 1 Hz.
+		imuMovedSinceGPS = true
+	}
+	mismatch := !imuMovedSinceGPS && stratuxClock.Since(gpsMovingSince) >= ahrsMotionCheckTime
+	if mismatch && !mySituation.AHRSMotionMismatch {
+		log.Printf("AHRS: GPS has shown motion for %s but the IMU has reported stationary throughout. The IMU may be stuck.\n", stratuxClock.Since(gpsMovingSince))
+	}
+	mySituation.AHRSMotionMismatch = mismatch
+}
+
+// suppressGPSNoiseAtRest returns the groundspeed (kts) to report. When the IMU says the aircraft is still,
+// low GPS groundspeeds are noise and are reported as 0, which also keeps the course from wandering.
+func suppressGPSNoiseAtRest(groundspeed float64) float64 {
+	rawSituation.GroundSpeed = groundspeed
+	if groundspeed < 2*aircraftMovingSpeed && isAHRSValid() && mySituation.AHRSStationary {
+		return 0
+	}
+	return groundspeed
+}
+
+/*
+	applyAutoTrim().
+		Optional straight-and-level auto-trim. During steady cruise the aircraft is assumed to be close
+		 to level, so any pitch or roll shown then is mostly slow AHRS bias. The trim follows the
+		 measured attitude with globalSettings.AHRS_AutoTrimTimeConstant (seconds), and is subtracted
+		 from the reported attitude. Limited to +/- autoTrimLimit degrees so that it can't hide a real
+		 attitude. Steady cruise needs a still IMU (no rotation, 1 g), a valid GPS fix, a groundspeed
+		 and track that haven't changed for autoTrimSteadyTime, and near zero GPS vertical speed, so
+		 that a long climb or descent isn't trimmed out.
+*/
+
+const (
+	autoTrimLimit      = 5.0 // degrees
+	autoTrimSteadyTime = 30 * time.Second
+	autoTrimMinSpeed   = 40  // kts
+	autoTrimMaxVertVel = 200 // ft/min
+	autoTrimCourseBand = 3   // degrees
+	autoTrimSpeedBand  = 5   // kts
+)
+
+var pitchTrim, rollTrim float64
+var autoTrimCourse float32
+var autoTrimSpeed uint16
+var autoTrimSteadySince time.Time // stratuxClock time since which track and speed have been steady.
+var lastAutoTrimTime time.Time
+
+// isSteadyCruise must be called with mySituation.mu_GPS held.
+func isSteadyCruise() bool {
+	if !isGPSValid() || !isGPSGroundTrackValid() || mySituation.GroundSpeed < autoTrimMinSpeed {
+		autoTrimSteadySince = stratuxClock.Time
+		return false
+	}
+	courseChange := math.Abs(degreesRel(radians(float64(mySituation.TrueCourse - autoTrimCourse))))
+	speedChange := math.Abs(float64(mySituation.GroundSpeed) - float64(autoTrimSpeed))
+	if courseChange > autoTrimCourseBand || speedChange > autoTrimSpeedBand {
+		autoTrimCourse = mySituation.TrueCourse
+		autoTrimSpeed = mySituation.GroundSpeed
+		autoTrimSteadySince = stratuxClock.Time
+		return false
+	}
+	return stratuxClock.Since(autoTrimSteadySince) >= autoTrimSteadyTime &&
+		math.Abs(float64(mySituation.GPSVertVel*60)) < autoTrimMaxVertVel && mySituation.AHRSStationary
+}
+
+func applyAutoTrim(pitch, roll float64) (float64, float64) {
+	dt := stratuxClock.Since(lastAutoTrimTime).Seconds()
+	lastAutoTrimTime = stratuxClock.Time
+	if !globalSettings.AHRS_AutoTrim {
+		return pitch, roll
+	}
+
+	tau := float64(globalSettings.AHRS_AutoTrimTimeConstant)
+	if tau > 0 && dt < 1 {
+		mySituation.mu_GPS.Lock()
+		steady := isSteadyCruise()
+		mySituation.mu_GPS.Unlock()
+		if steady {
+			pitchTrim += (pitch - pitchTrim) * dt / tau
+			rollTrim += (roll - rollTrim) * dt / tau
+			pitchTrim = math.Max(-autoTrimLimit, math.Min(autoTrimLimit, pitchTrim))
+			rollTrim = math.Max(-autoTrimLimit, math.Min(autoTrimLimit, rollTrim))
+		}
+	}
+	mySituation.mu_Attitude.Lock()
+	mySituation.AHRSPitchTrim = pitchTrim
+	mySituation.AHRSRollTrim = rollTrim
+	mySituation.mu_Attitude.Unlock()
+	return pitch - pitchTrim, roll - rollTrim
+}
@@ -0,0 +1,51 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ahrs_test.go: Tests for AHRS validity across IMU failures.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestAHRSInvalidAfterSustainedIMUFailure runs imuWatchdog()'s checks over ten seconds without an IMU sample. The
+// restarts must not make the frozen attitude valid again.
+func TestAHRSInvalidAfterSustainedIMUFailure(t *testing.T) {
+	defer func(h int) { globalSettings.AHRS_GlitchHoldTime = h }(globalSettings.AHRS_GlitchHoldTime)
+
+	for _, tt := range []struct {
+		holdMs   int
+		wantHold time.Duration
+	}{
+		{1000, time.Second},
+		{500, 500 * time.Millisecond},
+		{5000, imuStallTime}, // Capped.
+	} {
+		globalSettings.AHRS_GlitchHoldTime = tt.holdMs
+		stratuxClock = &monotonic{Time: time.Time{}.Add(time.Hour)}
+		lastIMUReadTime = stratuxClock.Time // The last good sample.
+		lastIMURestartTime = stratuxClock.Time.Add(-time.Minute)
+		start := stratuxClock.Time
+
+		restarts := 0
+		for step := 1; step <= 300; step++ {
+			stratuxClock.Time = stratuxClock.Time.Add(33 * time.Millisecond) // attitudeReaderSender().
+			mySituation.LastAttitudeTime = stratuxClock.Time
+			if step%30 == 0 && imuReaderStalled() { // imuWatchdog(), about once a second.
+				restarts++
+			}
+			if elapsed := stratuxClock.Since(start); isAHRSValid() != (elapsed < tt.wantHold) {
+				t.Fatalf("hold %d ms: isAHRSValid() = %v after %s without a sample", tt.holdMs, isAHRSValid(), elapsed)
+			}
+		}
+		if restarts < 3 {
+			t.Errorf("hold %d ms: %d reader restarts in ten seconds, want at least 3", tt.holdMs, restarts)
+		}
+	}
+}
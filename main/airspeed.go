@@ -0,0 +1,80 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	airspeed.go: External airspeed input, and a groundspeed vs. airspeed integrity check.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	externalAirspeedTimeout = 5 * time.Second
+	airspeedCheckMinTAS     = 40.0  // Knots. Pitot readings below this are too noisy to compare.
+	airspeedCheckMargin     = 15.0  // Knots allowed beyond what the wind can explain.
+	airspeedCheckMaxWind    = 100.0 // Knots assumed possible when the wind is unknown.
+)
+
+var lastAirspeedTime time.Time // stratuxClock time of the last airspeed from the network.
+var lastWindTime time.Time     // stratuxClock time of the last wind from the network.
+
+/*
+	setExternalAirspeed().
+		Takes true airspeed (kt) from an external air data source, and optionally the wind speed (kt,
+		 negative if not known) it has estimated.
+*/
+
+func setExternalAirspeed(tas, wind float64) bool {
+	if tas < 0 || tas > 1000 || wind > 500 {
+		return false
+	}
+	mySituation.TAS = tas
+	lastAirspeedTime = stratuxClock.Time
+	if wind >= 0 {
+		mySituation.WindSpeed = wind
+		lastWindTime = stratuxClock.Time
+	}
+	return true
+}
+
+/*
+	checkAirspeedVsGroundspeed().
+		The wind triangle means groundspeed and true airspeed can differ by at most the wind speed, whatever
+		 the heading. A larger difference points to a blocked pitot or a bad GPS velocity. Without a wind
+		 estimate only very large differences are flagged. Sets mySituation.AirspeedCheck to "" when
+		 there is nothing to compare.
+*/
+
+func checkAirspeedVsGroundspeed() {
+	if lastAirspeedTime.IsZero() || stratuxClock.Since(lastAirspeedTime) > externalAirspeedTimeout ||
+		!isGPSValid() || !mySituation.Moving || mySituation.TAS < airspeedCheckMinTAS {
+		mySituation.GSAirspeedDelta = 0
+		mySituation.AirspeedCheck = ""
+		return
+	}
+
+	delta := float64(mySituation.GroundSpeedF) - mySituation.TAS
+	allowed := airspeedCheckMaxWind
+	if !lastWindTime.IsZero() && stratuxClock.Since(lastWindTime) < externalAirspeedTimeout {
+		allowed = mySituation.WindSpeed
+	}
+	allowed += airspeedCheckMargin
+
+	mySituation.GSAirspeedDelta = delta
+	if math.Abs(delta) <= allowed {
+		mySituation.AirspeedCheck = "OK"
+		return
+	}
+	check := fmt.Sprintf("Groundspeed differs from airspeed by %.0f kt, more than the wind explains", delta)
+	if mySituation.AirspeedCheck != check {
+		logf(LOG_WARN, "%s (GS %.0f kt, TAS %.0f kt).\n", check, mySituation.GroundSpeedF, mySituation.TAS)
+	}
+	mySituation.AirspeedCheck = check
+}
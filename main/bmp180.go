@@ -0,0 +1,331 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	bmp180.go: Temperature and pressure altitude from the BMP180, BMP280 or BME280 pressure sensor.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kidoman/embd/sensor/bmp180"
+)
+
+const (
+	pressureAltMin        = -2000.0 // Readings outside of this range (ft) are rejected.
+	pressureAltMax        = 60000.0
+	pressureSensorMaxFail = 10 // Consecutive rejected readings before the sensor is declared failed.
+)
+
+// PressureSensor is an onboard barometric sensor. Altitude is pressure altitude in meters.
+type PressureSensor interface {
+	Temperature() (float64, error) // ºC.
+	Altitude() (float64, error)
+}
+
+// humiditySensor is a PressureSensor that also measures relative humidity (BME280).
+type humiditySensor interface {
+	Humidity() (float64, error) // Percent.
+}
+
+var myPressureSensor PressureSensor
+
+// pressureSource is the plausibility and vertical speed state of one source of pressure altitude. The onboard
+// sensor and the network source (see setExternalPressureAlt()) each have their own, so that one can't reject or
+// skew the other's readings.
+type pressureSource struct {
+	name            string
+	lastGoodAlt     float64
+	lastGoodAltTime time.Time // stratuxClock time of lastGoodAlt. Zero until the first good reading.
+	rejects         int       // Consecutive implausible readings.
+	failed          *bool     // Too many implausible readings in a row. The onboard sensor's is in globalStatus.
+
+	vertVelFilter movingAverage
+	lastAlt       float64
+	lastAltTime   time.Time // stratuxClock time of lastAlt. Zero until the first sample.
+}
+
+var onboardPressure = &pressureSource{name: "Pressure sensor", failed: &globalStatus.Pressure_sensor_failed}
+var externalPressure = &pressureSource{name: "External pressure altitude", failed: new(bool)}
+
+var pressureMutex sync.Mutex          // Serializes onboard and network updates of the pressure altitude fields.
+var pressureAltSource *pressureSource // Source of mySituation.Pressure_alt. Protected by pressureMutex.
+
+// newPressureSensor starts the driver for the pressure sensor found by hardwareSelfTest().
+func newPressureSensor() (PressureSensor, error) {
+	switch globalStatus.Pressure_sensor {
+	case "BMP180":
+		return bmp180.New(i2cbus), nil
+	case "BMP280", "BME280":
+		return newBMX280(i2cbus, pressureSensorAddr, globalStatus.Pressure_sensor == "BME280")
+	}
+	return nil, fmt.Errorf("unsupported pressure sensor: %s", globalStatus.Pressure_sensor)
+}
+
+// initPressureSensor starts reading the pressure sensor, if a supported one was found. A sensor that fails to
+// initialize is retried by tempAndPressureReader().
+func initPressureSensor() {
+	switch globalStatus.Pressure_sensor {
+	case "BMP180", "BMP280", "BME280":
+	default:
+		log.Printf("No supported pressure sensor found (pressure sensor: %s). Pressure altitude not available.\n", globalStatus.Pressure_sensor)
+		return
+	}
+	sensor, err := newPressureSensor()
+	if err != nil {
+		log.Printf("%s init failed: %s. Will retry.\n", globalStatus.Pressure_sensor, err.Error())
+	} else {
+		myPressureSensor = sensor
+	}
+	go tempAndPressureReader()
+}
+
+const (
+	pressureSensorReinitErrors = 5 // Consecutive read errors before the driver is re-initialized.
+	pressureSensorMaxReinits   = 3 // Re-initializations before the sensor is declared failed.
+)
+
+var pressureReadErrors int // Consecutive read errors. Only touched by tempAndPressureReader().
+var pressureReinits int
+
+/*
+	pressureSensorReadError().
+		Counts a failed pressure sensor read. Every pressureSensorReinitErrors errors in a row the driver is
+		 re-initialized, up to pressureSensorMaxReinits times; after that the sensor is declared failed, but
+		 reads carry on so that it recovers by itself if the I2C bus does. Only the pressure sensor is
+		 affected - the IMU has its own error handling (see imuWatchdog()).
+*/
+
+func pressureSensorReadError(err error) {
+	pressureReadErrors++
+	globalStatus.Pressure_sensor_read_errors = pressureReadErrors
+	if pressureReadErrors == 1 || pressureReadErrors%100 == 0 {
+		log.Printf("Pressure sensor read error (%d in a row): %s\n", pressureReadErrors, err.Error())
+	}
+	if pressureReadErrors%pressureSensorReinitErrors != 0 {
+		return
+	}
+	if pressureReinits >= pressureSensorMaxReinits {
+		if !globalStatus.Pressure_sensor_failed {
+			log.Printf("Pressure sensor: still failing after %d re-initializations. Declaring it failed.\n", pressureReinits)
+			globalStatus.Pressure_sensor_failed = true
+		}
+		return
+	}
+	pressureReinits++
+	log.Printf("Pressure sensor: re-initializing (%d of %d).\n", pressureReinits, pressureSensorMaxReinits)
+	if sensor, err := newPressureSensor(); err == nil {
+		myPressureSensor = sensor
+	} else {
+		log.Printf("Pressure sensor re-init failed: %s\n", err.Error())
+	}
+}
+
+// pressureSensorReadOK clears the read error state after a good read.
+func pressureSensorReadOK() {
+	if pressureReadErrors > 0 && pressureReinits > 0 {
+		log.Printf("Pressure sensor: reading again.\n")
+	}
+	pressureReadErrors = 0
+	pressureReinits = 0
+	globalStatus.Pressure_sensor_read_errors = 0
+}
+
+func readPressureSensor() (float64, float64, error) { // ºCelsius, Feet
+	if myPressureSensor == nil {
+		return 0.0, 0.0, fmt.Errorf("%s not initialized", globalStatus.Pressure_sensor)
+	}
+	temp, err := myPressureSensor.Temperature()
+	if err != nil {
+		return temp, 0.0, err
+	}
+	altitude, err := myPressureSensor.Altitude()
+	altitude = float64(1/0.3048) * altitude // Convert meters to feet.
+	if err != nil {
+		return temp, altitude, err
+	}
+	return temp, altitude, nil
+}
+
+/*
+	isPressureAltPlausible().
+		Rejects pressure altitudes from source p outside of pressureAltMin..pressureAltMax and single-sample
+		 jumps that imply a vertical speed beyond globalSettings.MaxVertVel, so that the last good value is
+		 held instead. After pressureSensorMaxFail rejects in a row the source is declared failed, and the
+		 next in-range reading is taken as a new baseline.
+*/
+
+func isPressureAltPlausible(p *pressureSource, alt float64) bool {
+	ok := alt >= pressureAltMin && alt <= pressureAltMax
+	if !ok {
+		log.Printf("%s: %.0f ft out of range.\n", p.name, alt)
+	} else if !p.lastGoodAltTime.IsZero() && !*p.failed {
+		minutes := stratuxClock.Since(p.lastGoodAltTime).Minutes()
+		ok = minutes > 0 && isVertVelPlausible(float32((alt-p.lastGoodAlt)/minutes), "Baro")
+	}
+
+	if !ok {
+		p.rejects++
+		if p.rejects >= pressureSensorMaxFail && !*p.failed {
+			log.Printf("%s: %d bad readings in a row. Declaring it failed.\n", p.name, p.rejects)
+			*p.failed = true
+		}
+		return false
+	}
+
+	if *p.failed {
+		log.Printf("%s: readings plausible again.\n", p.name)
+	}
+	p.rejects = 0
+	*p.failed = false
+	p.lastGoodAlt = alt
+	p.lastGoodAltTime = stratuxClock.Time
+	return true
+}
+
+const (
+	altimeterSettingMin = 900.0 // hPa. Altimeter settings outside of this range are rejected.
+	altimeterSettingMax = 1100.0
+)
+
+// setAltimeterSetting sets the altimeter setting (QNH) used for IndicatedAlt. Values below 100 are taken as inHg,
+// anything else as hPa. Takes effect with the next pressure altitude, and is saved with the settings.
+func setAltimeterSetting(v float64) bool {
+	if v < 100 {
+		v *= 33.8639 // inHg to hPa.
+	}
+	if v < altimeterSettingMin || v > altimeterSettingMax {
+		return false
+	}
+	globalSettings.AltimeterSetting = v
+	saveSettings()
+	return true
+}
+
+// updateIndicatedAlt sets mySituation.IndicatedAlt from a pressure altitude (ft) and the altimeter setting.
+func updateIndicatedAlt(pressureAlt float64) {
+	qnh := globalSettings.AltimeterSetting
+	if qnh < altimeterSettingMin || qnh > altimeterSettingMax {
+		qnh = 1013.25
+	}
+	mySituation.IndicatedAlt = indicatedAltitude(pressureAlt, qnh)
+}
+
+/*
+	updateBaroVertVel().
+		Differentiates successive accepted pressure altitudes (ft) from source p into mySituation.BaroVertVel,
+		 ft/min, averaged over the "barovertvel" filter window. Single-sample spikes have already been rejected
+		 by isPressureAltPlausible(). The first sample, or the first after a gap of more than 5 seconds, only
+		 sets the baseline.
+*/
+
+func updateBaroVertVel(p *pressureSource, alt float64) {
+	dt := stratuxClock.Since(p.lastAltTime).Minutes()
+	if p.lastAltTime.IsZero() || dt > 5.0/60 {
+		p.vertVelFilter = movingAverage{}
+		mySituation.BaroVertVel = 0
+	} else if dt > 0 {
+		n := int(filterWindowSeconds("barovertvel")/(dt*60) + 0.5) // Samples in the window, at this sample's interval.
+		if n < 1 {
+			n = 1
+		}
+		mySituation.BaroVertVel = p.vertVelFilter.add((alt-p.lastAlt)/dt, n)
+	}
+	p.lastAlt = alt
+	p.lastAltTime = stratuxClock.Time
+}
+
+// usePressureAlt makes alt (ft) from source p the current pressure altitude. After a switch of source, p's vertical
+// speed baseline is restarted, so that the step between the two sources isn't seen as a climb or descent.
+// Must be called with pressureMutex held.
+func usePressureAlt(p *pressureSource, alt float64) {
+	if p != pressureAltSource {
+		p.lastAltTime = time.Time{}
+		pressureAltSource = p
+	}
+	mySituation.Pressure_alt = alt
+	updateBaroVertVel(p, alt)
+	updateIndicatedAlt(alt)
+	mySituation.LastTempPressTime = stratuxClock.Time
+}
+
+const externalPressureTimeout = 5 * time.Second
+
+var lastExternalPressureTime time.Time // stratuxClock time of the last pressure altitude from the network.
+var lastOnboardTempTime time.Time      // stratuxClock time of the last onboard sensor temperature.
+
+// isExternalPressureFresh reports whether a recent network pressure altitude should be used instead of the onboard sensor.
+func isExternalPressureFresh() bool {
+	return globalSettings.ExternalPressure_Enabled && !lastExternalPressureTime.IsZero() &&
+		stratuxClock.Since(lastExternalPressureTime) < externalPressureTimeout
+}
+
+/*
+	setExternalPressureAlt().
+		Takes a pressure altitude (ft), and optionally QNH (hPa, 0 if not known), from an external altimeter on
+		 the network. While fresh it replaces the onboard sensor reading; after externalPressureTimeout without
+		 an update the onboard sensor takes over again. The same plausibility checks as the onboard sensor apply,
+		 with their own state, and implausible network readings never mark the onboard sensor failed.
+*/
+
+func setExternalPressureAlt(alt, qnh float64) bool {
+	if !globalSettings.ExternalPressure_Enabled {
+		return false
+	}
+	pressureMutex.Lock()
+	defer pressureMutex.Unlock()
+	rawSituation.Pressure_alt = alt
+	if !isPressureAltPlausible(externalPressure, alt) {
+		return false
+	}
+	lastExternalPressureTime = stratuxClock.Time
+	usePressureAlt(externalPressure, alt)
+	mySituation.Pressure_alt_source = "external"
+	if qnh > 0 {
+		mySituation.QNH = qnh
+	}
+	if stratuxClock.Since(lastOnboardTempTime) < 15*time.Second {
+		mySituation.DensityAltitude = densityAltitude(alt, mySituation.Temp)
+	}
+	return true
+}
+
+func tempAndPressureReader() {
+	timer := time.NewTicker(1 * time.Second) // Read functions in bmp180 are slow.
+	for {
+		<-timer.C
+		if globalSettings.DemoMode {
+			continue
+		}
+		temp, alt, err := readPressureSensor()
+		if err != nil {
+			pressureSensorReadError(err)
+			continue
+		}
+		pressureSensorReadOK()
+		mySituation.Temp = temp
+		if humidity, ok := myPressureSensor.(humiditySensor); ok {
+			if h, err := humidity.Humidity(); err == nil {
+				mySituation.Humidity = h
+			}
+		}
+		lastOnboardTempTime = stratuxClock.Time
+		pressureMutex.Lock()
+		if !isExternalPressureFresh() { // Otherwise the network source is in use. See setExternalPressureAlt().
+			rawSituation.Pressure_alt = alt
+			if isPressureAltPlausible(onboardPressure, alt) { // If not, hold the last good value.
+				usePressureAlt(onboardPressure, alt)
+				mySituation.Pressure_alt_source = globalStatus.Pressure_sensor
+				mySituation.DensityAltitude = densityAltitude(alt, temp)
+			}
+		}
+		pressureMutex.Unlock()
+	}
+}
@@ -0,0 +1,158 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	bmp280.go: Driver for the Bosch BMP280 and BME280 pressure sensors.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/kidoman/embd"
+)
+
+const (
+	BMX280_REG_CALIB_TP = 0x88 // 24 bytes of temperature and pressure trimming parameters.
+	BMX280_REG_CALIB_H1 = 0xA1
+	BMX280_REG_CALIB_H2 = 0xE1 // 7 bytes of humidity trimming parameters.
+	BMX280_REG_CTRL_HUM = 0xF2
+	BMX280_REG_CTRL     = 0xF4
+	BMX280_REG_CONFIG   = 0xF5
+	BMX280_REG_DATA     = 0xF7 // Pressure, temperature and (BME280) humidity ADC values.
+)
+
+// bmx280 reads a BMP280, or a BME280 which adds humidity. It implements PressureSensor.
+type bmx280 struct {
+	bus      embd.I2CBus
+	addr     byte
+	humidity bool // BME280.
+
+	t1                                 float64
+	t2, t3                             float64
+	p1, p2, p3, p4, p5, p6, p7, p8, p9 float64
+	h1, h2, h3, h4, h5, h6             float64
+}
+
+// newBMX280 reads the sensor's trimming parameters and starts it measuring continuously.
+func newBMX280(bus embd.I2CBus, addr byte, humidity bool) (*bmx280, error) {
+	b := &bmx280{bus: bus, addr: addr, humidity: humidity}
+
+	c := make([]byte, 24)
+	if err := bus.ReadFromReg(addr, BMX280_REG_CALIB_TP, c); err != nil {
+		return nil, fmt.Errorf("reading calibration: %s", err.Error())
+	}
+	u16 := func(i int) float64 { return float64(binary.LittleEndian.Uint16(c[i:])) }
+	s16 := func(i int) float64 { return float64(int16(binary.LittleEndian.Uint16(c[i:]))) }
+	b.t1, b.t2, b.t3 = u16(0), s16(2), s16(4)
+	b.p1, b.p2, b.p3, b.p4, b.p5 = u16(6), s16(8), s16(10), s16(12), s16(14)
+	b.p6, b.p7, b.p8, b.p9 = s16(16), s16(18), s16(20), s16(22)
+
+	if humidity {
+		h1, err := bus.ReadByteFromReg(addr, BMX280_REG_CALIB_H1)
+		if err != nil {
+			return nil, fmt.Errorf("reading calibration: %s", err.Error())
+		}
+		h := make([]byte, 7)
+		if err := bus.ReadFromReg(addr, BMX280_REG_CALIB_H2, h); err != nil {
+			return nil, fmt.Errorf("reading calibration: %s", err.Error())
+		}
+		b.h1 = float64(h1)
+		b.h2 = float64(int16(binary.LittleEndian.Uint16(h[0:])))
+		b.h3 = float64(h[2])
+		b.h4 = float64(int16(uint16(int8(h[3]))<<4 | uint16(h[4]&0x0F)))
+		b.h5 = float64(int16(uint16(int8(h[5]))<<4 | uint16(h[4]>>4)))
+		b.h6 = float64(int8(h[6]))
+		// Humidity oversampling x1. Only takes effect after the following write to the control register.
+		if err := bus.WriteByteToReg(addr, BMX280_REG_CTRL_HUM, 0x01); err != nil {
+			return nil, err
+		}
+	}
+
+	// Standby 62.5 ms, IIR filter x16.
+	if err := bus.WriteByteToReg(addr, BMX280_REG_CONFIG, 0x30); err != nil {
+		return nil, err
+	}
+	// Temperature oversampling x2, pressure oversampling x16, normal (continuous) mode.
+	if err := bus.WriteByteToReg(addr, BMX280_REG_CTRL, 0x57); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+/*
+	read().
+		Reads and compensates one measurement: temperature (ºC), pressure (Pa) and, on a BME280, relative
+		 humidity (%). The compensation is the floating point version from the Bosch datasheets.
+*/
+
+func (b *bmx280) read() (temp, press, hum float64, err error) {
+	d := make([]byte, 8)
+	n := 6
+	if b.humidity {
+		n = 8
+	}
+	if err = b.bus.ReadFromReg(b.addr, BMX280_REG_DATA, d[:n]); err != nil {
+		return
+	}
+	adcP := float64(uint32(d[0])<<12 | uint32(d[1])<<4 | uint32(d[2])>>4)
+	adcT := float64(uint32(d[3])<<12 | uint32(d[4])<<4 | uint32(d[5])>>4)
+	adcH := float64(uint32(d[6])<<8 | uint32(d[7]))
+
+	var1 := (adcT/16384.0 - b.t1/1024.0) * b.t2
+	var2 := (adcT/131072.0 - b.t1/8192.0) * (adcT/131072.0 - b.t1/8192.0) * b.t3
+	tFine := var1 + var2
+	temp = tFine / 5120.0
+
+	var1 = tFine/2.0 - 64000.0
+	var2 = var1 * var1 * b.p6 / 32768.0
+	var2 = var2 + var1*b.p5*2.0
+	var2 = var2/4.0 + b.p4*65536.0
+	var1 = (b.p3*var1*var1/524288.0 + b.p2*var1) / 524288.0
+	var1 = (1.0 + var1/32768.0) * b.p1
+	if var1 == 0 {
+		err = fmt.Errorf("invalid pressure calibration")
+		return
+	}
+	press = 1048576.0 - adcP
+	press = (press - var2/4096.0) * 6250.0 / var1
+	var1 = b.p9 * press * press / 2147483648.0
+	var2 = press * b.p8 / 32768.0
+	press = press + (var1+var2+b.p7)/16.0
+
+	if b.humidity {
+		h := tFine - 76800.0
+		h = (adcH - (b.h4*64.0 + b.h5/16384.0*h)) * (b.h2 / 65536.0 * (1.0 + b.h6/67108864.0*h*(1.0+b.h3/67108864.0*h)))
+		hum = math.Max(0, math.Min(100, h*(1.0-b.h1*h/524288.0)))
+	}
+	return
+}
+
+// Temperature returns the temperature in ºC.
+func (b *bmx280) Temperature() (float64, error) {
+	temp, _, _, err := b.read()
+	return temp, err
+}
+
+// Altitude returns the pressure altitude in meters, standard atmosphere.
+func (b *bmx280) Altitude() (float64, error) {
+	_, press, _, err := b.read()
+	if err != nil {
+		return 0, err
+	}
+	return 44330.0 * (1.0 - math.Pow(press/101325.0, 0.190295)), nil
+}
+
+// Humidity returns the relative humidity in percent. BME280 only.
+func (b *bmx280) Humidity() (float64, error) {
+	if !b.humidity {
+		return 0, fmt.Errorf("%s has no humidity sensor", globalStatus.Pressure_sensor)
+	}
+	_, _, hum, err := b.read()
+	return hum, err
+}
@@ -182,17 +182,36 @@ var sqlTypeMap = map[reflect.Kind]string{
 	reflect.UnsafePointer: "notsupported",
 }
 
+// structFields returns the names and values of the fields of a struct, with the fields of embedded structs
+// (e.g. SituationData.GPSSituationData) in place of the embedded struct itself.
+func structFields(val reflect.Value) ([]string, []reflect.Value) {
+	names := make([]string, 0)
+	values := make([]reflect.Value, 0)
+	for i := 0; i < val.NumField(); i++ {
+		if val.Type().Field(i).Anonymous && val.Field(i).Kind() == reflect.Struct {
+			n, v := structFields(val.Field(i))
+			names = append(names, n...)
+			values = append(values, v...)
+			continue
+		}
+		names = append(names, val.Type().Field(i).Name)
+		values = append(values, val.Field(i))
+	}
+	return names, values
+}
+
 func makeTable(i interface{}, tbl string, db *sql.DB) {
 	val := reflect.ValueOf(i)
+	names, vals := structFields(val)
 
 	fields := make([]string, 0)
-	for i := 0; i < val.NumField(); i++ {
-		kind := val.Field(i).Kind()
-		fieldName := val.Type().Field(i).Name
+	for i := 0; i < len(vals); i++ {
+		kind := vals[i].Kind()
+		fieldName := names[i]
 		sqlTypeAlias := sqlTypeMap[kind]
 
 		// Check that if the field is a struct that it can be marshalled.
-		if sqlTypeAlias == "struct" && !structCanBeMarshalled(val.Field(i)) {
+		if sqlTypeAlias == "struct" && !structCanBeMarshalled(vals[i]) {
 			continue
 		}
 		if sqlTypeAlias == "notsupported" || fieldName == "id" {
@@ -283,19 +302,20 @@ var insertBatchIfs map[string][][]interface{}
 
 func insertData(i interface{}, tbl string, db *sql.DB, ts_num int64) int64 {
 	val := reflect.ValueOf(i)
+	names, vals := structFields(val)
 
 	keys := make([]string, 0)
 	values := make([]string, 0)
-	for i := 0; i < val.NumField(); i++ {
-		kind := val.Field(i).Kind()
-		fieldName := val.Type().Field(i).Name
+	for i := 0; i < len(vals); i++ {
+		kind := vals[i].Kind()
+		fieldName := names[i]
 		sqlTypeAlias := sqlTypeMap[kind]
 
 		if sqlTypeAlias == "notsupported" || fieldName == "id" {
 			continue
 		}
 
-		v := sqliteMarshalFunctions[sqlTypeAlias].Marshal(val.Field(i))
+		v := sqliteMarshalFunctions[sqlTypeAlias].Marshal(vals[i])
 
 		keys = append(keys, fieldName)
 		values = append(values, v)
@@ -506,7 +526,7 @@ func dataLog() {
 		Create a timestamp entry using GPS time.
 */
 
-func setDataLogTimeWithGPS(sit SituationData) {
+func setDataLogTimeWithGPS(sit GPSSituationData) {
 	if isGPSClockValid() {
 		var ts StratuxTimestamp
 		// Piggyback a GPS time update from this update.
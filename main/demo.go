@@ -0,0 +1,106 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	demo.go: Static "demo/screenshot" situation, for documentation screenshots and UI testing.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Attitude shown in demo mode. Straight and level.
+const (
+	demoPitch   = 0.0
+	demoRoll    = 0.0
+	demoHeading = 270.0
+)
+
+// Satellites shown in demo mode: NMEA ID, elevation, azimuth, signal. All in solution.
+var demoSatellites = [][4]int{
+	{2, 67, 310, 45}, {5, 41, 52, 44}, {6, 22, 128, 38}, {9, 15, 220, 35}, {12, 55, 175, 46},
+	{17, 30, 280, 41}, {19, 12, 80, 33}, {25, 48, 10, 43}, {29, 35, 245, 40}, {31, 18, 160, 36},
+	{46, 38, 194, 42}, {48, 33, 230, 40}, // SBAS (WAAS)
+	{66, 52, 300, 40}, {67, 25, 20, 37}, {75, 44, 140, 39}, {76, 20, 200, 34}, {82, 61, 90, 41}, {83, 28, 330, 36},
+}
+
+/*
+	setDemoSituation().
+		Holds mySituation at a fixed, valid, deterministic situation: a GPS + SBAS fix with a full
+		 constellation, level attitude and a reasonable altitude and speed. The sensor readers skip their
+		 updates while globalSettings.DemoMode is set, and the timestamps are refreshed here so that every
+		 validity check stays true.
+*/
+
+func setDemoSituation() {
+	mySituation.mu_GPS.Lock()
+	globalStatus.GPS_connected = true
+	mySituation.LastValidNMEAMessageTime = stratuxClock.Time
+	mySituation.LastFixLocalTime = stratuxClock.Time
+	mySituation.LastGroundTrackTime = stratuxClock.Time
+	mySituation.LastGPSTimeTime = stratuxClock.Time
+	mySituation.GPSTime = time.Now().UTC()
+	mySituation.GPSWeek = gpsWeekNumber(mySituation.GPSTime)
+	mySituation.Lat = 43.9844
+	mySituation.Lng = -88.5570
+	mySituation.Quality = 2
+	mySituation.Alt = 4500
+	mySituation.GeoidSep = -112
+	mySituation.HeightAboveEllipsoid = mySituation.Alt + mySituation.GeoidSep
+	mySituation.Accuracy = 3
+	mySituation.AccuracyVert = 5
+	mySituation.HDOP = 0.8
+	mySituation.PDOP = 1.4
+	mySituation.NACp = 10
+	mySituation.GroundSpeed = 110
+	mySituation.GroundSpeedF = 110
+	mySituation.TrueCourse = demoHeading
+	mySituation.DisplayCourse = demoHeading
+	mySituation.GPSVertVel = 0
+	mySituation.FixFrozen = false
+	setUncertaintyRadius(&mySituation.GPSSituationData)
+
+	satelliteMutex.Lock()
+	for _, d := range demoSatellites {
+		sat := SatelliteInfo{SatelliteNMEA: uint8(d[0]), Elevation: int16(d[1]), Azimuth: int16(d[2]), Signal: int8(d[3]),
+			TimeLastSolution: stratuxClock.Time, TimeLastSeen: stratuxClock.Time, TimeLastTracked: stratuxClock.Time,
+			InSolution: true, HasEphemeris: true}
+		switch {
+		case d[0] <= 32:
+			sat.Type = SAT_TYPE_GPS
+			sat.SatelliteID = fmt.Sprintf("G%d", d[0])
+		case d[0] < 65:
+			sat.Type = SAT_TYPE_SBAS
+			sat.SatelliteID = fmt.Sprintf("S%d", d[0]+87)
+		default:
+			sat.Type = SAT_TYPE_GLONASS
+			sat.SatelliteID = fmt.Sprintf("R%d", d[0]-64)
+		}
+		Satellites[sat.SatelliteID] = sat
+	}
+	updateConstellation()
+	satelliteMutex.Unlock()
+	mySituation.mu_GPS.Unlock()
+
+	mySituation.Temp = 15
+	mySituation.Pressure_alt = 4400
+	updateIndicatedAlt(mySituation.Pressure_alt)
+	mySituation.DensityAltitude = densityAltitude(mySituation.Pressure_alt, mySituation.Temp)
+	mySituation.LastTempPressTime = stratuxClock.Time
+	lastIMUReadTime = stratuxClock.Time
+}
+
+func demoSituationSender() {
+	timer := time.NewTicker(200 * time.Millisecond)
+	for {
+		<-timer.C
+		if globalSettings.DemoMode {
+			setDemoSituation()
+		}
+	}
+}
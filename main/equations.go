@@ -246,9 +246,45 @@ func degreesHdg(angle float64) float64 {
 	for angle < 0 {
 		angle += 2 * math.Pi
 	}
+	for angle >= 2*math.Pi {
+		angle -= 2 * math.Pi
+	}
 	return angle * 180.0 / math.Pi
 }
 
+// offsetLatLon moves a point (decimal degrees) by north and east distances in meters, for small offsets.
+// Longitude is wrapped across the antimeridian, and a point moved past a pole comes back down the other side.
+func offsetLatLon(lat, lon, north, east float64) (float64, float64) {
+	radius_earth := 6371008.8 // meters; mean radius
+	lat += degrees(north / radius_earth)
+	if lat > 90 {
+		lat = 180 - lat
+		lon += 180
+	} else if lat < -90 {
+		lat = -180 - lat
+		lon += 180
+	}
+	cosLat := math.Cos(radians(lat))
+	if cosLat > 1e-6 { // East is undefined at the poles.
+		lon += degrees(east / (radius_earth * cosLat))
+	}
+	return lat, degreesRel(radians(lon))
+}
+
+// densityAltitude returns the density altitude (ft) for a pressure altitude (ft) and outside air temperature (ºC),
+// from the ISA pressure ratio at pressure altitude and the measured temperature ratio. Dry air.
+func densityAltitude(pressureAlt, temp float64) float64 {
+	delta := math.Pow(1-6.8755856e-6*pressureAlt, 5.2558797) // Pressure ratio, P/P0.
+	theta := (temp + 273.15) / 288.15                        // Temperature ratio, T/T0.
+	return 145442.16 * (1 - math.Pow(delta/theta, 0.234969))
+}
+
+// indicatedAltitude returns the altitude (ft) an altimeter set to qnh (hPa) shows at the given pressure altitude (ft).
+func indicatedAltitude(pressureAlt, qnh float64) float64 {
+	p := 1013.25 * math.Pow(1-6.8755856e-6*pressureAlt, 5.2558797) // Static pressure, hPa.
+	return 145442.16 * (1 - math.Pow(p/qnh, 0.190263))
+}
+
 /*
 Distance functions based on rectangular coordinate systems
 Simple calculations and "good enough" on small scale (± 1° of lat / lon)
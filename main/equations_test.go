@@ -0,0 +1,74 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	equations_test.go: Tests for the angle and position helpers.
+*/
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistRectAntimeridian(t *testing.T) {
+	tests := []struct {
+		lon1, lon2  float64
+		wantBearing float64
+	}{
+		{179.9, -179.9, 90},
+		{-179.9, 179.9, 270},
+	}
+	for _, tt := range tests {
+		dist, bearing, _, _ := distRect(0, tt.lon1, 0, tt.lon2)
+		if math.Abs(dist-22239) > 10 {
+			t.Errorf("distRect(0, %v, 0, %v): distance %.0f m, want 22239 m", tt.lon1, tt.lon2, dist)
+		}
+		if math.Abs(bearing-tt.wantBearing) > 0.01 {
+			t.Errorf("distRect(0, %v, 0, %v): bearing %.2f, want %v", tt.lon1, tt.lon2, bearing, tt.wantBearing)
+		}
+	}
+}
+
+func TestOffsetLatLon(t *testing.T) {
+	tests := []struct {
+		name             string
+		lat, lon         float64
+		north, east      float64
+		wantLat, wantLon float64
+	}{
+		{"east across the antimeridian", 0, 179.99, 0, 2000, 0, -179.992},
+		{"west across the antimeridian", 0, -179.99, 0, -2000, 0, 179.992},
+		{"over the north pole", 89.99, 10, 2000, 0, 89.992, -170},
+		{"over the south pole", -89.99, -10, -2000, 0, -89.992, 170},
+		{"east near the north pole", 89.9, 179.9, 0, 100, 89.9, -179.585},
+	}
+	for _, tt := range tests {
+		lat, lon := offsetLatLon(tt.lat, tt.lon, tt.north, tt.east)
+		if math.Abs(lat-tt.wantLat) > 0.001 || math.Abs(lon-tt.wantLon) > 0.001 {
+			t.Errorf("%s: got %.4f, %.4f, want %.4f, %.4f", tt.name, lat, lon, tt.wantLat, tt.wantLon)
+		}
+	}
+}
+
+func TestAngleWrap(t *testing.T) {
+	for _, tt := range []struct{ in, rel, hdg float64 }{
+		{0, 0, 0},
+		{190, -170, 190},
+		{-190, 170, 170},
+		{360, 0, 0},
+		{540, 180, 180},
+		{-350, 10, 10},
+		{719, -1, 359},
+	} {
+		if got := degreesRel(radians(tt.in)); math.Abs(got-tt.rel) > 1e-9 {
+			t.Errorf("degreesRel(radians(%v)) = %v, want %v", tt.in, got, tt.rel)
+		}
+		if got := degreesHdg(radians(tt.in)); math.Abs(got-tt.hdg) > 1e-9 {
+			t.Errorf("degreesHdg(radians(%v)) = %v, want %v", tt.in, got, tt.hdg)
+		}
+	}
+}
@@ -45,6 +45,7 @@ const (
 	managementAddr = ":80"
 	debugLog       = "/var/log/stratux.log"
 	dataLogFile    = "/var/log/stratux.sqlite"
+	logDir         = "/var/log/stratux/" // Session logs (raw GPS captures, etc.), browsable via /view_logs/.
 	//FlightBox: log to /root.
 	debugLog_FB         = "/root/stratux.log"
 	dataLogFile_FB      = "/var/log/stratux.sqlite"
@@ -90,11 +91,9 @@ var Crc16Table [256]uint16
 // Current AHRS, pressure altitude, etc.
 var mySituation SituationData
 
-type SituationData struct {
-	mu_GPS *sync.Mutex
-
-	// From GPS.
-	LastFixSinceMidnightUTC  float32
+// GPSSituationData is the part of SituationData that comes from the GPS. Protected by SituationData.mu_GPS.
+type GPSSituationData struct {
+	LastFixSinceMidnightUTC  float64 // Seconds, with the receiver's sub-second resolution.
 	Lat                      float32
 	Lng                      float32
 	Quality                  uint8
@@ -105,33 +104,114 @@ type SituationData struct {
 	SatellitesSeen           uint16  // satellites seen (signal received)
 	Accuracy                 float32 // 95% confidence for horizontal position, meters.
 	NACp                     uint8   // NACp categories are defined in AC 20-165A
+	VelocityAccuracy         float32 // 95% confidence for horizontal velocity, m/s. From UBX-NAV-PVT only; 0 if unknown.
+	NACv                     uint8   // NACv category (DO-260B) for VelocityAccuracy. 0 = unknown. See calculateNACv().
 	Alt                      float32 // Feet MSL
+	HDOP                     float32 // Horizontal dilution of precision, from GSA.
+	PDOP                     float32 // Position (3D) dilution of precision, from GSA. 0 when not reported.
 	AccuracyVert             float32 // 95% confidence for vertical position, meters
+	AccuracyWeight           float32 // Constellation weighting factor applied to the HDOP accuracy estimate. 1.0 = unweighted.
+	SolutionMix              string  // Satellites in solution by constellation, e.g. "GPS:8 GLONASS:4 SBAS:1"
+	FixFrozen                bool    // Receiver keeps reporting the same position. See checkFrozenFix().
+	UncertaintyRadiusM       float32 // Radius of the 95% horizontal position uncertainty circle, meters. For display.
+	UncertaintyRadiusFt      float32 // Same, feet.
+	UncertaintyRadiusNM      float32 // Same, nautical miles.
+	UncertaintyRadiusValid   bool    // False when there is no valid fix.
 	GPSVertVel               float32 // GPS vertical velocity, feet per second
 	LastFixLocalTime         time.Time
 	TrueCourse               float32
-	GroundSpeed              uint16
+	DisplayCourse            float32 // TrueCourse, slew rate limited for display. See updateDisplayCourse().
+	MagneticVariation        float32 // Degrees, east positive. From RMC.
+	MagneticVariationValid   bool    // False until the receiver reports a variation.
+	MagneticCourse           float32 // TrueCourse - MagneticVariation. See updateMagneticCourse().
+	GroundSpeed              uint16  // Knots, rounded.
+	GroundSpeedF             float32 // Knots, full resolution for slow flight.
 	LastGroundTrackTime      time.Time
-	GPSTime                  time.Time
+	GPSTime                  time.Time // UTC. The receiver has already applied GPSLeapSeconds.
+	GPSWeek                  int       // Week number (epoch 1980-01-06) of GPSTime. From PUBX,04, otherwise from the date.
+	GPSLeapSeconds           int       // GPS-UTC offset in effect for GPSTime. GPS time is GPSTime + GPSLeapSeconds. 0 if not reported.
 	LastGPSTimeTime          time.Time // stratuxClock time since last GPS time received.
 	LastValidNMEAMessageTime time.Time // time valid NMEA message last seen
 	LastValidNMEAMessage     string    // last NMEA message processed.
+}
+
+type SituationData struct {
+	mu_GPS *sync.Mutex
+
+	// From GPS. Updated as a unit by processNMEALine, so a message that turns out to be unusable changes nothing.
+	GPSSituationData
+
+	// From GPS, but kept up to date by updateConstellation() and updateStatus() rather than by a single message,
+	//  so not part of GPSSituationData (where committing a message would roll them back). Protected by mu_GPS.
+	SatellitesRanging        uint16 // satellites used in solution, excluding SBAS
+	SatellitesGPS            uint16 // Per constellation, in solution. See updateConstellation().
+	SatellitesGLONASS        uint16
+	SatellitesGalileo        uint16
+	SatellitesBeiDou         uint16
+	SatellitesQZSS           uint16 // QZSS ranging satellites. SLAS augmentation is counted as SBAS.
+	SatellitesSBAS           uint16
+	SatellitesGPSTracked     uint16 // Per constellation, tracked.
+	SatellitesGLONASSTracked uint16
+	SatellitesGalileoTracked uint16
+	SatellitesBeiDouTracked  uint16
+	SatellitesQZSSTracked    uint16
+	SatellitesSBASTracked    uint16
+	FixType                  string // "No Fix", "2D", "3D + SBAS"... See fixType().
+	AccuracyDiagnosis        string // Likely cause of poor accuracy (geometry or signal). See diagnoseGPSAccuracy().
 
 	mu_Attitude *sync.Mutex
 
-	// From BMP180 pressure sensor.
-	Temp              float64
-	Pressure_alt      float64
-	LastTempPressTime time.Time
+	// From the BMP180/BMP280/BME280 pressure sensor.
+	Temp                float64
+	Pressure_alt        float64 // Feet, standard atmosphere (29.92 inHg). This is what the ownship report needs.
+	IndicatedAlt        float64 // Feet, corrected to globalSettings.AltimeterSetting. See updateIndicatedAlt().
+	BaroVertVel         float64 // ft/min, from Pressure_alt. See updateBaroVertVel().
+	DensityAltitude     float64 // Feet, from Temp and Pressure_alt. Only updated while isTempPressValid().
+	Pressure_alt_source string  // Onboard sensor ("BMP180", "BMP280", "BME280"), or "external" while a network source is fresh. See setExternalPressureAlt().
+	QNH                 float64 // hPa, from the external source if it sends one.
+	Humidity            float64 // Relative humidity, percent. BME280 only.
+	LastTempPressTime   time.Time
+
+	// From an external air data source. See setExternalAirspeed().
+	TAS             float64 // Knots.
+	WindSpeed       float64 // Knots, if the source sends it.
+	GSAirspeedDelta float64 // GroundSpeedF - TAS, knots.
+	AirspeedCheck   string  // "" with nothing to compare, "OK", or the discrepancy. See checkAirspeedVsGroundspeed().
 
 	// From MPU9250 gyro/accel/mag.
 	Pitch            float64
 	Roll             float64
 	Yaw              float64
 	Gyro_heading     float64
+	SlipSkid         float64 // Degrees of inclinometer ball deflection, from lateral acceleration. Positive towards the IMU's +Y axis.
+	YawRate          float64 // Deg/s, from the gyro Z axis.
+	GLoad            float64 // G, total acceleration. 1.0 in unaccelerated flight.
 	LastAttitudeTime time.Time
+	AHRSStationary   bool    // IMU has shown no rotation or acceleration for a few seconds.
+	AHRSPitchTrim    float64 // Straight-and-level auto-trim subtracted from Pitch and Roll. See applyAutoTrim().
+	AHRSRollTrim     float64
+
+	Moving             bool // Aircraft is moving, fused from GPS and IMU. See updateAircraftMoving().
+	AHRSMotionMismatch bool // GPS has shown sustained motion while the IMU reported stationary, so the IMU may be stuck.
+
+	Raw *RawSituationData `json:",omitempty"` // Unfiltered values, only when globalSettings.ReportRawValues is set.
+}
+
+// Values before filtering, validation or correction, for checking filter behaviour in the field.
+type RawSituationData struct {
+	Lat          float32 // Before lever-arm correction.
+	Lng          float32
+	Alt          float32
+	TrueCourse   float32 // Before slew rate limiting (DisplayCourse).
+	GroundSpeed  float64 // Before suppression of GPS noise at rest, kts.
+	NACp         uint8   // Before hysteresis.
+	Pitch        float64 // Latest attitude sample, before averaging.
+	Roll         float64
+	Pressure_alt float64 // Latest pressure sensor reading, including rejected ones.
 }
 
+var rawSituation RawSituationData
+
 type WriteCloser interface {
 	io.Writer
 	io.Closer
@@ -242,6 +322,12 @@ func makeOwnshipReport() bool {
 	if !isGPSValid() {
 		return false
 	}
+	sendGDL90(prepareMessage(ownshipReport()), false)
+	return true
+}
+
+// ownshipReport encodes the ownship report from mySituation, before framing. See makeOwnshipReport().
+func ownshipReport() []byte {
 	msg := make([]byte, 28)
 	// See p.16.
 	msg[0] = 0x0A // Message type "Ownship".
@@ -289,30 +375,47 @@ func makeOwnshipReport() bool {
 	msg[11] = byte((alt & 0xFF0) >> 4) // Altitude.
 	msg[12] = byte((alt & 0x00F) << 4)
 	if isGPSGroundTrackValid() {
-		msg[12] = msg[12] | 0x09 // "Airborne" + "True Track"
+		msg[12] = msg[12] | 0x08 // "Airborne". Independent of OwnshipVelocity, which only controls the velocity fields.
+		if globalSettings.OwnshipVelocity {
+			msg[12] = msg[12] | 0x01 // "True Track"
+		}
 	}
 
 	msg[13] = byte(0x80 | (mySituation.NACp & 0x0F)) //Set NIC = 8 and use NACp from ry835ai.go.
 
-	gdSpeed := uint16(0) // 1kt resolution.
-	if isGPSGroundTrackValid() {
+	gdSpeed := uint16(0xFFF) // 1kt resolution. 0xFFF = no information available.
+	if isGPSGroundTrackValid() && globalSettings.OwnshipVelocity {
 		gdSpeed = mySituation.GroundSpeed
+		if gdSpeed > 0xFFE { // 0xFFE = 4094 kt or more.
+			gdSpeed = 0xFFE
+		}
 	}
 
 	// gdSpeed should fit in 12 bits.
 	msg[14] = byte((gdSpeed & 0xFF0) >> 4)
 	msg[15] = byte((gdSpeed & 0x00F) << 4)
 
-	verticalVelocity := int16(0x800) // ft/min. 64 ft/min resolution.
-	//TODO: 0x800 = no information available.
-	// verticalVelocity should fit in 12 bits.
+	verticalVelocity := int16(0x800) // ft/min. 64 ft/min resolution. 0x800 = no information available.
+	if isGPSVertVelValid() && globalSettings.OwnshipVelocity {
+		vv := float64(mySituation.GPSVertVel) * 60 / 64
+		verticalVelocity = int16(math.Floor(vv + 0.5))
+		if verticalVelocity > 0x1FE { // +32,640 ft/min or more.
+			verticalVelocity = 0x1FE
+		} else if verticalVelocity < -0x1FE {
+			verticalVelocity = -0x1FE
+		}
+	}
+	// verticalVelocity should fit in 12 bits, two's complement.
 	msg[15] = msg[15] | byte((verticalVelocity&0x0F00)>>8)
 	msg[16] = byte(verticalVelocity & 0xFF)
 
 	// Track is degrees true, set from GPS true course.
 	groundTrack := float32(0)
-	if isGPSGroundTrackValid() {
+	if isGPSGroundTrackValid() && globalSettings.OwnshipVelocity {
 		groundTrack = mySituation.TrueCourse
+		if globalSettings.GPS_MaxCourseSlewRate > 0 {
+			groundTrack = mySituation.DisplayCourse
+		}
 	}
 
 	tempTrack := groundTrack + TRACK_RESOLUTION/2 // offset by half the 8-bit resolution to minimize binning error
@@ -332,17 +435,14 @@ func makeOwnshipReport() bool {
 
 	msg[18] = 0x01 // "Light (ICAO) < 15,500 lbs"
 
-	// Create callsign "Stratux".
-	msg[19] = 0x53
-	msg[20] = 0x74
-	msg[21] = 0x72
-	msg[22] = 0x61
-	msg[23] = 0x74
-	msg[24] = 0x75
-	msg[25] = 0x78
+	// Callsign, 8 characters, space padded. "Stratux" unless set.
+	callsign := globalSettings.OwnshipCallsign
+	if len(callsign) == 0 {
+		callsign = "Stratux"
+	}
+	copy(msg[19:27], []byte(fmt.Sprintf("%-8.8s", callsign)))
 
-	sendGDL90(prepareMessage(msg), false)
-	return true
+	return msg
 }
 
 func makeOwnshipGeometricAltitudeReport() bool {
@@ -601,14 +701,35 @@ func relayMessage(msgtype uint16, msg []byte) {
 	sendGDL90(prepareMessage(ret), true)
 }
 
+// heartbeatInterval returns the configured GDL90 heartbeat (keepalive) period, 1 second by default.
+func heartbeatInterval() time.Duration {
+	ms := globalSettings.HeartbeatInterval
+	if ms <= 0 {
+		ms = 1000
+	} else if ms < 100 {
+		ms = 100
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
 func heartBeatSender() {
 	timer := time.NewTicker(1 * time.Second)
 	timerMessageStats := time.NewTicker(2 * time.Second)
+	// Heartbeats go out on their own ticker, at a steady rate whether or not there is a GPS fix (the
+	//  "GPS position valid" bit is cleared without one), so that EFBs don't drop the connection.
+	keepaliveInterval := heartbeatInterval()
+	keepalive := time.NewTicker(keepaliveInterval)
 	for {
 		select {
-		case <-timer.C:
+		case <-keepalive.C:
 			sendGDL90(makeHeartbeat(), false)
 			sendGDL90(makeStratuxHeartbeat(), false)
+			if i := heartbeatInterval(); i != keepaliveInterval {
+				keepalive.Stop()
+				keepaliveInterval = i
+				keepalive = time.NewTicker(keepaliveInterval)
+			}
+		case <-timer.C:
 			sendGDL90(makeStratuxStatus(), false)
 			makeOwnshipReport()
 			makeOwnshipGeometricAltitudeReport()
@@ -760,8 +881,11 @@ func updateStatus() {
 		globalStatus.GPS_solution = "Unknown"
 	}
 
-	if !(globalStatus.GPS_connected) || !(isGPSConnected()) { // isGPSConnected looks for valid NMEA messages. GPS_connected is set by gpsSerialReader and will immediately fail on disconnected USB devices, or in a few seconds after "blocked" comms on ttyAMA0.
+	// isGPSReceiving looks for any output from the GPS; isGPSConnected looks for valid NMEA messages. GPS_connected is set by gpsSerialReader and will immediately fail on disconnected USB devices, or in a few seconds after "blocked" comms on ttyAMA0.
+	// Only a receiver that has gone silent is disconnected (and reopened by pollGPS). One sending only bad sentences keeps its connection.
+	if !(globalStatus.GPS_connected) || !(isGPSReceiving()) || !(isGPSConnected()) {
 
+		mySituation.mu_GPS.Lock()
 		satelliteMutex.Lock()
 		Satellites = make(map[string]SatelliteInfo)
 		satelliteMutex.Unlock()
@@ -769,14 +893,42 @@ func updateStatus() {
 		mySituation.Satellites = 0
 		mySituation.SatellitesSeen = 0
 		mySituation.SatellitesTracked = 0
+		mySituation.SatellitesRanging = 0
+		setConstellationCounts(nil, nil)
 		mySituation.Quality = 0
-		globalStatus.GPS_solution = "Disconnected"
-		globalStatus.GPS_connected = false
+		mySituation.mu_GPS.Unlock()
+		if globalStatus.GPS_connected && isGPSReceiving() {
+			globalStatus.GPS_solution = "No valid data"
+		} else {
+			globalStatus.GPS_solution = "Disconnected"
+			globalStatus.GPS_connected = false
+		}
 	}
 
 	globalStatus.GPS_satellites_locked = mySituation.Satellites
 	globalStatus.GPS_satellites_seen = mySituation.SatellitesSeen
 	globalStatus.GPS_satellites_tracked = mySituation.SatellitesTracked
+	updateColdStartStatus()
+	updateAircraftMoving()
+	mySituation.mu_GPS.Lock()
+	mySituation.AccuracyDiagnosis = diagnoseGPSAccuracy()
+	recordFixTransition()
+	mySituation.mu_GPS.Unlock()
+	checkAirspeedVsGroundspeed()
+	if globalSettings.ReportRawValues {
+		// A copy, so that a snapshot being encoded doesn't change under it. rawSituation is written under
+		//  mu_GPS (position), mu_Attitude (attitude) and pressureMutex (pressure altitude).
+		mySituation.mu_GPS.Lock()
+		mySituation.mu_Attitude.Lock()
+		pressureMutex.Lock()
+		raw := rawSituation
+		pressureMutex.Unlock()
+		mySituation.mu_Attitude.Unlock()
+		mySituation.mu_GPS.Unlock()
+		mySituation.Raw = &raw
+	} else {
+		mySituation.Raw = nil
+	}
 
 	// Update Uptime value
 	globalStatus.Uptime = int64(stratuxClock.Milliseconds)
@@ -984,17 +1136,86 @@ func getProductNameFromId(product_id int) string {
 }
 
 type settings struct {
-	UAT_Enabled          bool
-	ES_Enabled           bool
-	GPS_Enabled          bool
-	NetworkOutputs       []networkConnection
-	AHRS_Enabled         bool
-	DisplayTrafficSource bool
-	DEBUG                bool
-	ReplayLog            bool
-	PPM                  int
-	OwnshipModeS         string
-	WatchList            string
+	UAT_Enabled               bool
+	ES_Enabled                bool
+	GPS_Enabled               bool
+	NetworkOutputs            []networkConnection
+	AHRS_Enabled              bool
+	DisplayTrafficSource      bool
+	DEBUG                     bool
+	LogLevel                  string // "error", "warn", "info", "debug" or "trace". See loglevel.go.
+	ReplayLog                 bool
+	PPM                       int
+	OwnshipModeS              string
+	OwnshipCallsign           string  // Up to 8 characters, A-Z, 0-9 and space. Sent in the GDL90 ownship report.
+	OwnshipVelocity           bool    // Send GPS groundspeed, track and vertical speed in the ownship report. Otherwise they are sent as "not available".
+	DemoMode                  bool    // Hold a fixed, valid situation for screenshots and UI testing. See setDemoSituation().
+	ExternalPressure_Enabled  bool    // Accept pressure altitude from the network (/setPressureAlt) in place of the onboard sensor.
+	AltimeterSetting          float64 // Local QNH, hPa, for IndicatedAlt. See setAltimeterSetting().
+	WatchList                 string
+	MaxVertVel                int                       // Vertical velocity sanity limit, ft/min. Readings beyond +/- this value are rejected. 0 disables.
+	HeartbeatInterval         int                       // Milliseconds between GDL90 heartbeats. Sent even without a GPS fix.
+	GPS_MinRangingSatellites  int                       // Non-SBAS satellites needed in solution for a valid fix. 0 to disable the check.
+	GPS_SBASMinSignal         int                       // dB-Hz. An SBAS satellite above this signal and GPS_SBASMinElevation is assumed in solution when the receiver doesn't say.
+	GPS_SBASMinElevation      int                       // Degrees.
+	GPS_FilterWindows         map[string]float32        // Situation filter windows in seconds, by filter name. See defaultFilterWindows.
+	GPS_RejectStaleEpochs     bool                      // Ignore position sentences whose fix time is older than the newest seen.
+	GPS_MeasRate              int                       // u-blox CFG-RATE: ms between measurements. 0 for the default (200 ms). See ubxRatePayload().
+	GPS_NavRate               int                       // Measurements per navigation solution. 0 for the default (1).
+	GPS_TimeRef               int                       // 0 = align measurements to UTC, 1 = GPS time.
+	GPS_Constellations        []string                  // Enabled GNSS: "GPS", "SBAS", "BeiDou", "QZSS", "GLONASS". Empty for GPS, SBAS and GLONASS.
+	GPS_DynModel              string                    // u-blox CFG-NAV5 dynamic platform model: "Airborne1g", "Airborne2g", "Airborne4g", "Stationary", "Pedestrian"... Empty for "Airborne2g". See ubxDynModels.
+	GPS_PreferHighRate        bool                      // u-blox: 10 Hz with GLONASS and BeiDou disabled, instead of 5 Hz multi-GNSS. See setGPSHighRate().
+	GPS_DisconnectGrace       int                       // Seconds without GPS output before reconnecting. Also the time without valid NMEA before "No valid data".
+	GPS_RawLog                bool                      // Capture the raw GPS serial stream to logDir.
+	GPS_GSVLogInterval        int                       // Seconds between synthesized GSV sentences (whole constellation) in the raw GPS log. 0 to disable.
+	GPS_AccuracyWeights       map[string]float32        // Per-constellation scaling of the HDOP accuracy estimate, keyed by name ("GPS", "GLONASS", ...). See constellationAccuracyWeight().
+	GPS_FrozenFixTimeout      int                       // Seconds of unchanging position before the fix is considered frozen. 0 disables.
+	GPS_FixAcquireTime        int                       // Seconds a fix must be continuously present before it's reported valid. See isGPSValid().
+	GPS_FixHoldTime           int                       // Seconds a fix may be missing before it's reported invalid.
+	GPS_FrozenFixInvalidate   bool                      // Invalidate a frozen fix instead of only degrading its NACp.
+	GPS_PortMessageRates      map[string]map[string]int // Per-port CFG-MSG rate overrides for u-blox receivers, keyed by port then message. See ubxMsgRatePayload().
+	GPS_NACpHysteresis        float32                   // Fraction of a NACp category boundary the accuracy must cross before NACp changes. 0 disables.
+	I2C_Speed                 int                       // I2C bus clock, Hz. 0 = leave at the boot configuration (400 kHz on the Stratux image, 100 kHz on a stock Pi). Written to /boot/config.txt at startup; takes effect after a reboot.
+	NMEA_SynthesizedGSV       bool                      // NMEA outputs send GSV sentences rebuilt from the merged constellation instead of the receiver's own. See synthesizeGSV().
+	NMEAServer_Enabled        bool                      // Stream the GPS NMEA sentences to TCP clients. See nmeaServer().
+	NMEAServer_Port           int                       // TCP port of the NMEA server.
+	NMEA_FLARMOwnship         bool                      // NMEA server also sends $PGRMZ ownship altitude and $PFLAU status, for FLARM-style consumers. See makeFLARMOwnship().
+	NMEA_AltitudeSource       string                    // Altitude in $PGRMZ: "GPS", or "Baro"/"" for pressure altitude (GPS when no pressure sensor).
+	GPSD_Enabled              bool                      // Serve gpsd JSON (TPV, SKY) on TCP port 2947. See gpsdServer().
+	GPS_Device                string                    // Serial device of the GPS, e.g. "/dev/ttyUSB1". Empty to probe for it. See detectGPSDevice().
+	GPS_Network_Source        string                    // host:port of an NMEA stream over TCP, read instead of a serial GPS. See openGPSNetwork().
+	GPS_Set_System_Time       bool                      // Set the system clock from GPS time when it's more than GPS_ClockSetThreshold off. See setSystemTimeFromGPS().
+	GPS_ClockSetThreshold     float64                   // Seconds the system clock may be off from GPS time before it's set.
+	GPS_ClockSetInterval      int                       // Minimum seconds between setting the system clock from GPS time.
+	GPS_Baud                  int                       // Baud rate for GPS_Device, and for the u-blox UART once configured. 0 for the defaults (9600, then 38400).
+	GPS_NavPVT                bool                      // u-blox: binary UBX-NAV-PVT in place of PUBX,00, for full resolution position and speed. Needs protocol 14 or later. Applied when the receiver is configured.
+	GPS_SaveConfig            bool                      // u-blox: save the configuration to the receiver's flash once applied, and skip reconfiguring it on later starts if it's still there. See openSavedUBXConfig().
+	GPS_PowerSave             bool                      // u-blox power save (cyclic tracking) at 1 Hz, for battery operation. Ignored when the AHRS is enabled. Applied when the receiver is configured.
+	GPS_AltitudeSource        string                    // Sentence type to take altitude from: "GGA", "PUBX", or "" for automatic (PUBX,00 preferred).
+	Influx_Enabled            bool                      // Send situation data as InfluxDB line protocol. See influxSender().
+	Influx_URL                string                    // "udp://host:port" or an HTTP write endpoint, e.g. "http://host:8086/write?db=stratux".
+	Influx_Interval           int                       // Seconds between points.
+	TrackLog_Enabled          bool                      // Record the flight track to a GPX file in logDir. See trackLogger().
+	TrackLog_KML              bool                      // Also write a KML file beside the GPX file.
+	TrackLog_Interval         int                       // Seconds between track points.
+	GPS_AntennaOffsetFwd      float32                   // GPS antenna position relative to the aircraft reference point, meters, body frame. See applyAntennaOffset().
+	GPS_AntennaOffsetRight    float32
+	GPS_AntennaOffsetUp       float32
+	GPS_DisabledSentences     []string  // NMEA sentence types to ignore, e.g. "GSV", "GPGSA", "PUBX,03". See isNMEASentenceDisabled().
+	GPS_MaxCourseSlewRate     float32   // Maximum rotation of the reported ownship track, deg/s. 0 disables. See updateDisplayCourse().
+	GPS_TrackMinSpeed         float32   // Groundspeed, kts, that must be sustained over the "track" filter window before the ground track is updated. See updateGroundTrack().
+	ReportRawValues           bool      // Include unfiltered values (SituationData.Raw) in the situation snapshot.
+	GPS_TalkerPrecedence      []string  // NMEA talkers in order of preference for GGA/RMC, e.g. "GN" (combined) before "GP". See isLowerPrecedenceTalker().
+	AHRS_AutoTrim             bool      // Slowly trim out pitch/roll bias during steady cruise. See applyAutoTrim().
+	AHRS_AutoTrimTimeConstant int       // Seconds.
+	AHRS_Orientation          string    // IMU mounting, e.g. "FlatForward", "EdgeLeft", "UpsideDown", or "Custom". See imuOrientations.
+	AHRS_OrientationMatrix    []float64 // Row-major 3x3 sensor-to-aircraft rotation, used when AHRS_Orientation is "Custom".
+	AHRS_GyroBias             []float64 // deg/s, aircraft X, Y, Z. Set by IMU calibration. See startIMUCalibration().
+	AHRS_AccelBias            []float64 // g, aircraft X, Y, Z. Set by IMU calibration.
+	AHRS_MagOffset            []float64 // Magnetometer hard-iron offset, X, Y, Z. Set by magnetometer calibration. See finishMagCalibration().
+	AHRS_MagScale             []float64 // Magnetometer soft-iron scale, X, Y, Z.
+	AHRS_GlitchHoldTime       int       // ms. Last attitude is held across IMU read errors for this long before AHRS is declared invalid. At most 2000, see imuStallTime.
 }
 
 type status struct {
@@ -1013,7 +1234,32 @@ type status struct {
 	GPS_satellites_tracked                     uint16
 	GPS_connected                              bool
 	GPS_solution                               string
+	GPS_cold_start                             bool    // Receiver appears to be doing a cold start. See updateColdStartStatus().
+	GPS_acquisition_status                     string  // Human readable acquisition progress while there's no fix.
+	GPS_signal_warning                         string  // Set when satellite signal values look like a receiver or parsing fault. See checkSignalPlausibility().
+	GPS_acquisition_eta                        int     // Rough estimate of seconds to first fix during a cold start.
+	GPS_power_save                             bool    // Receiver was configured in power save mode.
+	GPS_leap_seconds                           int     // GPS-UTC offset (leap seconds) reported by the receiver.
+	GPS_leap_seconds_valid                     bool    // Leap second count has been confirmed from the almanac rather than the firmware default.
+	GPS_fix_rate                               float64 // Measured navigation solution rate, Hz.
+	GPS_antenna_status                         string  // u-blox antenna supervisor: INIT, DONTKNOW, OK, SHORT or OPEN. See processUBXMONHW().
+	GPS_jamming_level                          int     // u-blox CW jamming indicator, 0 (none) to 255 (strong).
+	GPS_jamming_state                          string  // u-blox jamming/interference monitor: unknown, OK, warning or critical.
 	RY835AI_connected                          bool
+	GPS_device                                 string // Results of the startup hardware self-test.
+	GPS_detected_type                          string
+	GPS_firmware_version                       string // u-blox MON-VER software version. See queryUBXVersion().
+	GPS_hardware_version                       string
+	GPS_protocol_version                       float64 // u-blox protocol version, e.g. 18.00. 0 if unknown.
+	Pressure_sensor                            string
+	IMU_sensor                                 string
+	Magnetometer_connected                     bool
+	Pressure_sensor_failed                     bool    // Too many implausible pressure altitude readings, or read errors, in a row.
+	Pressure_sensor_read_errors                int     // Consecutive pressure sensor read errors. See pressureSensorReadError().
+	IMU_read_errors                            int     // Consecutive IMU samples dropped because of read errors.
+	IMU_calibration                            string  // "", "running", "complete" or "failed: <reason>". See startIMUCalibration().
+	Mag_calibration                            string  // "", "running", "complete" or "failed: <reason>". See finishMagCalibration().
+	Mag_calibration_spread                     float64 // Spread of the corrected field strength in the last magnetometer calibration, percent. Lower is better.
 	Uptime                                     int64
 	Clock                                      time.Time
 	UptimeClock                                time.Time
@@ -1043,34 +1289,51 @@ func defaultSettings() {
 	}
 	globalSettings.AHRS_Enabled = false
 	globalSettings.DEBUG = false
+	globalSettings.LogLevel = "warn"
 	globalSettings.DisplayTrafficSource = false
 	globalSettings.ReplayLog = false //TODO: 'true' for debug builds.
 	globalSettings.OwnshipModeS = "F00000"
+	globalSettings.MaxVertVel = 10000
+	globalSettings.GPS_FrozenFixTimeout = 5
+	globalSettings.GPS_FixAcquireTime = 2
+	globalSettings.GPS_FixHoldTime = 15
+	globalSettings.GPS_NACpHysteresis = 0.1
+	globalSettings.Influx_Interval = 1
+	globalSettings.TrackLog_Interval = 1
+	globalSettings.AHRS_AutoTrimTimeConstant = 600
+	globalSettings.AHRS_GlitchHoldTime = 1000
+	globalSettings.AHRS_Orientation = "FlatForward"
+	globalSettings.AltimeterSetting = 1013.25
+	globalSettings.NMEAServer_Port = 10110 // IANA "nmea-0183".
+	globalSettings.GPS_Set_System_Time = true
+	globalSettings.GPS_ClockSetThreshold = 3
+	globalSettings.GPS_ClockSetInterval = 60
+	globalSettings.HeartbeatInterval = 1000
+	globalSettings.GPS_MinRangingSatellites = 4
+	globalSettings.GPS_SBASMinSignal = 16
+	globalSettings.GPS_SBASMinElevation = 10
+	globalSettings.GPS_RejectStaleEpochs = true
+	globalSettings.GPS_TimeRef = 1
+	globalSettings.GPS_DisconnectGrace = 5
+	globalSettings.OwnshipVelocity = true
+	globalSettings.GPS_NavPVT = true
+	globalSettings.GPS_TrackMinSpeed = 3
+	globalSettings.GPS_TalkerPrecedence = []string{"GN", "GP", "GL", "GA", "GB"}
 }
 
 func readSettings() {
-	fd, err := os.Open(configLocation)
+	defaultSettings() // Any settings missing from the config file keep their default values.
+	buf, err := ioutil.ReadFile(configLocation)
 	if err != nil {
 		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
-		defaultSettings()
 		return
 	}
-	defer fd.Close()
-	buf := make([]byte, 1024)
-	count, err := fd.Read(buf)
+	err = json.Unmarshal(buf, &globalSettings)
 	if err != nil {
 		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
 		defaultSettings()
 		return
 	}
-	var newSettings settings
-	err = json.Unmarshal(buf[0:count], &newSettings)
-	if err != nil {
-		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
-		defaultSettings()
-		return
-	}
-	globalSettings = newSettings
 	log.Printf("read in settings.\n")
 }
 
@@ -1239,13 +1502,26 @@ func attitudeReaderSender() {
 		<-timer.C
 
 		pitch, roll, yaw, heading := GetCurrentAHRS()
+		pitch, roll = applyAutoTrim(pitch, roll)
+		slipSkid, yawRate, gLoad := degrees(math.Atan2(imuAccelY, imuAccelZ)), imuYawRate, imuGLoad
+		if globalSettings.DemoMode || stratuxClock.Since(lastIMUReadTime) > 1*time.Second {
+			slipSkid, yawRate, gLoad = 0, 0, 1
+		}
+		if globalSettings.DemoMode {
+			pitch, roll, yaw, heading = demoPitch, demoRoll, demoHeading, demoHeading
+		}
 
 		mySituation.mu_Attitude.Lock()
 		mySituation.Pitch = pitch
 		mySituation.Roll = roll
 		mySituation.Yaw = yaw
 		mySituation.Gyro_heading = heading
+		mySituation.SlipSkid = slipSkid
+		mySituation.YawRate = yawRate
+		mySituation.GLoad = gLoad
 		mySituation.LastAttitudeTime = stratuxClock.Time
+		rawSituation.Pitch = attitudeXhistory[0] // Same axis mapping as GetCurrentAHRS() above.
+		rawSituation.Roll = attitudeYhistory[0]
 
 		// Send, if valid.
 		//		if isGPSGroundTrackValid(), etc.
@@ -1275,9 +1551,9 @@ func makeAHRSGDL90Report() {
 	pitch := int16(mySituation.Pitch * 10.0)
 	roll := int16(mySituation.Roll * 10.0)
 	hdg := uint16(mySituation.Gyro_heading * 10.0)
-	slipSkid := int16(float64(0) * float64(10.0))
-	yawRate := int16(mySituation.Yaw * 10.0)
-	g := int16(float64(1.0) * float64(10.0))
+	slipSkid := int16(mySituation.SlipSkid * 10.0)
+	yawRate := int16(mySituation.YawRate * 10.0)
+	g := int16(mySituation.GLoad * 10.0)
 
 	// Roll.
 	msg[4] = byte((roll >> 8) & 0xFF)
@@ -1306,8 +1582,9 @@ func makeAHRSGDL90Report() {
 	sendMsg(prepareMessage(msg), NETWORK_AHRS_GDL90, false)
 }
 
+// isTempPressValid reports whether the pressure altitude is current. Depends only on the pressure source, not the IMU.
 func isTempPressValid() bool {
-	return stratuxClock.Since(mySituation.LastTempPressTime) < 15*time.Second
+	return stratuxClock.Since(mySituation.LastTempPressTime) < 15*time.Second && (!globalStatus.Pressure_sensor_failed || isExternalPressureFresh())
 }
 
 func main() {
@@ -1385,11 +1662,19 @@ func main() {
 	initDataLog()
 
 	initGPS()
+	go nmeaServer()
+	go gpsdServer()
 	initMPU9250()
+	initPressureSensor()
 	go attitudeReaderSender()
 
 	// Start the heartbeat message loop in the background, once per second.
 	go heartBeatSender()
+	// Optional InfluxDB output.
+	go influxSender()
+	// Optional GPX/KML track log.
+	go trackLogger()
+	go demoSituationSender()
 	// Start the management interface.
 	go managementInterface()
 
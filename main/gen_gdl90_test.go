@@ -0,0 +1,58 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gen_gdl90_test.go: Tests for the GDL90 message encoding.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOwnshipReportVelocity(t *testing.T) {
+	tests := []struct {
+		name      string
+		velocity  bool    // globalSettings.OwnshipVelocity
+		track     bool    // Ground track valid.
+		vertVel   bool    // GPS vertical speed valid.
+		speed     uint16  // kts
+		course    float32 // degrees true
+		fpm       float32 // ft/min
+		msg12     byte    // Altitude low nibble, and misc: airborne, true track.
+		msg14to17 [4]byte // Horizontal velocity, vertical velocity and track.
+	}{
+		{"climbing east", true, true, true, 120, 90, 600, 0xC9, [4]byte{0x07, 0x80, 0x09, 0x40}},
+		{"descending south west", true, true, true, 95, 225, -1000, 0xC9, [4]byte{0x05, 0xFF, 0xF0, 0xA0}},
+		{"no vertical speed", true, true, false, 120, 90, 0, 0xC9, [4]byte{0x07, 0x88, 0x00, 0x40}},
+		{"velocity disabled", false, true, true, 120, 90, 600, 0xC8, [4]byte{0xFF, 0xF8, 0x00, 0x00}},
+		{"no ground track", true, false, false, 0, 0, 0, 0xC0, [4]byte{0xFF, 0xF8, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		resetGPSTestState()
+		globalSettings.OwnshipVelocity = tt.velocity
+		mySituation.Alt = 2500 // (2500 + 1000) / 25 = 0x08C.
+		mySituation.GroundSpeed = tt.speed
+		mySituation.TrueCourse = tt.course
+		mySituation.GPSVertVel = tt.fpm / 60 // ft/s
+		if tt.track {
+			mySituation.LastGroundTrackTime = stratuxClock.Time
+		}
+		lastGPSVertVelTime = time.Time{}
+		if tt.vertVel {
+			lastGPSVertVelTime = stratuxClock.Time
+		}
+
+		msg := ownshipReport()
+		if msg[11] != 0x08 || msg[12] != tt.msg12 {
+			t.Errorf("%s: altitude/misc bytes %02X %02X, want 08 %02X", tt.name, msg[11], msg[12], tt.msg12)
+		}
+		if got := [4]byte{msg[14], msg[15], msg[16], msg[17]}; got != tt.msg14to17 {
+			t.Errorf("%s: velocity/track bytes % X, want % X", tt.name, got, tt.msg14to17)
+		}
+	}
+}
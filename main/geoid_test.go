@@ -0,0 +1,45 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	geoid_test.go: Tests for the coarse geoid model.
+*/
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGeoidHeight(t *testing.T) {
+	// EGM96 geoid heights, m. The NGA points are the test points shipped with NGA's EGM96 interpolation program
+	// (OUTINTPT.DAT). None of these were used to build geoidGrid, which is coarse, so only to within a few metres.
+	for _, tt := range []struct {
+		name     string
+		lat, lng float64
+		want     float64
+	}{
+		{"NGA 1", 38.628155, -90.220845, -31.628},
+		{"NGA 2", -14.621217, -54.978886, -2.969},
+		{"NGA 3", 46.874319, 102.448729, -43.575},
+		{"NGA 4", -23.617446, 133.874712, 15.871},
+		{"NGA 5", 38.625473, -0.0005, 50.066},
+		{"NGA 6", -0.466744, 0.0023, 17.329},
+		{"Sydney", -33.87, 151.21, 22},
+		{"Auckland", -36.85, 174.76, 33},
+		{"Perth", -31.95, 115.86, -30},
+		{"Cape Town", -33.92, 18.42, 31},
+		{"London", 51.48, 0, 46},
+		{"New York", 40.71, -74.01, -33},
+		{"Tokyo", 35.68, 139.69, 37},
+		{"North pole", 90, 0, 13},
+		{"South pole", -90, 0, -30},
+	} {
+		if got := geoidHeight(tt.lat, tt.lng); math.Abs(got-tt.want) > 5 {
+			t.Errorf("%s: geoidHeight(%v, %v) = %.1f, want %v", tt.name, tt.lat, tt.lng, got, tt.want)
+		}
+	}
+}
@@ -11,29 +11,50 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
 
 	"github.com/tarm/serial"
 
 	"os"
 	"os/exec"
+	"path/filepath"
 )
 
 const (
 	SAT_TYPE_UNKNOWN = 0  // default type
 	SAT_TYPE_GPS     = 1  // GPxxx; NMEA IDs 1-32
 	SAT_TYPE_GLONASS = 2  // GLxxx; NMEA IDs 65-88
-	SAT_TYPE_GALILEO = 3  // GAxxx; NMEA IDs unknown
-	SAT_TYPE_BEIDOU  = 4  // GBxxx; NMEA IDs 201-235
+	SAT_TYPE_GALILEO = 3  // GAxxx; NMEA IDs 211-246 (u-blox), or 1-36 with the GA talker
+	SAT_TYPE_BEIDOU  = 4  // GBxxx; NMEA IDs 201-235 (201-210 without the GB talker), or 1-63 with the GB talker
+	SAT_TYPE_QZSS    = 5  // GQxxx; NMEA IDs 193-200 (reported with GP talker by NMEA 4.0 receivers). 201-202 clash with BeiDou.
 	SAT_TYPE_SBAS    = 10 // NMEA IDs 33-54
 )
 
+// Constellation names, in display order. Also the keys used by globalSettings.GPS_AccuracyWeights.
+var satTypeOrder = []uint8{SAT_TYPE_GPS, SAT_TYPE_GLONASS, SAT_TYPE_GALILEO, SAT_TYPE_BEIDOU, SAT_TYPE_QZSS, SAT_TYPE_SBAS, SAT_TYPE_UNKNOWN}
+var satTypeNames = map[uint8]string{
+	SAT_TYPE_UNKNOWN: "Unknown",
+	SAT_TYPE_GPS:     "GPS",
+	SAT_TYPE_GLONASS: "GLONASS",
+	SAT_TYPE_GALILEO: "Galileo",
+	SAT_TYPE_BEIDOU:  "BeiDou",
+	SAT_TYPE_QZSS:    "QZSS",
+	SAT_TYPE_SBAS:    "SBAS",
+}
+
 type SatelliteInfo struct {
 	SatelliteNMEA    uint8     // NMEA ID of the satellite. 1-32 is GPS, 33-54 is SBAS, 65-88 is Glonass.
 	SatelliteID      string    // Formatted code indicating source and PRN code. e.g. S138==WAAS satellite 138, G2==GPS satellites 2
@@ -45,16 +66,46 @@ type SatelliteInfo struct {
 	TimeLastSeen     time.Time // Time (system ticker) a signal was last received from this satellite
 	TimeLastTracked  time.Time // Time (system ticker) this satellite was tracked (almanac data)
 	InSolution       bool      // True if satellite is used in the position solution (reported by GSA message or PUBX,03)
+	HasEphemeris     bool      // True if the receiver has decoded this satellite's ephemeris (reported by PUBX,03, implied by GSA)
 }
 
 var serialConfig *serial.Config
 var serialPort *serial.Port
+var serialPortMutex = &sync.Mutex{} // Protects serialPort, and serialises writes to it once the reader is running. See writeUBX().
+
+// The running gpsSerialReader(), if any. Only used by pollGPS(). See startGPSSerialReader().
+var gpsReaderQuit chan struct{} // Closed to ask the reader to stop.
+var gpsReaderDone chan struct{} // Closed by the reader once it has stopped and closed its port.
+var gpsReaderPort io.ReadCloser // The reader's port, closed by stopGPSSerialReader() if the reader doesn't stop.
+
+var gpsReaderStopTimeout = 10 * time.Second // Reads time out after 2.5 s, so the reader should stop well within this.
+
+var gpsRawLogChan chan []byte // Copies of raw serial reads, written to disk by gpsRawLogger().
+
+const (
+	gpsRawLogMaxSize = 10 * 1024 * 1024 // Start a new capture file after 10 MB.
+
+	gpsLastFixLocation     = "/etc/stratux.lastfix"   // Time of the last valid fix, kept across restarts for cold start detection.
+	gpsSavedConfigLocation = "/etc/stratux.gpsconfig" // Fingerprint of the configuration saved in the receiver. See saveUBXConfig().
+	gpsColdStartAge        = 7 * 24 * time.Hour       // Almanac is considered stale if the last fix is older than this.
+	gpsAcquireGrace        = 60 * time.Second         // Normal warm/hot start time to first fix.
+	gpsEphemerisTime       = 30 * time.Second         // Time to decode one satellite's ephemeris with a good signal. Done in parallel.
+	gpsAlmanacTime         = 750 * time.Second        // Time to download a complete almanac. Worst case cold start TTFF.
+	gpsSatsNeededForFix    = 4
+)
 
-var readyToInitGPS bool // TO-DO: replace with channel control to terminate goroutine when complete
+var gpsLastFix time.Time       // Wall clock time of the last valid fix, this session or a previous one.
+var gpsLastFixSaved time.Time  // Wall clock time gpsLastFix was last written to gpsLastFixLocation.
+var gpsConnectedTime time.Time // stratuxClock time the receiver was last (re)connected.
 
 var satelliteMutex *sync.Mutex
 var Satellites map[string]SatelliteInfo
 
+// Frozen fix detection state. Protected by mySituation.mu_GPS.
+var frozenFixLat, frozenFixLng float32
+var frozenFixTime float64
+var frozenFixSince time.Time // stratuxClock time at which the current position was first reported.
+
 /*
 u-blox5_Referenzmanual.pdf
 Platform settings
@@ -96,6 +147,382 @@ func makeUBXCFG(class, id byte, msglen uint16, msg []byte) []byte {
 	return ret
 }
 
+const kmhToKnots = 0.539957
+
+// setGroundSpeed stores a groundspeed in knots, at full resolution in GroundSpeedF and rounded to whole knots
+// in GroundSpeed for GDL90 and the rest of the code.
+func setGroundSpeed(s *GPSSituationData, groundspeed float64) {
+	s.GroundSpeedF = float32(groundspeed)
+	s.GroundSpeed = uint16(groundspeed + 0.5)
+}
+
+type ubxGNSSBlock struct {
+	name     string // Key used in globalSettings.GPS_Constellations.
+	gnssID   byte
+	resTrkCh byte // Reserved tracking channels.
+	maxTrkCh byte // Maximum tracking channels.
+}
+
+// CFG-GNSS configuration blocks, in the order sent. GLONASS is last.
+var ubxGNSSBlocks = []ubxGNSSBlock{
+	{"GPS", 0x00, 0x08, 0x10},
+	{"SBAS", 0x01, 0x02, 0x03},
+	{"BeiDou", 0x03, 0x00, 0x10},
+	{"QZSS", 0x05, 0x00, 0x03},
+	{"GLONASS", 0x06, 0x08, 0x0E},
+}
+
+// ubxGNSSPayload builds the CFG-GNSS payload, enabling the constellations named in globalSettings.GPS_Constellations.
+// Defaults to GPS, SBAS and GLONASS. Note max position rate = 5 Hz if GPS+GLONASS used, so GLONASS and BeiDou are
+// left out with globalSettings.GPS_PreferHighRate, for 10 Hz.
+func ubxGNSSPayload() []byte {
+	enabled := make(map[string]bool)
+	for _, c := range globalSettings.GPS_Constellations {
+		enabled[c] = true
+	}
+	if len(enabled) == 0 {
+		enabled = map[string]bool{"GPS": true, "SBAS": true, "GLONASS": true}
+	}
+	if globalSettings.GPS_PreferHighRate {
+		enabled["GLONASS"] = false
+		enabled["BeiDou"] = false
+	}
+	payload := []byte{0x00, 0x20, 0x20, byte(len(ubxGNSSBlocks))}
+	for _, b := range ubxGNSSBlocks {
+		enable := byte(0x00)
+		if enabled[b.name] {
+			enable = 0x01
+		}
+		payload = append(payload, b.gnssID, b.resTrkCh, b.maxTrkCh, 0x00, enable, 0x00, 0x01, 0x01)
+	}
+	return payload
+}
+
+var gpsIsUblox bool         // Connected receiver accepts UBX configuration messages.
+var ubxAckChan chan [3]byte // ACK (1) or NAK (0), then class and ID of the acknowledged message, from processUBXFrame().
+
+// waitUBXAck waits up to timeout for the receiver to ACK or NAK the configuration message class/id.
+func waitUBXAck(class, id byte, timeout time.Duration) (acked, answered bool) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case a := <-ubxAckChan:
+			if a[1] == class && a[2] == id {
+				return a[0] == 0x01, true
+			}
+		case <-deadline:
+			return false, false
+		}
+	}
+}
+
+const (
+	ubxConfigRetries    = 3
+	ubxConfigAckTimeout = 1 * time.Second
+)
+
+// deadlineReader ends the stream (io.EOF) at 'deadline'. The underlying port needs a ReadTimeout for this to be prompt.
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+}
+
+func (d deadlineReader) Read(p []byte) (int, error) {
+	if time.Now().After(d.deadline) {
+		return 0, io.EOF
+	}
+	return d.r.Read(p)
+}
+
+// readUBXAck reads from the port until the ACK-ACK or ACK-NAK for the class/id, or the timeout. For use before
+// gpsSerialReader() is started; after that, ACKs arrive through ubxAckChan (see waitUBXAck()).
+func readUBXAck(p io.Reader, class, id byte, timeout time.Duration) (acked, answered bool) {
+	frame := readUBXFrame(p, timeout, func(f []byte) bool {
+		return f[2] == 0x05 && len(f) >= 10 && f[6] == class && f[7] == id
+	})
+	if frame == nil {
+		return false, false
+	}
+	return frame[3] == 0x01, true
+}
+
+// readUBXFrame reads from the port until a UBX frame accepted by 'match', or the timeout. Returns a copy of the
+// whole frame, or nil.
+func readUBXFrame(p io.Reader, timeout time.Duration, match func(frame []byte) bool) []byte {
+	scanner := bufio.NewScanner(deadlineReader{p, time.Now().Add(timeout)})
+	scanner.Split(scanGPSFrames)
+	for scanner.Scan() {
+		frame := scanner.Bytes()
+		if len(frame) >= 8 && frame[0] == 0xB5 && match(frame) {
+			return append([]byte(nil), frame...)
+		}
+	}
+	return nil
+}
+
+/*
+	queryUBXVersion().
+		Polls UBX-MON-VER and records the receiver's software and hardware versions and protocol version
+		 (from the "PROTVER" extension) in globalStatus. The protocol version decides which configuration
+		 messages are sent; it is left at 0 (unknown) if the receiver doesn't answer.
+*/
+
+func queryUBXVersion(p *serial.Port) {
+	globalStatus.GPS_protocol_version = 0
+	var frame []byte
+	for try := 0; try < ubxConfigRetries && frame == nil; try++ {
+		p.Write(makeUBXCFG(0x0A, 0x04, 0, nil))
+		frame = readUBXFrame(p, ubxConfigAckTimeout, func(f []byte) bool { return f[2] == 0x0A && f[3] == 0x04 })
+	}
+	if frame == nil || len(frame) < 6+40+2 {
+		log.Printf("GPS: no answer to MON-VER; assuming an older u-blox.\n")
+		return
+	}
+	payload := frame[6 : len(frame)-2]
+	cstr := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return strings.TrimSpace(string(b))
+	}
+	globalStatus.GPS_firmware_version = cstr(payload[0:30])
+	globalStatus.GPS_hardware_version = cstr(payload[30:40])
+	extensions := make([]string, 0)
+	for i := 40; i+30 <= len(payload); i += 30 {
+		ext := cstr(payload[i : i+30])
+		extensions = append(extensions, ext)
+		if strings.HasPrefix(ext, "PROTVER") { // "PROTVER=18.00", or "PROTVER 15.00" on older firmware.
+			if v, err := strconv.ParseFloat(strings.TrimLeft(ext[len("PROTVER"):], "= "), 64); err == nil {
+				globalStatus.GPS_protocol_version = v
+			}
+		}
+	}
+	globalStatus.GPS_detected_type = fmt.Sprintf("u-blox (HW %s)", globalStatus.GPS_hardware_version)
+	log.Printf("GPS: u-blox hardware %s, software %s, protocol %.2f. %s\n", globalStatus.GPS_hardware_version,
+		globalStatus.GPS_firmware_version, globalStatus.GPS_protocol_version, strings.Join(extensions, ", "))
+}
+
+// ubxSupportsGNSS reports whether the receiver takes CFG-GNSS (protocol 14, u-blox 7, and later). Assumed when
+// the version is unknown, as before MON-VER was queried.
+func ubxSupportsGNSS() bool {
+	return globalStatus.GPS_protocol_version == 0 || globalStatus.GPS_protocol_version >= 14
+}
+
+// ubxUseNavPVT reports whether NAV-PVT replaces PUBX,00: globalSettings.GPS_NavPVT, and a receiver known to
+// support it (protocol 14 or later). PUBX,00 is kept when the version is unknown, since it works everywhere.
+func ubxUseNavPVT() bool {
+	return globalSettings.GPS_NavPVT && globalStatus.GPS_protocol_version >= 14
+}
+
+/*
+	writeUBXConfig().
+		Writes a UBX CFG message and waits for the receiver's ACK, resending up to ubxConfigRetries times
+		 if there is no answer (e.g. the message was corrupted on a noisy line). A NAK is not retried.
+		 Returns whether the receiver acknowledged the message; failures are logged.
+*/
+
+func writeUBXConfig(p *serial.Port, class, id byte, payload []byte, what string) bool {
+	for try := 1; try <= ubxConfigRetries; try++ {
+		p.Write(makeUBXCFG(class, id, uint16(len(payload)), payload))
+		acked, answered := readUBXAck(p, class, id, ubxConfigAckTimeout)
+		if acked {
+			logf(LOG_DEBUG, "GPS acknowledged %s.\n", what)
+			return true
+		}
+		if answered {
+			log.Printf("GPS rejected %s (class 0x%02X, ID 0x%02X).\n", what, class, id)
+			return false
+		}
+		logf(LOG_DEBUG, "GPS: no ACK for %s, try %d of %d.\n", what, try, ubxConfigRetries)
+	}
+	log.Printf("GPS: %s not acknowledged after %d tries; the receiver may not be configured as expected.\n", what, ubxConfigRetries)
+	return false
+}
+
+// ubxReceiverConnected reports whether a u-blox receiver is connected and writeUBX() can reach it.
+func ubxReceiverConnected() bool {
+	serialPortMutex.Lock()
+	defer serialPortMutex.Unlock()
+	return globalStatus.GPS_connected && gpsIsUblox && serialPort != nil
+}
+
+// writeUBX sends a UBX message to the connected receiver. All writes made while gpsSerialReader() runs go through
+// here, so that they don't interleave with each other or race with a reconnect replacing serialPort.
+func writeUBX(class, id byte, payload []byte) {
+	serialPortMutex.Lock()
+	defer serialPortMutex.Unlock()
+	if serialPort != nil {
+		serialPort.Write(makeUBXCFG(class, id, uint16(len(payload)), payload))
+	}
+}
+
+/*
+	setGNSSConstellations().
+		Applies globalSettings.GPS_Constellations to the running receiver: sends CFG-GNSS on the open serial port
+		 and waits for the ACK, without reconnecting or resending the rest of the configuration. The receiver
+		 needs a GNSS restart to use the new mix, so this is followed by a GNSS-only software reset (which
+		 keeps the configuration and ephemeris), and the satellite list is cleared so that the effect shows up
+		 as the receiver reacquires.
+*/
+
+func setGNSSConstellations() {
+	if !ubxReceiverConnected() {
+		log.Printf("GPS: constellations will be applied when a u-blox receiver connects.\n")
+		return
+	}
+	if !ubxSupportsGNSS() {
+		log.Printf("GPS: receiver (protocol %.2f) doesn't support CFG-GNSS.\n", globalStatus.GPS_protocol_version)
+		return
+	}
+	for len(ubxAckChan) > 0 { // Drop stale ACKs.
+		<-ubxAckChan
+	}
+	cfgGnss := ubxGNSSPayload()
+	writeUBX(0x06, 0x3E, cfgGnss)
+	acked, answered := waitUBXAck(0x06, 0x3E, 2*time.Second)
+	if !acked {
+		if answered {
+			log.Printf("GPS rejected constellation change %v.\n", globalSettings.GPS_Constellations)
+		} else {
+			log.Printf("GPS: no ACK for constellation change %v.\n", globalSettings.GPS_Constellations)
+		}
+		return
+	}
+	// CFG-RST: navBbrMask 0x0000 (hot start), resetMode 0x02 (controlled software reset, GNSS only).
+	writeUBX(0x06, 0x04, []byte{0x00, 0x00, 0x02, 0x00})
+	satelliteMutex.Lock()
+	Satellites = make(map[string]SatelliteInfo)
+	satelliteMutex.Unlock()
+	log.Printf("GPS constellations set to %v. Restarting GNSS.\n", globalSettings.GPS_Constellations)
+}
+
+/*
+	setGPSHighRate().
+		Applies globalSettings.GPS_PreferHighRate to the running receiver: CFG-RATE for 10 Hz (or back to the
+		 configured rate), and CFG-GNSS without (or with) GLONASS, followed by the GNSS restart in
+		 setGNSSConstellations(). The constellations are changed first when going to 10 Hz, and last when
+		 going back, so that the receiver never has a rate it can't do with its constellations.
+*/
+
+func setGPSHighRate() {
+	if !ubxReceiverConnected() {
+		log.Printf("GPS: rate will be applied when a u-blox receiver connects.\n")
+		return
+	}
+	if globalSettings.GPS_PreferHighRate {
+		setGNSSConstellations()
+	}
+	if globalStatus.GPS_power_save {
+		log.Printf("GPS: power save mode keeps the rate at 1 Hz.\n")
+	} else {
+		for len(ubxAckChan) > 0 { // Drop stale ACKs.
+			<-ubxAckChan
+		}
+		rate := ubxRatePayload()
+		writeUBX(0x06, 0x08, rate)
+		if acked, _ := waitUBXAck(0x06, 0x08, 2*time.Second); !acked {
+			log.Printf("GPS: rate change not acknowledged.\n")
+		} else {
+			log.Printf("GPS: navigation rate set to %d ms.\n", int(rate[0])|int(rate[1])<<8)
+		}
+	}
+	if !globalSettings.GPS_PreferHighRate {
+		setGNSSConstellations()
+	}
+}
+
+// CFG-RST navBbrMask for each start type: which battery backed navigation data to clear.
+var ubxResetBbrMask = map[string]uint16{
+	"hot":  0x0000, // Keep everything.
+	"warm": 0x0001, // Clear ephemeris.
+	"cold": 0xFFFF, // Clear everything: ephemeris, almanac, position, clock.
+}
+
+/*
+	resetGPS().
+		Restarts a u-blox receiver: "hot", "warm" or "cold" start with UBX-CFG-RST, or "factory" to clear the
+		 saved configuration (CFG-CFG) and cold start. Starts are a GNSS-only reset, which keeps the port and
+		 configuration. A factory reset does a full software reset that returns the receiver to its default
+		 baud rate and messages, so the GPS is reconnected and configured again by pollGPS().
+*/
+
+func resetGPS(mode string) error {
+	if !ubxReceiverConnected() {
+		return fmt.Errorf("no u-blox receiver connected")
+	}
+	switch mode {
+	case "hot", "warm", "cold":
+		mask := ubxResetBbrMask[mode]
+		// resetMode 0x02: controlled software reset, GNSS only.
+		writeUBX(0x06, 0x04, []byte{byte(mask), byte(mask >> 8), 0x02, 0x00})
+	case "factory":
+		// CFG-CFG: clearMask all sections, saveMask none, loadMask all sections, deviceMask BBR, flash, EEPROM
+		//  and SPI flash. Then CFG-RST: cold start, resetMode 0x01 (controlled software reset).
+		cfg := []byte{0xFF, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x00, 0x00, 0x17}
+		writeUBX(0x06, 0x09, cfg)
+		time.Sleep(100 * time.Millisecond)
+		writeUBX(0x06, 0x04, []byte{0xFF, 0xFF, 0x01, 0x00})
+		os.Remove(gpsSavedConfigLocation)
+		globalStatus.GPS_connected = false // Reconfigure once it's back.
+	default:
+		return fmt.Errorf("unknown reset '%s'; expected hot, warm, cold or factory", mode)
+	}
+	satelliteMutex.Lock()
+	Satellites = make(map[string]SatelliteInfo)
+	satelliteMutex.Unlock()
+	log.Printf("GPS: %s reset sent.\n", mode)
+	return nil
+}
+
+// parseNMEATime parses an NMEA "hhmmss.ss" UTC time field. The seconds are kept at the receiver's full
+// resolution, so that fix times line up with the receiver's measurement epoch at high navigation rates.
+func parseNMEATime(t string) (hr, min int, sec float64, ok bool) {
+	if len(t) < 6 {
+		return 0, 0, 0, false
+	}
+	hr, err1 := strconv.Atoi(t[0:2])
+	min, err2 := strconv.Atoi(t[2:4])
+	sec, err3 := strconv.ParseFloat(t[4:], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, 0, 0, false
+	}
+	return hr, min, sec, true
+}
+
+const (
+	ubxMinMeasRate     = 25  // ms. Fastest u-blox M8 measurement rate.
+	ubxMinNavSolPeriod = 100 // ms. Fastest navigation solution rate (10 Hz, single constellation).
+)
+
+/*
+	ubxRatePayload().
+		Builds the CFG-RATE payload from globalSettings.GPS_MeasRate (ms between measurements),
+		 GPS_NavRate (measurements per navigation solution) and GPS_TimeRef (0 = UTC, 1 = GPS time),
+		 e.g. measure at 10 Hz but solve at 5 Hz with 100 ms and 2. Unset values default to 5 Hz solutions
+		 (10 Hz with GPS_PreferHighRate) aligned to GPS time. A combination the chip can't do is logged and replaced by the default.
+*/
+
+func ubxRatePayload() []byte {
+	measRate, navRate, timeRef := globalSettings.GPS_MeasRate, globalSettings.GPS_NavRate, globalSettings.GPS_TimeRef
+	if measRate == 0 {
+		measRate = 200
+		if globalSettings.GPS_PreferHighRate {
+			measRate = 100 // 10 Hz. Needs a single constellation; see ubxGNSSPayload().
+		}
+	}
+	if navRate == 0 {
+		navRate = 1
+	}
+	if measRate < ubxMinMeasRate || measRate > 0xFFFF || navRate < 1 || navRate > 127 || measRate*navRate < ubxMinNavSolPeriod || (timeRef != 0 && timeRef != 1) {
+		log.Printf("GPS: invalid CFG-RATE measRate=%d ms, navRate=%d, timeRef=%d. Using 5 Hz.\n", measRate, navRate, timeRef)
+		measRate, navRate, timeRef = 200, 1, 1
+	}
+	if measRate != 200 || navRate != 1 {
+		log.Printf("GPS: measuring every %d ms, navigation solution every %d measurement(s).\n", measRate, navRate)
+	}
+	return []byte{byte(measRate), byte(measRate >> 8), byte(navRate), byte(navRate >> 8), byte(timeRef), byte(timeRef >> 8)}
+}
+
 func makeNMEACmd(cmd string) []byte {
 	chk_sum := byte(0)
 	for i := range cmd {
@@ -104,31 +531,125 @@ func makeNMEACmd(cmd string) []byte {
 	return []byte(fmt.Sprintf("$%s*%02x\x0d\x0a", cmd, chk_sum))
 }
 
-func initGPSSerial() bool {
-	var device string
-	baudrate := int(9600)
-	isSirfIV := bool(false)
+// CFG-MSG output rate targets, in payload order after the message class and ID.
+var ubxPortNames = []string{"DDC", "UART1", "UART2", "USB", "I2C", "Res"}
+
+type ubxMsgRate struct {
+	name      string // Key used in globalSettings.GPS_PortMessageRates.
+	class, id byte
+	rates     [6]byte // Output every nth fix on each of ubxPortNames. 0 = disabled.
+}
+
+// Default message output configuration. Feeds Stratux on UART1 (and USB for the USB-attached receivers).
+var ubxMsgRates = []ubxMsgRate{
+	//                          DDC   UART1 UART2 USB   I2C   Res
+	{"GGA", 0xF0, 0x00, [6]byte{0x00, 0x05, 0x00, 0x05, 0x00, 0x01}},    // GGA enabled every 5th message
+	{"GLL", 0xF0, 0x01, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x01}},    // GLL disabled
+	{"GSA", 0xF0, 0x02, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x01}},    // GSA disabled. {0x00, 0x05, 0x00, 0x05, 0x00, 0x01} for every 5th position (used for testing only)
+	{"GSV", 0xF0, 0x03, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x01}},    // GSV disabled. {0x00, 0x05, 0x00, 0x05, 0x00, 0x01} for every 5th position (used for testing only)
+	{"RMC", 0xF0, 0x04, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x01}},    // RMC
+	{"VTG", 0xF0, 0x05, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x01}},    // VGT
+	{"GRS", 0xF0, 0x06, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},    // GRS
+	{"GST", 0xF0, 0x07, [6]byte{0x00, 0x01, 0x00, 0x01, 0x00, 0x00}},    // GST enabled every fix, for its error estimates. See isGSTRecent().
+	{"ZDA", 0xF0, 0x08, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},    // ZDA
+	{"GBS", 0xF0, 0x09, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},    // GBS
+	{"DTM", 0xF0, 0x0A, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},    // DTM
+	{"GNS", 0xF0, 0x0D, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},    // GNS
+	{"THS", 0xF0, 0x0E, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},    // THS
+	{"VLW", 0xF0, 0x0F, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},    // VLW
+	{"PUBX00", 0xF1, 0x00, [6]byte{0x01, 0x01, 0x01, 0x01, 0x01, 0x00}}, // Ublox,0
+	{"PUBX03", 0xF1, 0x03, [6]byte{0x05, 0x05, 0x05, 0x05, 0x05, 0x00}}, // Ublox,3
+	{"PUBX04", 0xF1, 0x04, [6]byte{0x0A, 0x0A, 0x0A, 0x0A, 0x0A, 0x00}}, // Ublox,4
+	{"NAVPVT", 0x01, 0x07, [6]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}}, // UBX-NAV-PVT. Replaces PUBX,00 when ubxUseNavPVT().
+}
+
+// Rates used for UBX-NAV-PVT, in place of PUBX,00, when ubxUseNavPVT().
+var ubxNavPVTRates = [6]byte{0x01, 0x01, 0x01, 0x01, 0x01, 0x00}
+
+// ubxMsgRatePayload builds the CFG-MSG payload for m, applying any per-port overrides from
+// globalSettings.GPS_PortMessageRates, e.g. {"UART2": {"GGA": 1, "RMC": 1}} to feed a second device on UART2.
+func ubxMsgRatePayload(m ubxMsgRate) []byte {
+	rates := m.rates
+	if ubxUseNavPVT() {
+		switch m.name {
+		case "PUBX00":
+			rates = [6]byte{}
+		case "NAVPVT":
+			rates = ubxNavPVTRates
+		}
+	}
+	for i, port := range ubxPortNames {
+		if r, ok := globalSettings.GPS_PortMessageRates[port][m.name]; ok && r >= 0 && r <= 0xFF {
+			logf(LOG_INFO, "GPS: %s output on %s set to every %d fix(es) (default %d).\n", m.name, port, r, rates[i])
+			rates[i] = byte(r)
+		}
+	}
+	return append([]byte{m.class, m.id}, rates[:]...)
+}
 
+// detectGPSDevice returns the first GPS device found in the probe order, a description of the receiver
+// type, and the baud rate the receiver is expected to be using before it is configured.
+func detectGPSDevice() (device, gpsType string, baudrate int, ok bool) {
+	baudrate = 9600
+	if globalSettings.GPS_Device != "" { // Set by the user. No probing.
+		if globalSettings.GPS_Baud > 0 {
+			baudrate = globalSettings.GPS_Baud
+		}
+		if _, err := os.Stat(globalSettings.GPS_Device); err != nil {
+			log.Printf("GPS device %s: %s\n", globalSettings.GPS_Device, err.Error())
+			return "", "", baudrate, false
+		}
+		return globalSettings.GPS_Device, "u-blox (configured)", baudrate, true
+	}
 	if _, err := os.Stat("/dev/ublox8"); err == nil { // u-blox 8 (RY83xAI over USB).
-		device = "/dev/ublox8"
+		return "/dev/ublox8", "u-blox 8", baudrate, true
 	} else if _, err := os.Stat("/dev/ublox7"); err == nil { // u-blox 7 (VK-172, RY725AI over USB).
-		device = "/dev/ublox7"
+		return "/dev/ublox7", "u-blox 7", baudrate, true
 	} else if _, err := os.Stat("/dev/ublox6"); err == nil { // u-blox 6 (VK-162).
-		device = "/dev/ublox6"
+		return "/dev/ublox6", "u-blox 6", baudrate, true
 	} else if _, err := os.Stat("/dev/prolific0"); err == nil { // Assume it's a BU-353-S4 SIRF IV.
 		//TODO: Check a "serialout" flag and/or deal with multiple prolific devices.
-		isSirfIV = true
-		baudrate = 4800
-		device = "/dev/prolific0"
+		return "/dev/prolific0", "SiRF IV", 4800, true
+	} else if device, gpsType, baud, ok := detectGPSDeviceByID(); ok {
+		return device, gpsType, baud, true
 	} else if _, err := os.Stat("/dev/ttyAMA0"); err == nil { // ttyAMA0 is PL011 UART (GPIO pins 8 and 10) on all RPi.
-		device = "/dev/ttyAMA0"
-	} else {
+		return "/dev/ttyAMA0", "u-blox (UART)", baudrate, true
+	}
+	return "", "", baudrate, false
+}
+
+// detectGPSDeviceByID looks for a known receiver in /dev/serial/by-id, for devices the Stratux udev rules
+// don't name (e.g. newer u-blox modules).
+func detectGPSDeviceByID() (device, gpsType string, baudrate int, ok bool) {
+	ids, _ := filepath.Glob("/dev/serial/by-id/*")
+	for _, id := range ids {
+		name := strings.ToLower(filepath.Base(id))
+		if strings.Contains(name, "u-blox") || strings.Contains(name, "ublox") {
+			return id, "u-blox (by-id)", 9600, true
+		} else if strings.Contains(name, "prolific") { // Assume it's a BU-353-S4 SIRF IV, as with /dev/prolific0.
+			return id, "SiRF IV", 4800, true
+		}
+	}
+	return "", "", 0, false
+}
+
+// ubxConfiguredBaud is the UART baud rate the u-blox is switched to: globalSettings.GPS_Baud if set, otherwise 38400.
+func ubxConfiguredBaud() int {
+	if globalSettings.GPS_Baud > 0 {
+		return globalSettings.GPS_Baud
+	}
+	return 38400
+}
+
+func initGPSSerial() bool {
+	device, gpsType, baudrate, ok := detectGPSDevice()
+	if !ok {
 		log.Printf("No suitable device found.\n")
 		return false
 	}
-	if globalSettings.DEBUG {
-		log.Printf("Using %s for GPS\n", device)
-	}
+	isSirfIV := gpsType == "SiRF IV"
+	gpsIsUblox = !isSirfIV
+	logf(LOG_INFO, "Using %s for GPS\n", device)
 
 	/* Developer option -- uncomment to allow "hot" configuration of GPS (assuming 38.4 kpbs on warm start)
 		serialConfig = &serial.Config{Name: device, Baud: 38400}
@@ -178,8 +699,28 @@ func initGPSSerial() bool {
 
 		-- End developer option */
 
-	// Open port at default baud for config.
-	serialConfig = &serial.Config{Name: device, Baud: baudrate}
+	if gpsIsUblox {
+		// Power save mode trades update rate and accuracy for battery life. Not used while the AHRS is
+		//  running, which needs the full GPS update rate. AHRS_Enabled alone doesn't tell: initMPU9250()
+		//  sets it whether or not an IMU was found, and only starts the reader with a working magnetometer.
+		ahrsRunning := globalSettings.AHRS_Enabled && globalStatus.IMU_sensor != "" && globalStatus.IMU_sensor != selfTestNotFound && globalStatus.Magnetometer_connected
+		globalStatus.GPS_power_save = globalSettings.GPS_PowerSave && !ahrsRunning
+		if globalSettings.GPS_PowerSave && !globalStatus.GPS_power_save {
+			log.Printf("GPS power save mode not enabled: AHRS needs the full update rate.\n")
+		}
+		if globalSettings.GPS_SaveConfig {
+			if p := openSavedUBXConfig(device); p != nil {
+				serialPortMutex.Lock()
+				serialPort = p
+				serialPortMutex.Unlock()
+				return true
+			}
+		}
+	}
+	saveFingerprint := "" // Set if the configuration is to be saved to the receiver. See saveUBXConfig().
+
+	// Open port at default baud for config. ReadTimeout lets writeUBXConfig() give up on a missing ACK.
+	serialConfig = &serial.Config{Name: device, Baud: baudrate, ReadTimeout: 100 * time.Millisecond}
 	p, err := serial.OpenPort(serialConfig)
 	if err != nil {
 		log.Printf("serial port err: %s\n", err.Error())
@@ -212,116 +753,29 @@ func initGPSSerial() bool {
 		// Enable GSV (once every 5 position updates)
 		p.Write(makeNMEACmd("PSRF103,03,00,05,01"))
 
-		if globalSettings.DEBUG {
-			log.Printf("Finished writing SiRF GPS config to %s. Opening port to test connection.\n", device)
-		}
+		logf(LOG_INFO, "Finished writing SiRF GPS config to %s. Opening port to test connection.\n", device)
 	} else {
-		// Set 5 Hz update. Little endian order.
-		//p.Write(makeUBXCFG(0x06, 0x08, 6, []byte{0x64, 0x00, 0x01, 0x00, 0x01, 0x00})) // 10 Hz
-		p.Write(makeUBXCFG(0x06, 0x08, 6, []byte{0xc8, 0x00, 0x01, 0x00, 0x01, 0x00})) // 5 Hz
-
-		// Set navigation settings.
-		nav := make([]byte, 36)
-		nav[0] = 0x05 // Set dyn and fixMode only.
-		nav[1] = 0x00
-		// dyn.
-		nav[2] = 0x07 // "Airborne with >2g Acceleration".
-		nav[3] = 0x02 // 3D only.
-
-		p.Write(makeUBXCFG(0x06, 0x24, 36, nav))
-
-		// GNSS configuration CFG-GNSS for ublox 7 higher, p. 125 (v8)
-		// NOTE: Max position rate = 5 Hz if GPS+GLONASS used.
-
-		// TESTING: 5Hz unified GPS + GLONASS
-
-		// Disable GLONASS to enable 10 Hz solution rate. GLONASS is not used
-		// for SBAS (WAAS), so little real-world impact.
-
-		cfgGnss := []byte{0x00, 0x20, 0x20, 0x05}
-		gps := []byte{0x00, 0x08, 0x10, 0x00, 0x01, 0x00, 0x01, 0x01}  // enable GPS with 8-16 tracking channels
-		sbas := []byte{0x01, 0x02, 0x03, 0x00, 0x01, 0x00, 0x01, 0x01} // enable SBAS (WAAS) with 2-3 tracking channels
-		beidou := []byte{0x03, 0x00, 0x10, 0x00, 0x00, 0x00, 0x01, 0x01}
-		qzss := []byte{0x05, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x01}
-		//glonass := []byte{0x06, 0x04, 0x0E, 0x00, 0x00, 0x00, 0x01, 0x01} // this disables GLONASS
-		glonass := []byte{0x06, 0x08, 0x0E, 0x00, 0x01, 0x00, 0x01, 0x01} // this enables GLONASS with 8-14 tracking channels
-		cfgGnss = append(cfgGnss, gps...)
-		cfgGnss = append(cfgGnss, sbas...)
-		cfgGnss = append(cfgGnss, beidou...)
-		cfgGnss = append(cfgGnss, qzss...)
-		cfgGnss = append(cfgGnss, glonass...)
-		p.Write(makeUBXCFG(0x06, 0x3E, uint16(len(cfgGnss)), cfgGnss))
-
-		// SBAS configuration for ublox 6 and higher
-		p.Write(makeUBXCFG(0x06, 0x16, 8, []byte{0x01, 0x07, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00}))
-
-		// Message output configuration: UBX,00 (position) on each calculated fix; UBX,03 (satellite info) every 5th fix,
-		//  UBX,04 (timing) every 10th, GGA (NMEA position) every 5th. All other NMEA messages disabled.
-
-		//                                             Msg   DDC   UART1 UART2 USB   I2C   Res
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x00, 0x00, 0x05, 0x00, 0x05, 0x00, 0x01})) // GGA enabled every 5th message
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // GLL disabled
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // GSA disabled
-		//p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x02, 0x00, 0x05, 0x00, 0x05, 0x00, 0x01})) // GSA enabled disabled every 5th position (used for testing only)
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // GSV disabled
-		//p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x03, 0x00, 0x05, 0x00, 0x05, 0x00, 0x01})) // GSV enabled for every 5th position (used for testing only)
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // RMC
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01})) // VGT
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // GRS
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // GST
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // ZDA
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // GBS
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x0A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // DTM
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x0D, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // GNS
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x0E, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // ???
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF0, 0x0F, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // VLW
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF1, 0x00, 0x01, 0x01, 0x01, 0x01, 0x01, 0x00})) // Ublox,0
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF1, 0x03, 0x05, 0x05, 0x05, 0x05, 0x05, 0x00})) // Ublox,3
-		p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0xF1, 0x04, 0x0A, 0x0A, 0x0A, 0x0A, 0x0A, 0x00})) // Ublox,4
-
-		// Reconfigure serial port.
-		cfg := make([]byte, 20)
-		cfg[0] = 0x01 // portID.
-		cfg[1] = 0x00 // res0.
-		cfg[2] = 0x00 // res1.
-		cfg[3] = 0x00 // res1.
-
-		//      [   7   ] [   6   ] [   5   ] [   4   ]
-		//	0000 0000 0000 0000 0000 10x0 1100 0000
-		// UART mode. 0 stop bits, no parity, 8 data bits. Little endian order.
-		cfg[4] = 0xC0
-		cfg[5] = 0x08
-		cfg[6] = 0x00
-		cfg[7] = 0x00
-
-		// Baud rate. Little endian order.
-		bdrt := uint32(38400)
-		cfg[11] = byte((bdrt >> 24) & 0xFF)
-		cfg[10] = byte((bdrt >> 16) & 0xFF)
-		cfg[9] = byte((bdrt >> 8) & 0xFF)
-		cfg[8] = byte(bdrt & 0xFF)
-
-		// inProtoMask. NMEA and UBX. Little endian.
-		cfg[12] = 0x03
-		cfg[13] = 0x00
-
-		// outProtoMask. NMEA. Little endian.
-		cfg[14] = 0x02
-		cfg[15] = 0x00
-
-		cfg[16] = 0x00 // flags.
-		cfg[17] = 0x00 // flags.
-
-		cfg[18] = 0x00 //pad.
-		cfg[19] = 0x00 //pad.
-
-		p.Write(makeUBXCFG(0x06, 0x00, 20, cfg))
+		queryUBXVersion(p)
+
+		msgs := ubxConfigMessages()
+		allAcked := true
+		for _, m := range msgs {
+			if m.what == "" {
+				p.Write(makeUBXCFG(m.class, m.id, uint16(len(m.payload)), m.payload))
+			} else if !writeUBXConfig(p, m.class, m.id, m.payload, m.what) {
+				allAcked = false
+			}
+			if m.class == 0x06 && m.id == 0x24 {
+				logUBXDynModel()
+			}
+		}
 		//	time.Sleep(100* time.Millisecond) // pause and wait for the GPS to finish configuring itself before closing / reopening the port
-		baudrate = 38400
-
-		if globalSettings.DEBUG {
-			log.Printf("Finished writing u-blox GPS config to %s. Opening port to test connection.\n", device)
+		baudrate = ubxConfiguredBaud()
+		if globalSettings.GPS_SaveConfig && allAcked {
+			saveFingerprint = ubxConfigFingerprint(msgs)
 		}
+
+		logf(LOG_INFO, "Finished writing u-blox GPS config to %s. Opening port to test connection.\n", device)
 	}
 	p.Close()
 
@@ -333,11 +787,267 @@ func initGPSSerial() bool {
 		log.Printf("serial port err: %s\n", err.Error())
 		return false
 	}
+	if saveFingerprint != "" {
+		saveUBXConfig(p, saveFingerprint)
+	}
 
+	serialPortMutex.Lock()
 	serialPort = p
+	serialPortMutex.Unlock()
 	return true
 }
 
+// CFG-NAV5 dynamic platform models, by globalSettings.GPS_DynModel name.
+var ubxDynModels = map[string]byte{
+	"Portable":   0x00,
+	"Stationary": 0x02,
+	"Pedestrian": 0x03,
+	"Automotive": 0x04,
+	"Sea":        0x05,
+	"Airborne1g": 0x06, // Airborne with <1g acceleration. Gliders, balloons.
+	"Airborne2g": 0x07, // Airborne with <2g acceleration. The default.
+	"Airborne4g": 0x08, // Airborne with <4g acceleration. Aerobatics.
+}
+
+// ubxDynModel returns the name and CFG-NAV5 dynModel for globalSettings.GPS_DynModel. Empty or unknown names give
+// "Airborne2g". It doesn't log, as ubxConfigMessages() also runs for the saved configuration check; see
+// logUBXDynModel().
+func ubxDynModel() (string, byte) {
+	name := globalSettings.GPS_DynModel
+	model, ok := ubxDynModels[name]
+	if !ok {
+		name, model = "Airborne2g", ubxDynModels["Airborne2g"]
+	}
+	return name, model
+}
+
+// logUBXDynModel logs the dynamic platform model once CFG-NAV5 has been written to the receiver.
+func logUBXDynModel() {
+	name, model := ubxDynModel()
+	if s := globalSettings.GPS_DynModel; s != "" && s != name {
+		log.Printf("GPS: unknown dynamic model '%s'. Using %s.\n", s, name)
+	}
+	log.Printf("GPS: dynamic platform model %s (%d).\n", name, model)
+}
+
+// ubxConfigMsg is one UBX CFG message of the receiver configuration.
+type ubxConfigMsg struct {
+	class, id byte
+	payload   []byte
+	what      string // Description for writeUBXConfig(), which waits for the ACK. Empty to send without waiting.
+}
+
+/*
+	ubxConfigMessages().
+		The u-blox configuration sent by initGPSSerial(), in order, for the current settings and receiver
+		 (protocol version, power save). The last message switches the UART to ubxConfiguredBaud().
+*/
+
+func ubxConfigMessages() []ubxConfigMsg {
+	msgs := make([]ubxConfigMsg, 0)
+
+	if globalStatus.GPS_power_save {
+		// Set 1 Hz update. Little endian order.
+		msgs = append(msgs, ubxConfigMsg{0x06, 0x08, []byte{0xE8, 0x03, 0x01, 0x00, 0x01, 0x00}, "1 Hz rate (CFG-RATE)"}) // 1 Hz
+	} else {
+		// 5 Hz update by default. See ubxRatePayload().
+		msgs = append(msgs, ubxConfigMsg{0x06, 0x08, ubxRatePayload(), "navigation rate (CFG-RATE)"})
+	}
+
+	// Set navigation settings.
+	nav := make([]byte, 36)
+	nav[0] = 0x05 // Set dyn and fixMode only.
+	nav[1] = 0x00
+	// dyn. "Airborne with <2g Acceleration" unless set by globalSettings.GPS_DynModel.
+	_, nav[2] = ubxDynModel()
+	nav[3] = 0x02 // 3D only.
+
+	msgs = append(msgs, ubxConfigMsg{0x06, 0x24, nav, "navigation settings (CFG-NAV5)"})
+
+	// GNSS configuration CFG-GNSS for ublox 7 higher, p. 125 (v8)
+	// NOTE: Max position rate = 5 Hz if GPS+GLONASS used.
+
+	// TESTING: 5Hz unified GPS + GLONASS
+
+	// Disable GLONASS to enable 10 Hz solution rate. GLONASS is not used
+	// for SBAS (WAAS), so little real-world impact. Done with globalSettings.GPS_PreferHighRate.
+
+	// Enabled constellations are set by globalSettings.GPS_Constellations. See ubxGNSSPayload().
+	if ubxSupportsGNSS() {
+		msgs = append(msgs, ubxConfigMsg{0x06, 0x3E, ubxGNSSPayload(), "GNSS configuration (CFG-GNSS)"})
+	}
+
+	// SBAS configuration for ublox 6 and higher
+	msgs = append(msgs, ubxConfigMsg{0x06, 0x16, []byte{0x01, 0x07, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00}, ""})
+
+	// Power management. CFG-PM2 sets up cyclic tracking at one fix per second: the receiver powers down
+	//  parts of the RF and baseband between fixes, roughly halving its current draw (on the order of
+	//  25 mA down to 10-15 mA for a u-blox 8 with a good sky view). Position accuracy and dynamic
+	//  response are somewhat worse than continuous mode and reacquisition after signal loss is slower.
+	//  CFG-RXM then selects power save (1) or continuous (0) mode, so disabling the setting reverts it.
+	if globalStatus.GPS_power_save {
+		pm2 := make([]byte, 44)
+		pm2[0] = 0x01 // version.
+		// flags: updateEPH (bit 4), waitTimeFix (bit 10), mode = cyclic tracking (bits 17-18 = 1). Little endian.
+		pm2[4] = 0x10
+		pm2[5] = 0x04
+		pm2[6] = 0x02
+		pm2[7] = 0x00
+		// updatePeriod = 1000 ms.
+		pm2[8] = 0xE8
+		pm2[9] = 0x03
+		// searchPeriod = 10000 ms.
+		pm2[12] = 0x10
+		pm2[13] = 0x27
+		msgs = append(msgs, ubxConfigMsg{0x06, 0x3B, pm2, ""})
+		msgs = append(msgs, ubxConfigMsg{0x06, 0x11, []byte{0x08, 0x01}, ""}) // Power save mode.
+		log.Printf("GPS power save mode enabled (1 Hz cyclic tracking).\n")
+	} else {
+		msgs = append(msgs, ubxConfigMsg{0x06, 0x11, []byte{0x08, 0x00}, ""}) // Continuous mode.
+	}
+
+	// Message output configuration: UBX,00 (position) and GST (error estimates) on each calculated fix; UBX,03
+	//  (satellite info) every 5th fix, UBX,04 (timing) every 10th, GGA (NMEA position) every 5th. All other NMEA
+	//  messages disabled.
+	// Per-port rates can be overridden with globalSettings.GPS_PortMessageRates; see ubxMsgRatePayload().
+	for _, m := range ubxMsgRates {
+		msgs = append(msgs, ubxConfigMsg{0x06, 0x01, ubxMsgRatePayload(m), ""})
+	}
+
+	// Reconfigure serial port.
+	cfg := make([]byte, 20)
+	cfg[0] = 0x01 // portID.
+	cfg[1] = 0x00 // res0.
+	cfg[2] = 0x00 // res1.
+	cfg[3] = 0x00 // res1.
+
+	//      [   7   ] [   6   ] [   5   ] [   4   ]
+	//	0000 0000 0000 0000 0000 10x0 1100 0000
+	// UART mode. 0 stop bits, no parity, 8 data bits. Little endian order.
+	cfg[4] = 0xC0
+	cfg[5] = 0x08
+	cfg[6] = 0x00
+	cfg[7] = 0x00
+
+	// Baud rate. Little endian order.
+	bdrt := uint32(ubxConfiguredBaud())
+	cfg[11] = byte((bdrt >> 24) & 0xFF)
+	cfg[10] = byte((bdrt >> 16) & 0xFF)
+	cfg[9] = byte((bdrt >> 8) & 0xFF)
+	cfg[8] = byte(bdrt & 0xFF)
+
+	// inProtoMask. NMEA and UBX. Little endian.
+	cfg[12] = 0x03
+	cfg[13] = 0x00
+
+	// outProtoMask. NMEA and UBX. Little endian. UBX output is NAV-PVT (with GPS_NavPVT), and ACK/NAK of
+	//  configuration messages for setGNSSConstellations().
+	cfg[14] = 0x03
+	cfg[15] = 0x00
+
+	cfg[16] = 0x00 // flags.
+	cfg[17] = 0x00 // flags.
+
+	cfg[18] = 0x00 //pad.
+	cfg[19] = 0x00 //pad.
+
+	msgs = append(msgs, ubxConfigMsg{0x06, 0x00, cfg, ""})
+	return msgs
+}
+
+// ubxConfigFingerprint identifies a configuration and the receiver it was written to, so that a saved configuration
+// is only trusted for the same receiver firmware and the same settings.
+func ubxConfigFingerprint(msgs []ubxConfigMsg) string {
+	h := crc32.NewIEEE()
+	h.Write([]byte(globalStatus.GPS_hardware_version + "/" + globalStatus.GPS_firmware_version))
+	for _, m := range msgs {
+		h.Write(makeUBXCFG(m.class, m.id, uint16(len(m.payload)), m.payload))
+	}
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// saveUBXConfig saves the receiver's current configuration to its battery backed RAM and flash (CFG-CFG), and
+// records the fingerprint in gpsSavedConfigLocation for openSavedUBXConfig() on the next start.
+func saveUBXConfig(p *serial.Port, fingerprint string) {
+	// clearMask none, saveMask all sections, loadMask none, deviceMask BBR, flash, EEPROM and SPI flash.
+	save := []byte{0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17}
+	if !writeUBXConfig(p, 0x06, 0x09, save, "save configuration (CFG-CFG)") {
+		return
+	}
+	if err := ioutil.WriteFile(gpsSavedConfigLocation, []byte(fingerprint+"\n"), 0644); err != nil {
+		log.Printf("GPS: can't write %s: %s\n", gpsSavedConfigLocation, err.Error())
+		return
+	}
+	log.Printf("GPS configuration saved to the receiver.\n")
+}
+
+/*
+	openSavedUBXConfig().
+		Checks for a receiver that already runs the configuration initGPSSerial() would send, saved with
+		 saveUBXConfig() on an earlier start. The receiver must answer at ubxConfiguredBaud(), the fingerprint
+		 of the configuration for its firmware and the current settings must match gpsSavedConfigLocation,
+		 and its CFG-RATE must read back as configured. Returns the port, ready for gpsSerialReader(), or
+		 nil to configure the receiver as usual.
+*/
+
+func openSavedUBXConfig(device string) *serial.Port {
+	saved, err := ioutil.ReadFile(gpsSavedConfigLocation)
+	if err != nil {
+		return nil
+	}
+	p, err := serial.OpenPort(&serial.Config{Name: device, Baud: ubxConfiguredBaud(), ReadTimeout: 100 * time.Millisecond})
+	if err != nil {
+		return nil
+	}
+	queryUBXVersion(p)
+	msgs := ubxConfigMessages()
+	if globalStatus.GPS_protocol_version == 0 || ubxConfigFingerprint(msgs) != strings.TrimSpace(string(saved)) {
+		p.Close()
+		logf(LOG_INFO, "GPS: saved configuration doesn't match the receiver or settings. Reconfiguring.\n")
+		return nil
+	}
+	p.Write(makeUBXCFG(0x06, 0x08, 0, nil)) // Poll CFG-RATE.
+	frame := readUBXFrame(p, ubxConfigAckTimeout, func(f []byte) bool { return f[2] == 0x06 && f[3] == 0x08 })
+	p.Close()
+	if frame == nil || len(frame) < 6+6+2 || !bytes.Equal(frame[6:12], msgs[0].payload) {
+		log.Printf("GPS: receiver isn't running the saved configuration. Reconfiguring.\n")
+		return nil
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	serialConfig = &serial.Config{Name: device, Baud: ubxConfiguredBaud(), ReadTimeout: time.Millisecond * 2500}
+	if p, err = serial.OpenPort(serialConfig); err != nil {
+		log.Printf("serial port err: %s\n", err.Error())
+		return nil
+	}
+	log.Printf("GPS: using the configuration saved in the receiver.\n")
+	return p
+}
+
+/*
+	clearSavedGPSConfig().
+		Erases the configuration saved in the receiver's battery backed RAM and flash (CFG-CFG clearMask),
+		 for recovery. The running configuration is unchanged; the receiver starts with its defaults next
+		 time, and is configured from scratch.
+*/
+
+func clearSavedGPSConfig() error {
+	os.Remove(gpsSavedConfigLocation)
+	if !ubxReceiverConnected() {
+		return fmt.Errorf("no u-blox receiver connected")
+	}
+	for len(ubxAckChan) > 0 { // Drop stale ACKs.
+		<-ubxAckChan
+	}
+	clearCfg := []byte{0xFF, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x17}
+	writeUBX(0x06, 0x09, clearCfg)
+	if acked, _ := waitUBXAck(0x06, 0x09, 2*time.Second); !acked {
+		return fmt.Errorf("receiver didn't acknowledge clearing its saved configuration")
+	}
+	log.Printf("GPS: saved configuration cleared.\n")
+	return nil
+}
+
 // func validateNMEAChecksum determines if a string is a properly formatted NMEA sentence with a valid checksum.
 //
 // If the input string is valid, output is the input stripped of the "$" token and checksum, along with a boolean 'true'
@@ -378,43 +1088,702 @@ func validateNMEAChecksum(s string) (string, bool) {
 	return s_out, true
 }
 
-//  Only count this heading if a "sustained" >7 kts is obtained. This filters out a lot of heading
-//  changes while on the ground and "movement" is really only changes in GPS fix as it settles down.
-//TODO: Some more robust checking above current and last speed.
-//TODO: Dynamic adjust for gain based on groundspeed
-func setTrueCourse(groundSpeed uint16, trueCourse float64) {
-	/*if myMPU6050 != nil && globalStatus.RY835AI_connected && globalSettings.AHRS_Enabled {
-		if mySituation.GroundSpeed >= 7 && groundSpeed >= 7 {
-			myMPU6050.ResetHeading(trueCourse, 0.10)
-		}
-	}*/
+// Satellites in solution from the current run of GSA sentences. Protected by mySituation.mu_GPS.
+var gsaCycleSVs map[string]bool
+var gsaCycleOpen bool      // A run of GSA sentences is in progress.
+var gsaCycleTruncated bool // At least one GSA sentence in the run was full (12 satellites), so there may be more.
+
+var ggaUnitsLogged = make(map[string]bool)
+
+// ggaUnitsToFeet returns the factor to convert a GGA altitude or geoid separation to feet, from its units field.
+// The standard is "M"; some firmwares send "F" or nothing. Anything else is logged once and assumed to be meters.
+func ggaUnitsToFeet(units, field string) float64 {
+	switch units {
+	case "M":
+		return 3.28084
+	case "F":
+		return 1.0
+	}
+	if !ggaUnitsLogged[field+units] {
+		log.Printf("GPS: unexpected GGA %s units '%s', assuming meters.\n", field, units)
+		ggaUnitsLogged[field+units] = true
+	}
+	return 3.28084
 }
 
-func calculateNACp(accuracy float32) uint8 {
-	ret := uint8(0)
+var lastPUBXAltitudeTime time.Time // stratuxClock time of the last altitude taken from PUBX,00. Protected by mySituation.mu_GPS.
+var lastGeoidSepTime time.Time     // stratuxClock time of the last geoid separation reported by the receiver (GGA, NAV-PVT). Protected by mySituation.mu_GPS.
 
-	if accuracy < 3 {
-		ret = 11
-	} else if accuracy < 10 {
-		ret = 10
-	} else if accuracy < 30 {
-		ret = 9
-	} else if accuracy < 92.6 {
-		ret = 8
-	} else if accuracy < 185.2 {
-		ret = 7
-	} else if accuracy < 555.6 {
-		ret = 6
+// updateGeoidSep falls back to the built-in geoid model (geoidHeight()) for the geoid separation when the receiver
+// hasn't reported one recently - for example when GGA is disabled or hasn't arrived yet after startup.
+func updateGeoidSep(s *GPSSituationData) {
+	if stratuxClock.Since(lastGeoidSepTime) < 10*time.Second {
+		return
 	}
+	s.GeoidSep = float32(geoidHeight(float64(s.Lat), float64(s.Lng)) * 3.28084) // feet
+}
 
-	return ret
+// useAltitudeFrom reports whether an altitude from the given sentence type ("GGA" or "PUBX") should be used,
+// so that receivers sending both don't alternate between two slightly different altitudes. By default PUBX,00
+// (every fix, HAE + GeoidSep) is preferred and GGA is only used when no PUBX,00 altitude has been seen recently.
+func useAltitudeFrom(source string) bool {
+	switch globalSettings.GPS_AltitudeSource {
+	case "GGA", "PUBX":
+		return source == globalSettings.GPS_AltitudeSource
+	}
+	return source == "PUBX" || stratuxClock.Since(lastPUBXAltitudeTime) > 3*time.Second
 }
 
 /*
-processNMEALine parses NMEA-0183 formatted strings against several message types.
+	Situation filter windows.
+		All smoothing of situation data is configured here, in seconds rather than samples, so that a filter
+		 behaves the same at 1 Hz and 10 Hz. filterWindowSamples() converts a window to a sample count using
+		 the fix rate measured by updateFixRate(), so windows follow the receiver if its rate changes.
+		 Defaults can be overridden per filter with globalSettings.GPS_FilterWindows.
+*/
 
-Standard messages supported: RMC GGA VTG GSA
-U-blox proprietary messages: PUBX,00 PUBX,03 PUBX,04
+var defaultFilterWindows = map[string]float64{
+	"vertvel":     1.0, // GPS vertical speed (PUBX,00).
+	"track":       2.0, // Ground track. See updateGroundTrack().
+	"barovertvel": 3.0, // Pressure altitude vertical speed. See updateBaroVertVel().
+}
+
+var gpsFixInterval float64 // Seconds between fixes, smoothed. Protected by mySituation.mu_GPS.
+var lastFixEpoch float64   // LastFixSinceMidnightUTC of the last fix seen by updateFixRate().
+
+var gpsVertVelFilter movingAverage
+var lastGPSVertVelTime time.Time // stratuxClock time GPSVertVel was last updated. See isGPSVertVelValid().
+
+// fixTimeDelta returns the seconds from fix time 'from' to fix time 'to' (both seconds since midnight UTC), taking the
+// shorter way around midnight, so 86399.5 to 0.5 is +1 s rather than -86399 s. Deltas are between -12 h and +12 h.
+func fixTimeDelta(from, to float64) float64 {
+	d := to - from
+	if d < -12*3600 {
+		d += 24 * 3600
+	} else if d >= 12*3600 {
+		d -= 24 * 3600
+	}
+	return d
+}
+
+// updateFixRate measures the receiver's navigation rate from the fix times of successive solutions.
+// Several sentences report the same fix, so only a change of fix time counts.
+func updateFixRate(fixTime float64) {
+	if fixTime == lastFixEpoch {
+		return
+	}
+	dt := fixTimeDelta(lastFixEpoch, fixTime)
+	lastFixEpoch = fixTime
+	if dt <= 0 || dt > 5 { // Out of order, or a gap in the fixes.
+		return
+	}
+	if gpsFixInterval == 0 {
+		gpsFixInterval = dt
+	} else {
+		gpsFixInterval += 0.1 * (dt - gpsFixInterval)
+	}
+	globalStatus.GPS_fix_rate = 1 / gpsFixInterval
+}
+
+var gpsCurrentEpoch float64 // Newest fix time (seconds since midnight UTC) seen in any sentence. Protected by mySituation.mu_GPS.
+var gpsEpochValid bool
+var gpsEpochTime time.Time // stratuxClock time gpsCurrentEpoch last advanced.
+
+// isStaleEpoch reports whether a sentence's fix time is older than the newest epoch already seen, e.g. a delayed
+// sentence from the previous cycle interleaved with the current one, so it must not overwrite fresher fields.
+// Times are compared across midnight with fixTimeDelta(), and if nothing newer has been seen for 3 seconds the
+// receiver's clock is assumed to have been corrected, and the epoch restarts.
+func isStaleEpoch(sentence string, fixTime float64) bool {
+	if gpsEpochValid && fixTimeDelta(gpsCurrentEpoch, fixTime) < 0 && stratuxClock.Since(gpsEpochTime) < 3*time.Second {
+		if globalSettings.GPS_RejectStaleEpochs {
+			logf(LOG_DEBUG, "GPS: ignoring %s from fix time %.2f, older than current epoch %.2f\n", sentence, fixTime, gpsCurrentEpoch)
+			return true
+		}
+		return false
+	}
+	if fixTime != gpsCurrentEpoch || !gpsEpochValid {
+		gpsEpochTime = stratuxClock.Time
+	}
+	gpsCurrentEpoch = fixTime
+	gpsEpochValid = true
+	return false
+}
+
+// filterWindowSeconds returns the length of the named filter window, in seconds.
+func filterWindowSeconds(name string) float64 {
+	if v, ok := globalSettings.GPS_FilterWindows[name]; ok {
+		return float64(v)
+	}
+	return defaultFilterWindows[name]
+}
+
+// filterWindowSamples returns the number of fixes that make up the named filter window. At least 1.
+func filterWindowSamples(name string) int {
+	secs := filterWindowSeconds(name)
+	rate := 1.0
+	if gpsFixInterval > 0 {
+		rate = 1 / gpsFixInterval
+	}
+	n := int(secs*rate + 0.5)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// movingAverage is a simple moving average whose window (in samples) can change from one sample to the next.
+type movingAverage struct {
+	samples []float64
+}
+
+func (m *movingAverage) add(v float64, n int) float64 {
+	m.samples = append(m.samples, v)
+	if len(m.samples) > n {
+		m.samples = m.samples[len(m.samples)-n:]
+	}
+	var sum float64
+	for _, x := range m.samples {
+		sum += x
+	}
+	return sum / float64(len(m.samples))
+}
+
+// parseMagneticVariation parses the RMC magnetic variation and its E/W field. East is positive.
+func parseMagneticVariation(v, ew string) (float32, bool) {
+	if v == "" || (ew != "E" && ew != "W") {
+		return 0, false
+	}
+	variation, err := strconv.ParseFloat(v, 32)
+	if err != nil {
+		return 0, false
+	}
+	if ew == "W" {
+		variation = -variation
+	}
+	return float32(variation), true
+}
+
+// updateMagneticCourse sets s.MagneticCourse from s.TrueCourse and the last magnetic variation from RMC.
+// Without a variation, MagneticCourse is left equal to TrueCourse.
+func updateMagneticCourse(s *GPSSituationData) {
+	mc := s.TrueCourse
+	if s.MagneticVariationValid {
+		mc -= s.MagneticVariation
+	}
+	for mc < 0 {
+		mc += 360
+	}
+	for mc >= 360 {
+		mc -= 360
+	}
+	s.MagneticCourse = mc
+}
+
+// groundTrackSample is a velocity sample kept by updateGroundTrack().
+type groundTrackSample struct {
+	speed   float64 // Knots.
+	course  float64 // Degrees true.
+	fixTime float64 // LastFixSinceMidnightUTC of the fix the sample belongs to.
+	t       time.Time
+}
+
+// One sample per fix, so 12.8 s at 10 Hz. A longer "track" filter window is cut to that, with a warning.
+var groundTrackSamples [128]groundTrackSample // Ring buffer. Protected by mySituation.mu_GPS.
+var groundTrackNext int                       // Index of the next sample to write.
+var groundTrackWindowWarned bool              // The "track" window is longer than groundTrackSamples holds, and that was logged.
+
+/*
+	updateGroundTrack().
+		Adds a groundspeed (kts) and track (deg true) sample, and updates s.TrueCourse with the track
+		 averaged over the "track" filter window - but only while the speed has stayed above
+		 globalSettings.GPS_TrackMinSpeed for the whole window. At low speed the reported track is mostly
+		 fix noise, so the last good course is kept. Tracks are averaged as velocity vectors so that
+		 359 and 1 degrees average to 0, not 180. RMC, VTG and PUBX,00 of the same fix (by
+		 s.LastFixSinceMidnightUTC) share one sample, the latest, so the window isn't filled three times as fast.
+*/
+
+func updateGroundTrack(s *GPSSituationData, groundspeed, trueCourse float64) {
+	last := (groundTrackNext - 1 + len(groundTrackSamples)) % len(groundTrackSamples)
+	if !groundTrackSamples[last].t.IsZero() && groundTrackSamples[last].fixTime == s.LastFixSinceMidnightUTC {
+		groundTrackNext = last // Same fix, from another sentence. Replace its sample.
+	}
+	groundTrackSamples[groundTrackNext] = groundTrackSample{speed: groundspeed, course: trueCourse, fixTime: s.LastFixSinceMidnightUTC, t: stratuxClock.Time}
+	groundTrackNext = (groundTrackNext + 1) % len(groundTrackSamples)
+
+	if n := filterWindowSamples("track"); n > len(groundTrackSamples) && !groundTrackWindowWarned {
+		logf(LOG_WARN, "GPS: track filter window of %.1f s (%d fixes) is longer than the %d fixes kept. Using %d.\n",
+			filterWindowSeconds("track"), n, len(groundTrackSamples), len(groundTrackSamples))
+		groundTrackWindowWarned = true
+	}
+
+	window := time.Duration(filterWindowSeconds("track") * float64(time.Second))
+	var north, east float64
+	for i := 0; i < len(groundTrackSamples); i++ {
+		smp := groundTrackSamples[(groundTrackNext-1-i+len(groundTrackSamples))%len(groundTrackSamples)]
+		if i > 0 && (smp.t.IsZero() || stratuxClock.Time.Sub(smp.t) > window) {
+			break
+		}
+		if smp.speed <= float64(globalSettings.GPS_TrackMinSpeed) {
+			return // Not sustained. Keep the last course.
+		}
+		north += smp.speed * math.Cos(radians(smp.course))
+		east += smp.speed * math.Sin(radians(smp.course))
+	}
+	s.TrueCourse = float32(degreesHdg(math.Atan2(east, north)))
+	updateDisplayCourse(s)
+	updateMagneticCourse(s)
+}
+
+var lastDisplayCourseTime time.Time // stratuxClock time DisplayCourse was last updated. Protected by mySituation.mu_GPS.
+
+/*
+	updateDisplayCourse().
+		Moves s.DisplayCourse towards s.TrueCourse by at most globalSettings.GPS_MaxCourseSlewRate
+		 degrees per second, so that the ownship icon rotates smoothly rather than snapping between
+		 discrete GPS track updates. After a gap in track updates, or a jump of more than 90 degrees,
+		 DisplayCourse is set straight to TrueCourse instead of slowly converging.
+*/
+
+func updateDisplayCourse(s *GPSSituationData) {
+	rawSituation.TrueCourse = s.TrueCourse
+	dt := stratuxClock.Since(lastDisplayCourseTime).Seconds()
+	lastDisplayCourseTime = stratuxClock.Time
+
+	diff := float32(degreesRel(radians(float64(s.TrueCourse - s.DisplayCourse))))
+
+	rate := globalSettings.GPS_MaxCourseSlewRate
+	if rate <= 0 || dt > 3 || diff > 90 || diff < -90 {
+		s.DisplayCourse = s.TrueCourse
+		return
+	}
+	maxStep := rate * float32(dt)
+	if diff > maxStep {
+		diff = maxStep
+	} else if diff < -maxStep {
+		diff = -maxStep
+	}
+	s.DisplayCourse = float32(degreesHdg(radians(float64(s.DisplayCourse + diff))))
+}
+
+// isVertVelPlausible checks a vertical velocity (ft/min) against the configured sanity limit. Used for both
+// GPS and barometric vertical speed so that a single bad sample doesn't propagate to vario consumers.
+func isVertVelPlausible(vv float32, source string) bool {
+	limit := float32(globalSettings.MaxVertVel)
+	if limit <= 0 || (vv <= limit && vv >= -limit) {
+		return true
+	}
+	log.Printf("%s vertical velocity %.0f ft/min exceeds +/-%.0f ft/min limit. Keeping last good value.\n", source, vv, limit)
+	return false
+}
+
+/*
+	constellationAccuracyWeight().
+		Weighting model for the HDOP-based accuracy estimate. Each satellite in solution contributes the
+		 weight configured for its constellation in globalSettings.GPS_AccuracyWeights (1.0 if not
+		 configured), and the estimate is scaled by the mean weight of all satellites in solution.
+		 e.g., {"GLONASS": 1.5} makes an all-GLONASS solution 50% less accurate than an all-GPS
+		 solution with the same HDOP, and a half GPS / half GLONASS solution 25% less accurate.
+		With no weights configured (the default) the factor is always 1.0.
+		Also returns the mix of satellites in solution, e.g. "GPS:8 GLONASS:4 SBAS:1".
+		Caller must hold satelliteMutex.
+*/
+
+func constellationAccuracyWeight() (float32, string) {
+	counts := make(map[uint8]int)
+	for _, thisSatellite := range Satellites {
+		if thisSatellite.InSolution {
+			counts[thisSatellite.Type]++
+		}
+	}
+
+	var weightSum float32
+	var total int
+	mix := make([]string, 0)
+	for _, svType := range satTypeOrder {
+		n := counts[svType]
+		if n == 0 {
+			continue
+		}
+		w, ok := globalSettings.GPS_AccuracyWeights[satTypeNames[svType]]
+		if !ok || w <= 0 {
+			w = 1.0
+		}
+		weightSum += w * float32(n)
+		total += n
+		mix = append(mix, fmt.Sprintf("%s:%d", satTypeNames[svType], n))
+	}
+
+	if total == 0 {
+		return 1.0, ""
+	}
+	return weightSum / float32(total), strings.Join(mix, " ")
+}
+
+/*
+	checkFrozenFix().
+		Some receivers, on losing lock, keep emitting the last valid GGA/RMC unchanged instead of flagging
+		 the fix invalid. If the reported position hasn't changed for globalSettings.GPS_FrozenFixTimeout
+		 seconds while either the fix time is also unchanged or the receiver claims to be moving, the fix
+		 is marked frozen. A frozen fix has its NACp degraded to 0, or is invalidated entirely if
+		 globalSettings.GPS_FrozenFixInvalidate is set. A position that is static while the fix time keeps
+		 advancing at low groundspeed is normal (u-blox static hold) and isn't flagged.
+
+		Must be called with mySituation.mu_GPS held, on a position message that is about to be committed.
+*/
+
+func checkFrozenFix(s *GPSSituationData) {
+	if s.Lat != frozenFixLat || s.Lng != frozenFixLng || (s.LastFixSinceMidnightUTC != frozenFixTime && s.GroundSpeed < 5) {
+		if s.FixFrozen {
+			log.Printf("GPS fix is updating again.\n")
+		}
+		frozenFixLat = s.Lat
+		frozenFixLng = s.Lng
+		frozenFixTime = s.LastFixSinceMidnightUTC
+		frozenFixSince = stratuxClock.Time
+		s.FixFrozen = false
+		return
+	}
+	frozenFixTime = s.LastFixSinceMidnightUTC
+
+	if globalSettings.GPS_FrozenFixTimeout <= 0 || stratuxClock.Since(frozenFixSince) < time.Duration(globalSettings.GPS_FrozenFixTimeout)*time.Second {
+		return
+	}
+	if !s.FixFrozen {
+		log.Printf("GPS fix appears frozen: position %.5f,%.5f unchanged for %s (fix time %.1f, groundspeed %d kts).\n",
+			s.Lat, s.Lng, stratuxClock.Since(frozenFixSince), s.LastFixSinceMidnightUTC, s.GroundSpeed)
+	}
+	s.FixFrozen = true
+	s.NACp = 0
+	if globalSettings.GPS_FrozenFixInvalidate {
+		s.Quality = 0
+	}
+}
+
+/*
+	applyAntennaOffset().
+		Lever-arm correction. Moves a freshly parsed antenna position to the aircraft reference point,
+		 using globalSettings.GPS_AntennaOffsetFwd/Right/Up: the antenna position relative to the
+		 reference point in meters, in the body frame (x forward along the longitudinal axis, y out the
+		 right wing, z up through the cabin roof). The offset is rotated into the local level frame
+		 using the AHRS pitch and roll and the aircraft heading (GPS true course while moving, otherwise
+		 the AHRS heading), then subtracted. No correction is made while the AHRS attitude is invalid.
+		 altUpdated says whether s.Alt came from this sentence, so that it's only corrected once.
+
+		Must be called after checkFrozenFix(), which compares raw antenna positions.
+*/
+
+func applyAntennaOffset(s *GPSSituationData, altUpdated bool) {
+	rawSituation.Lat = s.Lat
+	rawSituation.Lng = s.Lng
+	if altUpdated {
+		rawSituation.Alt = s.Alt
+	}
+
+	fwd := float64(globalSettings.GPS_AntennaOffsetFwd)
+	right := float64(globalSettings.GPS_AntennaOffsetRight)
+	down := -float64(globalSettings.GPS_AntennaOffsetUp)
+	if (fwd == 0 && right == 0 && down == 0) || !isAHRSValid() {
+		return
+	}
+
+	hdg := mySituation.Gyro_heading
+	if isGPSGroundTrackValid() && s.GroundSpeed > 10 {
+		hdg = float64(s.TrueCourse)
+	}
+	psi := hdg * math.Pi / 180
+	theta := mySituation.Pitch * math.Pi / 180
+	phi := mySituation.Roll * math.Pi / 180
+	cpsi, spsi := math.Cos(psi), math.Sin(psi)
+	cth, sth := math.Cos(theta), math.Sin(theta)
+	cphi, sphi := math.Cos(phi), math.Sin(phi)
+
+	// Body to north-east-down.
+	north := cpsi*cth*fwd + (cpsi*sth*sphi-spsi*cphi)*right + (cpsi*sth*cphi+spsi*sphi)*down
+	east := spsi*cth*fwd + (spsi*sth*sphi+cpsi*cphi)*right + (spsi*sth*cphi-cpsi*sphi)*down
+	d := -sth*fwd + cth*sphi*right + cth*cphi*down
+
+	lat, lng := offsetLatLon(float64(s.Lat), float64(s.Lng), -north, -east)
+	s.Lat = float32(lat)
+	s.Lng = float32(lng)
+	if altUpdated {
+		s.Alt += float32(d * 3.28084) // Antenna is d meters below the reference point.
+		s.HeightAboveEllipsoid += float32(d * 3.28084)
+	}
+}
+
+// setUncertaintyRadius fills in the display radius of the 95% horizontal position uncertainty circle from
+// s.Accuracy, the best available accuracy estimate (PUBX,00 / NAV-PVT hAcc or GST if available, otherwise from HDOP).
+func setUncertaintyRadius(s *GPSSituationData) {
+	s.UncertaintyRadiusValid = s.Quality > 0 && s.Accuracy > 0 && !s.FixFrozen
+	if !s.UncertaintyRadiusValid {
+		s.UncertaintyRadiusM = 0
+		s.UncertaintyRadiusFt = 0
+		s.UncertaintyRadiusNM = 0
+		return
+	}
+	s.UncertaintyRadiusM = s.Accuracy
+	s.UncertaintyRadiusFt = s.Accuracy * 3.28084
+	s.UncertaintyRadiusNM = s.Accuracy / 1852.0
+}
+
+func calculateNACp(accuracy float32) uint8 {
+	ret := uint8(0)
+
+	if accuracy < 3 {
+		ret = 11
+	} else if accuracy < 10 {
+		ret = 10
+	} else if accuracy < 30 {
+		ret = 9
+	} else if accuracy < 92.6 {
+		ret = 8
+	} else if accuracy < 185.2 {
+		ret = 7
+	} else if accuracy < 555.6 {
+		ret = 6
+	}
+
+	return ret
+}
+
+// calculateNACv returns the NACv category (DO-260B) for a 95% horizontal velocity accuracy in m/s. 0 = unknown or >= 10 m/s.
+func calculateNACv(accuracy float32) uint8 {
+	ret := uint8(0)
+
+	if accuracy <= 0 {
+		ret = 0
+	} else if accuracy < 0.3 {
+		ret = 4
+	} else if accuracy < 1 {
+		ret = 3
+	} else if accuracy < 3 {
+		ret = 2
+	} else if accuracy < 10 {
+		ret = 1
+	}
+
+	return ret
+}
+
+/*
+	calculateNACpHysteresis().
+		Wraps calculateNACp() so that an accuracy estimate hovering around a category boundary doesn't
+		 flip NACp on every fix. The category only changes from prev once the accuracy is more than
+		 globalSettings.GPS_NACpHysteresis (fraction of the boundary value) past the boundary. Large
+		 changes still take effect immediately.
+*/
+
+func calculateNACpHysteresis(accuracy float32, prev uint8) uint8 {
+	nacp := calculateNACp(accuracy)
+	rawSituation.NACp = nacp
+	band := globalSettings.GPS_NACpHysteresis
+	if band <= 0 || prev == 0 || nacp == prev {
+		return nacp
+	}
+	if nacp > prev { // Improving. Require the accuracy to be comfortably below the boundary.
+		if n := calculateNACp(accuracy * (1 + band)); n > prev {
+			return n
+		}
+	} else { // Degrading. Require the accuracy to be comfortably above the boundary.
+		if n := calculateNACp(accuracy * (1 - band)); n < prev {
+			return n
+		}
+	}
+	return prev
+}
+
+var lastGSTTime time.Time // stratuxClock time of the last GST used. Protected by mySituation.mu_GPS.
+
+// isGSTRecent reports whether GST error estimates are arriving, in which case they take precedence over the HDOP estimate from GSA.
+func isGSTRecent() bool {
+	return stratuxClock.Since(lastGSTTime) < 3*time.Second
+}
+
+// GGA quality for each GNS mode indicator, in order of preference: RTK fixed, RTK float, differential, autonomous or
+// precise, estimated (dead reckoning). N (no fix), M (manual input) and S (simulator) don't count as a fix.
+var gnsModes = []struct {
+	mode    byte
+	quality uint8
+}{{'R', 4}, {'F', 5}, {'D', 2}, {'A', 1}, {'P', 1}, {'E', 6}}
+
+// gnsModeQuality returns the GGA-equivalent quality of a GNS mode indicator string, one character per constellation
+// (e.g. "AADN"): the best mode of any constellation. 0 if none has a fix.
+func gnsModeQuality(modes string) uint8 {
+	for _, m := range gnsModes {
+		if strings.IndexByte(modes, m.mode) >= 0 {
+			return m.quality
+		}
+	}
+	return 0
+}
+
+// isValidLatLng reports whether a parsed position is on the globe. Corrupt sentences with a valid checksum are
+// rare, but some clone receivers send them. Such a fix is rejected without changing mySituation. Written so that
+// NaN (strconv.ParseFloat accepts "NaN") fails too.
+func isValidLatLng(lat, lng float32) bool {
+	if !(lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180) {
+		logf(LOG_DEBUG, "GPS: rejecting out of range position %f, %f\n", lat, lng)
+		return false
+	}
+	return true
+}
+
+var talkerLastSeen = make(map[string]time.Time) // stratuxClock time each position sentence (talker + type) was last used.
+var talkerSkipLogged = make(map[string]bool)
+
+/*
+	isLowerPrecedenceTalker().
+		Multi-GNSS receivers may send the same position sentence from several talkers in one fix cycle,
+		 e.g. GNGGA (combined solution) and GPGGA (GPS only), with slightly different values. For GGA,
+		 GNS and RMC, a sentence is skipped if the same sentence type was received from a talker earlier in
+		 globalSettings.GPS_TalkerPrecedence within the last 3 seconds. An empty precedence list disables
+		 this, and talkers not in the list are always used.
+
+		Must be called with mySituation.mu_GPS held.
+*/
+
+func isLowerPrecedenceTalker(sentence string) bool {
+	if len(sentence) != 5 || len(globalSettings.GPS_TalkerPrecedence) == 0 {
+		return false
+	}
+	talker, sentenceType := sentence[:2], sentence[2:]
+	if sentenceType != "GGA" && sentenceType != "GNS" && sentenceType != "RMC" {
+		return false
+	}
+
+	for _, preferred := range globalSettings.GPS_TalkerPrecedence {
+		if preferred == talker {
+			break // Nothing better seen.
+		}
+		if t, ok := talkerLastSeen[preferred+sentenceType]; ok && stratuxClock.Since(t) < 3*time.Second {
+			if !talkerSkipLogged[sentence] {
+				log.Printf("GPS: ignoring %s in favor of %s%s.\n", sentence, preferred, sentenceType)
+				talkerSkipLogged[sentence] = true
+			}
+			return true
+		}
+	}
+	talkerLastSeen[sentence] = stratuxClock.Time
+	talkerSkipLogged[sentence] = false
+	return false
+}
+
+/*
+	isNMEASentenceDisabled().
+		Checks a raw sentence against globalSettings.GPS_DisabledSentences, before any parsing. Entries
+		 can name a sentence with its talker ("GPGSA"), without it to match every talker ("GSV"), or a
+		 u-blox proprietary message ("PUBX,03").
+*/
+
+func isNMEASentenceDisabled(l string) bool {
+	if len(globalSettings.GPS_DisabledSentences) == 0 || len(l) < 7 || l[0] != '$' {
+		return false
+	}
+	end := strings.IndexAny(l, ",*")
+	if end < 0 {
+		return false
+	}
+	id := l[1:end]
+	for _, disabled := range globalSettings.GPS_DisabledSentences {
+		if disabled == id || (len(id) == 5 && disabled == id[2:]) || (id == "PUBX" && strings.HasPrefix(l[1:], disabled+",")) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	parseGGAFix().
+		The fields that GGA and GNS share: fix time (x[1]), latitude (x[2], x[3]) and longitude (x[4], x[5]),
+		 plus the MSL altitude and geoid separation, whose fields and units differ between the two sentences
+		 and are passed in. Everything is parsed and checked before the fix time counts towards the epoch
+		 and the fix rate, so a bad sentence returns false having changed nothing outside s. altUpdated is
+		 whether the altitude was used (see useAltitudeFrom()).
+*/
+
+func parseGGAFix(x []string, s *GPSSituationData, alt, altUnits, sep, sepUnits string) (altUpdated, ok bool) {
+	// Timestamp.
+	if len(x[1]) < 7 {
+		return false, false
+	}
+	hr, min, sec, ok := parseNMEATime(x[1])
+	if !ok {
+		return false, false
+	}
+	fixTime := float64(3600*hr+60*min) + sec
+
+	// Latitude.
+	if len(x[2]) < 4 {
+		return false, false
+	}
+	deg, err1 := strconv.Atoi(x[2][0:2])
+	minf, err2 := strconv.ParseFloat(x[2][2:], 32)
+	if err1 != nil || err2 != nil {
+		return false, false
+	}
+	lat := float32(deg) + float32(minf/60.0)
+	if x[3] == "S" { // South = negative.
+		lat = -lat
+	}
+
+	// Longitude.
+	if len(x[4]) < 5 {
+		return false, false
+	}
+	deg, err1 = strconv.Atoi(x[4][0:3])
+	minf, err2 = strconv.ParseFloat(x[4][3:], 32)
+	if err1 != nil || err2 != nil {
+		return false, false
+	}
+	lng := float32(deg) + float32(minf/60.0)
+	if x[5] == "W" { // West = negative.
+		lng = -lng
+	}
+	if !isValidLatLng(lat, lng) {
+		return false, false
+	}
+
+	// Altitude, and the geoid separation if the receiver sends one. Some leave it empty; the built-in geoid model
+	//  is used then.
+	altF, err1 := strconv.ParseFloat(alt, 32)
+	if err1 != nil {
+		return false, false
+	}
+	var geoidSep float64
+	if sep != "" {
+		if geoidSep, err1 = strconv.ParseFloat(sep, 32); err1 != nil {
+			return false, false
+		}
+	}
+
+	if isStaleEpoch(x[0], fixTime) {
+		return false, false
+	}
+	updateFixRate(fixTime)
+
+	s.LastFixSinceMidnightUTC = fixTime
+	s.Lat = lat
+	s.Lng = lng
+	if sep != "" {
+		s.GeoidSep = float32(geoidSep * ggaUnitsToFeet(sepUnits, "geoid separation"))
+		lastGeoidSepTime = stratuxClock.Time
+	} else {
+		updateGeoidSep(s)
+	}
+	altUpdated = useAltitudeFrom("GGA") // GNS has the same precedence as GGA.
+	if altUpdated {
+		s.Alt = float32(altF * ggaUnitsToFeet(altUnits, "altitude"))
+		s.HeightAboveEllipsoid = s.GeoidSep + s.Alt
+	}
+	s.LastFixLocalTime = stratuxClock.Time
+	return altUpdated, true
+}
+
+/*
+processNMEALine parses NMEA-0183 formatted strings against several message types.
+
+Standard messages supported: RMC GGA GNS VTG GSA
+U-blox proprietary messages: PUBX,00 PUBX,03 PUBX,04
 
 return is false if errors occur during parse, or if GPS position is invalid
 return is true if parse occurs correctly and position is valid.
@@ -425,12 +1794,20 @@ func processNMEALine(l string) (sentenceUsed bool) {
 	mySituation.mu_GPS.Lock()
 
 	defer func() {
-		if sentenceUsed || globalSettings.DEBUG {
+		if sentenceUsed || logLevelEnabled(LOG_DEBUG) {
 			logSituation()
 		}
 		mySituation.mu_GPS.Unlock()
 	}()
 
+	if globalSettings.DemoMode { // Situation is held by setDemoSituation().
+		return false
+	}
+
+	if isNMEASentenceDisabled(l) {
+		return false
+	}
+
 	l_valid, validNMEAcs := validateNMEAChecksum(l)
 	if !validNMEAcs {
 		log.Printf("GPS error. Invalid NMEA string: %s\n", l_valid) // remove log message once validation complete
@@ -440,6 +1817,15 @@ func processNMEALine(l string) (sentenceUsed bool) {
 
 	mySituation.LastValidNMEAMessageTime = stratuxClock.Time
 	mySituation.LastValidNMEAMessage = l
+	nmeaServerSendLine(l, x[0])
+
+	if (x[0] != "GNGSA") && (x[0] != "GPGSA") {
+		gsaCycleOpen = false // Any other sentence ends a run of GSA sentences.
+	}
+
+	if isLowerPrecedenceTalker(x[0]) {
+		return false
+	}
 
 	if x[0] == "PUBX" { // UBX proprietary message
 		if x[1] == "00" { // Position fix.
@@ -447,7 +1833,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 				return false
 			}
 
-			tmpSituation := mySituation // If we decide to not use the data in this message, then don't make incomplete changes in mySituation.
+			tmpSituation := mySituation.GPSSituationData // If we decide to not use the data in this message, then don't make incomplete changes in mySituation.
 
 			// Do the accuracy / quality fields first to prevent invalid position etc. from being sent downstream
 			// field 8 = nav status
@@ -474,7 +1860,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			tmpSituation.Accuracy = float32(hAcc * 2) // UBX reports 1-sigma variation; NACp is 95% confidence (2-sigma)
 
 			// NACp estimate.
-			tmpSituation.NACp = calculateNACp(tmpSituation.Accuracy)
+			tmpSituation.NACp = calculateNACpHysteresis(tmpSituation.Accuracy, mySituation.NACp)
 
 			// field 10 = vertical accuracy, m
 			vAcc, err := strconv.ParseFloat(x[10], 32)
@@ -487,21 +1873,23 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			if len(x[2]) < 8 {
 				return false
 			}
-			hr, err1 := strconv.Atoi(x[2][0:2])
-			min, err2 := strconv.Atoi(x[2][2:4])
-			sec, err3 := strconv.ParseFloat(x[2][4:], 32)
-			if err1 != nil || err2 != nil || err3 != nil {
+			hr, min, sec, ok := parseNMEATime(x[2])
+			if !ok {
 				return false
 			}
 
-			tmpSituation.LastFixSinceMidnightUTC = float32(3600*hr+60*min) + float32(sec)
+			tmpSituation.LastFixSinceMidnightUTC = float64(3600*hr+60*min) + sec
+			if isStaleEpoch(x[0], tmpSituation.LastFixSinceMidnightUTC) {
+				return false
+			}
+			updateFixRate(tmpSituation.LastFixSinceMidnightUTC)
 
 			// field 3-4 = lat
 			if len(x[3]) < 10 {
 				return false
 			}
 
-			hr, err1 = strconv.Atoi(x[3][0:2])
+			hr, err1 := strconv.Atoi(x[3][0:2])
 			minf, err2 := strconv.ParseFloat(x[3][2:], 32)
 			if err1 != nil || err2 != nil {
 				return false
@@ -526,6 +1914,9 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			if x[6] == "W" { // West = negative.
 				tmpSituation.Lng = -tmpSituation.Lng
 			}
+			if !isValidLatLng(tmpSituation.Lat, tmpSituation.Lng) {
+				return false
+			}
 
 			// field 7 = height above ellipsoid, m
 
@@ -533,9 +1924,14 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			if err1 != nil {
 				return false
 			}
-			alt := float32(hae*3.28084) - tmpSituation.GeoidSep        // convert to feet and offset by geoid separation
-			tmpSituation.HeightAboveEllipsoid = float32(hae * 3.28084) // feet
-			tmpSituation.Alt = alt
+			altUpdated := useAltitudeFrom("PUBX")
+			if altUpdated {
+				updateGeoidSep(&tmpSituation)
+				alt := float32(hae*3.28084) - tmpSituation.GeoidSep        // convert to feet and offset by geoid separation
+				tmpSituation.HeightAboveEllipsoid = float32(hae * 3.28084) // feet
+				tmpSituation.Alt = alt
+				lastPUBXAltitudeTime = stratuxClock.Time
+			}
 
 			tmpSituation.LastFixLocalTime = stratuxClock.Time
 
@@ -544,23 +1940,15 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			if err != nil {
 				return false
 			}
-			groundspeed = groundspeed * 0.540003 // convert to knots
-			tmpSituation.GroundSpeed = uint16(groundspeed)
+			groundspeed = suppressGPSNoiseAtRest(groundspeed * kmhToKnots) // convert to knots
+			setGroundSpeed(&tmpSituation, groundspeed)
 
 			// field 12 = track, deg
-			trueCourse := float32(0.0)
 			tc, err := strconv.ParseFloat(x[12], 32)
 			if err != nil {
 				return false
 			}
-			if groundspeed > 3 { // TO-DO: use average groundspeed over last n seconds to avoid random "jumps"
-				trueCourse = float32(tc)
-				setTrueCourse(uint16(groundspeed), tc)
-				tmpSituation.TrueCourse = trueCourse
-			} else {
-				// Negligible movement. Don't update course, but do use the slow speed.
-				// TO-DO: use average course over last n seconds?
-			}
+			updateGroundTrack(&tmpSituation, groundspeed, tc)
 			tmpSituation.LastGroundTrackTime = stratuxClock.Time
 
 			// field 13 = vertical velocity, m/s
@@ -568,7 +1956,11 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			if err != nil {
 				return false
 			}
-			tmpSituation.GPSVertVel = float32(vv * -3.28084) // convert to ft/sec and positive = up
+			gpsVertVel := float32(vv * -3.28084) // convert to ft/sec and positive = up
+			if isVertVelPlausible(gpsVertVel*60, "GPS") {
+				tmpSituation.GPSVertVel = float32(gpsVertVelFilter.add(float64(gpsVertVel), filterWindowSamples("vertvel")))
+				lastGPSVertVelTime = stratuxClock.Time
+			} // otherwise keep the last good value
 
 			// field 14 = age of diff corrections
 
@@ -579,8 +1971,13 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			}
 			tmpSituation.Satellites = uint16(sat) // this seems to be reliable. UBX,03 handles >12 satellites solutions correctly.
 
+			checkFrozenFix(&tmpSituation)
+			applyAntennaOffset(&tmpSituation, altUpdated)
+			setUncertaintyRadius(&tmpSituation)
+			nmeaServerSynthesize(&tmpSituation)
+
 			// We've made it this far, so that means we've processed "everything" and can now make the change to mySituation.
-			mySituation = tmpSituation
+			mySituation.GPSSituationData = tmpSituation
 			return true
 		} else if x[1] == "03" { // satellite status message. Only the first 20 satellites will be reported in this message for UBX firmware older than v3.0. Order seems to be GPS, then SBAS, then GLONASS.
 
@@ -594,15 +1991,12 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			if err != nil {
 				return false
 			}
+			lastSBASSolutionReport = stratuxClock.Time // PUBX,03 flags every satellite, including SBAS, as used or not.
 
-			if globalSettings.DEBUG {
-				log.Printf("GPS PUBX,03 message with %d satellites is %d fields long. (Should be %d fields long)\n", satTracked, len(x), satTracked*6+3)
-			}
+			logf(LOG_TRACE, "GPS PUBX,03 message with %d satellites is %d fields long. (Should be %d fields long)\n", satTracked, len(x), satTracked*6+3)
 
 			if len(x) < (satTracked*6 + 3) { // malformed UBX,03 message that somehow passed checksum verification but is missing some of its fields
-				if globalSettings.DEBUG {
-					log.Printf("GPS PUBX,03 message is missing fields\n")
-				}
+				logf(LOG_DEBUG, "GPS PUBX,03 message is missing fields\n")
 				return false
 			}
 
@@ -644,7 +2038,19 @@ func processNMEALine(l string) (sentenceUsed bool) {
 					svType = SAT_TYPE_SBAS
 					svStr = fmt.Sprintf("S%d", sv)
 					sv -= 87 // subtract 87 to convert to NMEA from PRN.
-				} else { // TO-DO: Galileo
+				} else if sv >= 183 && sv <= 192 { // QZSS SLAS (L1S). Augmentation only, like SBAS, so not counted as ranging.
+					svType = SAT_TYPE_SBAS
+					svStr = fmt.Sprintf("S%d", sv)
+				} else if sv >= 193 && sv <= 200 { // QZSS
+					svType = SAT_TYPE_QZSS
+					svStr = fmt.Sprintf("Q%d", sv)
+				} else if sv >= 201 && sv <= 210 { // BeiDou, NMEA 4.0 numbering. 211-235 overlap u-blox Galileo, so are only BeiDou with the GB talker.
+					svType = SAT_TYPE_BEIDOU
+					svStr = fmt.Sprintf("B%d", sv-200) // subtract 200 to convert from NMEA to PRN.
+				} else if sv >= 211 && sv <= 246 { // Galileo, u-blox extended NMEA numbering.
+					svType = SAT_TYPE_GALILEO
+					svStr = fmt.Sprintf("E%d", sv-210) // subtract 210 to convert from NMEA to PRN.
+				} else {
 					svType = SAT_TYPE_UNKNOWN
 					svStr = fmt.Sprintf("U%d", sv)
 				}
@@ -692,17 +2098,20 @@ func processNMEALine(l string) (sentenceUsed bool) {
 				// Field 4+6*i is status: [ U | e | - ]: [U]sed in solution, [e]phemeris data only, [-] not used
 				if x[4+6*i] == "U" {
 					thisSatellite.InSolution = true
+					thisSatellite.HasEphemeris = true
 					thisSatellite.TimeLastSolution = stratuxClock.Time
 				} else if x[4+6*i] == "e" {
 					thisSatellite.InSolution = false
+					thisSatellite.HasEphemeris = true
 					//log.Printf("Satellite %s is no longer in solution but has ephemeris - UBX,03\n", svStr) // DEBUG
 					// do anything that needs to be done for ephemeris
 				} else {
 					thisSatellite.InSolution = false
+					thisSatellite.HasEphemeris = false
 					//log.Printf("Satellite %s is no longer in solution and has no ephemeris - UBX,03\n", svStr) // DEBUG
 				}
 
-				if globalSettings.DEBUG {
+				if logLevelEnabled(LOG_TRACE) {
 					inSolnStr := " "
 					if thisSatellite.InSolution {
 						inSolnStr = "+"
@@ -727,9 +2136,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 				return false
 			}
 			if utcWeek < 1877 || utcWeek >= 32767 { // unless we're in a flying Delorean, UTC dates before 2016-JAN-01 are not valid. Check underflow condition as well.
-				if globalSettings.DEBUG {
-					log.Printf("GPS week # %v out of scope; not setting time and date\n", utcWeek)
-				}
+				logf(LOG_DEBUG, "GPS week # %v out of scope; not setting time and date\n", utcWeek)
 				return false
 			} /* else {
 				log.Printf("GPS week # %v valid; evaluate time and date\n", utcWeek) //debug option
@@ -739,13 +2146,26 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			if len(x[2]) < 7 {
 				return false
 			}
-			hr, err1 := strconv.Atoi(x[2][0:2])
-			min, err2 := strconv.Atoi(x[2][2:4])
-			sec, err3 := strconv.ParseFloat(x[2][4:], 32)
-			if err1 != nil || err2 != nil || err3 != nil {
+			hr, min, sec, ok := parseNMEATime(x[2])
+			if !ok {
 				return false
 			}
 
+			// field 6 is leap seconds (GPS-UTC offset). A "D" suffix means it's the firmware default, not yet
+			//  confirmed from the almanac, so UTC may be off by a second or more.
+			if len(x) > 6 && len(x[6]) > 0 {
+				leapStr := strings.TrimSuffix(x[6], "D")
+				if leap, err := strconv.Atoi(leapStr); err == nil {
+					valid := leapStr == x[6]
+					if valid != globalStatus.GPS_leap_seconds_valid || leap != globalStatus.GPS_leap_seconds {
+						log.Printf("GPS leap seconds: %d (valid: %t)\n", leap, valid)
+					}
+					globalStatus.GPS_leap_seconds = leap
+					globalStatus.GPS_leap_seconds_valid = valid
+					gpsLeapSecondsReported = true
+				}
+			}
+
 			// field 3 is date
 
 			if len(x[3]) == 6 {
@@ -756,57 +2176,73 @@ func processNMEALine(l string) (sentenceUsed bool) {
 					// We only update ANY of the times if all of the time parsing is complete.
 					mySituation.LastGPSTimeTime = stratuxClock.Time
 					mySituation.GPSTime = gpsTime
-					mySituation.LastFixSinceMidnightUTC = float32(3600*hr+60*min) + float32(sec)
+					mySituation.GPSWeek = utcWeek
+					mySituation.GPSLeapSeconds = globalStatus.GPS_leap_seconds
+					mySituation.LastFixSinceMidnightUTC = float64(3600*hr+60*min) + sec
 					// log.Printf("GPS time is: %s\n", gpsTime) //debug
-					if time.Since(gpsTime) > 3*time.Second || time.Since(gpsTime) < -3*time.Second {
-						setStr := gpsTime.Format("20060102 15:04:05.000") + " UTC"
-						log.Printf("setting system time to: '%s'\n", setStr)
-						if err := exec.Command("date", "-s", setStr).Run(); err != nil {
-							log.Printf("Set Date failure: %s error\n", err)
-						} else {
-							log.Printf("Time set from GPS. Current time is %v\n", time.Now())
-						}
-					}
-					setDataLogTimeWithGPS(mySituation)
+					setSystemTimeFromGPS(gpsTime)
+					setDataLogTimeWithGPS(mySituation.GPSSituationData)
 					return true // All possible successes lead here.
 				}
 			}
 		}
 
 		// otherwise parse the NMEA standard messages as a compatibility option for SIRF, generic NMEA, etc.
-	} else if (x[0] == "GNVTG") || (x[0] == "GPVTG") { // Ground track information.
-		tmpSituation := mySituation // If we decide to not use the data in this message, then don't make incomplete changes in mySituation.
-		if len(x) < 9 {             // Reduce from 10 to 9 to allow parsing by devices pre-NMEA v2.3
+	} else if (x[0] == "GNGST") || (x[0] == "GPGST") { // Pseudorange error statistics.
+		tmpSituation := mySituation.GPSSituationData // If we decide to not use the data in this message, then don't make incomplete changes in mySituation.
+		if len(x) < 9 {
+			return false
+		}
+		if tmpSituation.Quality == 0 { // Receivers send GST without a fix, with blank or meaningless deviations.
 			return false
 		}
 
-		groundspeed, err := strconv.ParseFloat(x[5], 32) // Knots.
-		if err != nil {
+		// fields 6-8: 1-sigma standard deviation of latitude, longitude and altitude error, m.
+		latErr, err1 := strconv.ParseFloat(x[6], 32)
+		lonErr, err2 := strconv.ParseFloat(x[7], 32)
+		altErr, err3 := strconv.ParseFloat(x[8], 32)
+		if err1 != nil || err2 != nil || err3 != nil {
 			return false
 		}
-		tmpSituation.GroundSpeed = uint16(groundspeed)
 
-		trueCourse := float32(0)
-		tc, err := strconv.ParseFloat(x[1], 32)
+		// 2DRMS, about 95% confidence, to match the other accuracy sources.
+		tmpSituation.Accuracy = float32(2 * math.Sqrt(latErr*latErr+lonErr*lonErr))
+		tmpSituation.AccuracyVert = float32(2 * altErr)
+		tmpSituation.NACp = calculateNACpHysteresis(tmpSituation.Accuracy, mySituation.NACp)
+		if tmpSituation.FixFrozen {
+			tmpSituation.NACp = 0 // See checkFrozenFix().
+		}
+		setUncertaintyRadius(&tmpSituation)
+		lastGSTTime = stratuxClock.Time
+
+		// We've made it this far, so that means we've processed "everything" and can now make the change to mySituation.
+		mySituation.GPSSituationData = tmpSituation
+		return true
+	} else if (x[0] == "GNVTG") || (x[0] == "GPVTG") { // Ground track information.
+		tmpSituation := mySituation.GPSSituationData // If we decide to not use the data in this message, then don't make incomplete changes in mySituation.
+		if len(x) < 9 {                              // Reduce from 10 to 9 to allow parsing by devices pre-NMEA v2.3
+			return false
+		}
+
+		groundspeed, err := strconv.ParseFloat(x[5], 32) // Knots.
 		if err != nil {
 			return false
 		}
-		if groundspeed > 3 { // TO-DO: use average groundspeed over last n seconds to avoid random "jumps"
-			trueCourse = float32(tc)
-			setTrueCourse(uint16(groundspeed), tc)
-			tmpSituation.TrueCourse = trueCourse
-		} else {
-			// Negligible movement. Don't update course, but do use the slow speed.
-			// TO-DO: use average course over last n seconds?
+		setGroundSpeed(&tmpSituation, groundspeed)
+
+		tc, err := strconv.ParseFloat(x[1], 32)
+		if err != nil {
+			return false
 		}
+		updateGroundTrack(&tmpSituation, groundspeed, tc)
 		tmpSituation.LastGroundTrackTime = stratuxClock.Time
 
 		// We've made it this far, so that means we've processed "everything" and can now make the change to mySituation.
-		mySituation = tmpSituation
+		mySituation.GPSSituationData = tmpSituation
 		return true
 
 	} else if (x[0] == "GNGGA") || (x[0] == "GPGGA") { // Position fix.
-		tmpSituation := mySituation // If we decide to not use the data in this message, then don't make incomplete changes in mySituation.
+		tmpSituation := mySituation.GPSSituationData // If we decide to not use the data in this message, then don't make incomplete changes in mySituation.
 
 		if len(x) < 15 {
 			return false
@@ -818,77 +2254,72 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			return false
 		}
 		tmpSituation.Quality = uint8(q) // 1 = 3D GPS; 2 = DGPS (SBAS /WAAS)
-
-		// Timestamp.
-		if len(x[1]) < 7 {
-			return false
-		}
-		hr, err1 := strconv.Atoi(x[1][0:2])
-		min, err2 := strconv.Atoi(x[1][2:4])
-		sec, err3 := strconv.ParseFloat(x[1][4:], 32)
-		if err1 != nil || err2 != nil || err3 != nil {
+		// No fix. Don't commit the (possibly stale) position or refresh LastFixLocalTime, same as RMC status "V".
+		if q == 0 {
 			return false
 		}
 
-		tmpSituation.LastFixSinceMidnightUTC = float32(3600*hr+60*min) + float32(sec)
-
-		// Latitude.
-		if len(x[2]) < 4 {
+		// Time, position, altitude and geoid separation (Sep = HAE - MSL, needed for proper MSL offset on PUBX,00 altitudes).
+		altUpdated, ok := parseGGAFix(x, &tmpSituation, x[9], x[10], x[11], x[12])
+		if !ok {
 			return false
 		}
 
-		hr, err1 = strconv.Atoi(x[2][0:2])
-		minf, err2 := strconv.ParseFloat(x[2][2:], 32)
-		if err1 != nil || err2 != nil {
-			return false
-		}
+		checkFrozenFix(&tmpSituation)
+		applyAntennaOffset(&tmpSituation, altUpdated)
 
-		tmpSituation.Lat = float32(hr) + float32(minf/60.0)
-		if x[3] == "S" { // South = negative.
-			tmpSituation.Lat = -tmpSituation.Lat
-		}
+		// We've made it this far, so that means we've processed "everything" and can now make the change to mySituation.
+		mySituation.GPSSituationData = tmpSituation
+		return true
 
-		// Longitude.
-		if len(x[4]) < 5 {
-			return false
-		}
-		hr, err1 = strconv.Atoi(x[4][0:3])
-		minf, err2 = strconv.ParseFloat(x[4][3:], 32)
-		if err1 != nil || err2 != nil {
+	} else if (x[0] == "GNGNS") || (x[0] == "GPGNS") { // Position fix, multi-GNSS. Sent by some receivers in place of GGA.
+		tmpSituation := mySituation.GPSSituationData // If we decide to not use the data in this message, then don't make incomplete changes in mySituation.
+
+		//$GNGNS,103600.01,5114.51176,N,00012.29380,W,ANNN,07,1.18,111.5,45.6,,,V*00
+		/*
+		   103600.01    Fix taken at 10:36:00.01 UTC
+		   5114.51176,N Latitude
+		   00012.29380,W Longitude
+		   ANNN         Mode per constellation (GPS, GLONASS, Galileo, BeiDou): see gnsModeQuality()
+		   07           Satellites in use, all constellations
+		   1.18         HDOP
+		   111.5        Altitude MSL, meters
+		   45.6         Geoid separation, meters
+		   (empty)      Age of differential data
+		   (empty)      Differential station ID
+		   V            Navigational status (NMEA 4.1 and higher)
+		*/
+		if len(x) < 13 {
 			return false
 		}
 
-		tmpSituation.Lng = float32(hr) + float32(minf/60.0)
-		if x[5] == "W" { // West = negative.
-			tmpSituation.Lng = -tmpSituation.Lng
+		// Mode indicators. No fix in any constellation is handled as GGA quality 0.
+		tmpSituation.Quality = gnsModeQuality(x[6])
+		if tmpSituation.Quality == 0 {
+			return false
 		}
 
-		// Altitude.
-		alt, err1 := strconv.ParseFloat(x[9], 32)
-		if err1 != nil {
+		// Time, position, and altitude and geoid separation in meters.
+		altUpdated, ok := parseGGAFix(x, &tmpSituation, x[9], "M", x[10], "M")
+		if !ok {
 			return false
 		}
-		tmpSituation.Alt = float32(alt * 3.28084) // Convert to feet.
 
-		// Geoid separation (Sep = HAE - MSL)
-		// (needed for proper MSL offset on PUBX,00 altitudes)
-
-		geoidSep, err1 := strconv.ParseFloat(x[11], 32)
-		if err1 != nil {
-			return false
+		// Satellites in use. GSA, when sent, still refines this (see the GSA handler).
+		if sats, err := strconv.Atoi(x[7]); err == nil {
+			tmpSituation.Satellites = uint16(sats)
 		}
-		tmpSituation.GeoidSep = float32(geoidSep * 3.28084) // Convert to feet.
-		tmpSituation.HeightAboveEllipsoid = tmpSituation.GeoidSep + tmpSituation.Alt
 
-		// Timestamp.
-		tmpSituation.LastFixLocalTime = stratuxClock.Time
+		checkFrozenFix(&tmpSituation)
+		applyAntennaOffset(&tmpSituation, altUpdated)
+		nmeaServerSynthesize(&tmpSituation) // For consumers that only understand GGA.
 
 		// We've made it this far, so that means we've processed "everything" and can now make the change to mySituation.
-		mySituation = tmpSituation
+		mySituation.GPSSituationData = tmpSituation
 		return true
 
 	} else if (x[0] == "GNRMC") || (x[0] == "GPRMC") { // Recommended Minimum data. FIXME: Is this needed anymore?
-		tmpSituation := mySituation // If we decide to not use the data in this message, then don't make incomplete changes in mySituation.
+		tmpSituation := mySituation.GPSSituationData // If we decide to not use the data in this message, then don't make incomplete changes in mySituation.
 
 		//$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A
 		/*						check RY835 man for NMEA version, if >2.2, add mode field
@@ -918,30 +2349,31 @@ func processNMEALine(l string) (sentenceUsed bool) {
 		if len(x[1]) < 7 {
 			return false
 		}
-		hr, err1 := strconv.Atoi(x[1][0:2])
-		min, err2 := strconv.Atoi(x[1][2:4])
-		sec, err3 := strconv.ParseFloat(x[1][4:], 32)
-		if err1 != nil || err2 != nil || err3 != nil {
+		hr, min, sec, ok := parseNMEATime(x[1])
+		if !ok {
 			return false
 		}
-		tmpSituation.LastFixSinceMidnightUTC = float32(3600*hr+60*min) + float32(sec)
+		tmpSituation.LastFixSinceMidnightUTC = float64(3600*hr+60*min) + sec
+		if isStaleEpoch(x[0], tmpSituation.LastFixSinceMidnightUTC) {
+			return false
+		}
+		updateFixRate(tmpSituation.LastFixSinceMidnightUTC)
 
 		if len(x[9]) == 6 {
 			// Date of Fix, i.e 191115 =  19 November 2015 UTC  field 9
 			gpsTimeStr := fmt.Sprintf("%s %02d:%02d:%06.3f", x[9], hr, min, sec)
 			gpsTime, err := time.Parse("020106 15:04:05.000", gpsTimeStr)
-			if err == nil {
+			// RMC has no week number to check like PUBX,04 does. Derive it from the date, so that a receiver
+			//  without a battery backed RTC reporting its default date (often 1980) isn't taken as the time.
+			//  Two digit years are read as 1969-2068.
+			if utcWeek := gpsWeekNumber(gpsTime); err == nil && utcWeek < 1877 {
+				logf(LOG_DEBUG, "GPS date %s (week # %v) out of scope; not setting time and date\n", x[9], utcWeek)
+			} else if err == nil {
 				tmpSituation.LastGPSTimeTime = stratuxClock.Time
 				tmpSituation.GPSTime = gpsTime
-				if time.Since(gpsTime) > 3*time.Second || time.Since(gpsTime) < -3*time.Second {
-					setStr := gpsTime.Format("20060102 15:04:05.000") + " UTC"
-					log.Printf("setting system time to: '%s'\n", setStr)
-					if err := exec.Command("date", "-s", setStr).Run(); err != nil {
-						log.Printf("Set Date failure: %s error\n", err)
-					} else {
-						log.Printf("Time set from GPS. Current time is %v\n", time.Now())
-					}
-				}
+				tmpSituation.GPSWeek = utcWeek
+				tmpSituation.GPSLeapSeconds = globalStatus.GPS_leap_seconds
+				setSystemTimeFromGPS(gpsTime)
 			}
 		}
 
@@ -949,7 +2381,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 		if len(x[3]) < 4 {
 			return false
 		}
-		hr, err1 = strconv.Atoi(x[3][0:2])
+		hr, err1 := strconv.Atoi(x[3][0:2])
 		minf, err2 := strconv.ParseFloat(x[3][2:], 32)
 		if err1 != nil || err2 != nil {
 			return false
@@ -971,6 +2403,9 @@ func processNMEALine(l string) (sentenceUsed bool) {
 		if x[6] == "W" { // West = negative.
 			tmpSituation.Lng = -tmpSituation.Lng
 		}
+		if !isValidLatLng(tmpSituation.Lat, tmpSituation.Lng) {
+			return false
+		}
 
 		tmpSituation.LastFixLocalTime = stratuxClock.Time
 
@@ -979,32 +2414,37 @@ func processNMEALine(l string) (sentenceUsed bool) {
 		if err != nil {
 			return false
 		}
-		tmpSituation.GroundSpeed = uint16(groundspeed)
+		groundspeed = suppressGPSNoiseAtRest(groundspeed)
+		setGroundSpeed(&tmpSituation, groundspeed)
 
 		// ground track "True" (field 8)
-		trueCourse := float32(0)
 		tc, err := strconv.ParseFloat(x[8], 32)
 		if err != nil {
 			return false
 		}
-		if groundspeed > 3 { // TO-DO: use average groundspeed over last n seconds to avoid random "jumps"
-			trueCourse = float32(tc)
-			setTrueCourse(uint16(groundspeed), tc)
-			tmpSituation.TrueCourse = trueCourse
-		} else {
-			// Negligible movement. Don't update course, but do use the slow speed.
-			// TO-DO: use average course over last n seconds?
-		}
+		updateGroundTrack(&tmpSituation, groundspeed, tc)
 
 		tmpSituation.LastGroundTrackTime = stratuxClock.Time
 
+		// magnetic variation (field 10), E/W (field 11). Often left empty by receivers without a magnetic model.
+		if len(x) > 11 {
+			if v, ok := parseMagneticVariation(x[10], x[11]); ok {
+				tmpSituation.MagneticVariation = v
+				tmpSituation.MagneticVariationValid = true
+				updateMagneticCourse(&tmpSituation)
+			}
+		}
+
+		checkFrozenFix(&tmpSituation)
+		applyAntennaOffset(&tmpSituation, false)
+
 		// We've made it this far, so that means we've processed "everything" and can now make the change to mySituation.
-		mySituation = tmpSituation
-		setDataLogTimeWithGPS(mySituation)
+		mySituation.GPSSituationData = tmpSituation
+		setDataLogTimeWithGPS(mySituation.GPSSituationData)
 		return true
 
 	} else if (x[0] == "GNGSA") || (x[0] == "GPGSA") { // Satellite data.
-		tmpSituation := mySituation // If we decide to not use the data in this message, then don't make incomplete changes in mySituation.
+		tmpSituation := mySituation.GPSSituationData // If we decide to not use the data in this message, then don't make incomplete changes in mySituation.
 
 		if len(x) < 18 {
 			return false
@@ -1027,12 +2467,23 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			tmpSituation.Quality = 0 // Just a note.
 			return false
 		}
+		gsaFixMode, _ = strconv.Atoi(x[2])
+
+		// NMEA 4.1 receivers send one GNGSA per constellation each fix, identified by the system ID in field 18.
+		//  Accumulate the satellites from all of them until some other sentence ends the run.
+		if !gsaCycleOpen {
+			gsaCycleSVs = make(map[string]bool)
+			gsaCycleTruncated = false
+			gsaCycleOpen = true
+		}
+		systemID := ""
+		if len(x) > 18 {
+			systemID = x[18]
+		}
 
 		// fields 3-14: satellites in solution
 		var svStr string
 		var svType uint8
-		var svSBAS bool    // used to indicate whether this GSA message contains a SBAS satellite
-		var svGLONASS bool // used to indicate whether this GSA message contains GLONASS satellites
 		sat := 0
 
 		for _, svtxt := range x[3:15] {
@@ -1040,18 +2491,38 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			if err == nil {
 				sat++
 
-				if sv < 33 { // indicates GPS
+				if systemID == "3" { // Galileo. NMEA 4.1 numbers these from 1, so the system ID is needed to tell them from GPS.
+					svType = SAT_TYPE_GALILEO
+					svStr = fmt.Sprintf("E%d", sv)
+				} else if systemID == "4" { // BeiDou. Same numbering issue.
+					svType = SAT_TYPE_BEIDOU
+					svStr = fmt.Sprintf("B%d", sv)
+				} else if systemID == "5" { // QZSS, numbered from 1 by NMEA 4.11. Same IDs as NMEA 4.0 GSV.
+					svType = SAT_TYPE_QZSS
+					sv += 192
+					svStr = fmt.Sprintf("Q%d", sv)
+				} else if sv < 33 { // indicates GPS
 					svType = SAT_TYPE_GPS
 					svStr = fmt.Sprintf("G%d", sv)
 				} else if sv < 65 { // indicates SBAS: WAAS, EGNOS, MSAS, etc.
 					svType = SAT_TYPE_SBAS
 					svStr = fmt.Sprintf("S%d", sv+87) // add 87 to convert from NMEA to PRN.
-					svSBAS = true
 				} else if sv < 97 { // GLONASS
 					svType = SAT_TYPE_GLONASS
 					svStr = fmt.Sprintf("R%d", sv-64) // subtract 64 to convert from NMEA to PRN.
-					svGLONASS = true
-				} else { // TO-DO: Galileo
+				} else if sv >= 183 && sv <= 192 { // QZSS SLAS (L1S). Augmentation only, like SBAS, so not counted as ranging.
+					svType = SAT_TYPE_SBAS
+					svStr = fmt.Sprintf("S%d", sv)
+				} else if sv >= 193 && sv <= 200 { // QZSS
+					svType = SAT_TYPE_QZSS
+					svStr = fmt.Sprintf("Q%d", sv)
+				} else if sv >= 201 && sv <= 210 { // BeiDou, NMEA 4.0 numbering. 211-235 overlap u-blox Galileo, so are only BeiDou with the GB talker.
+					svType = SAT_TYPE_BEIDOU
+					svStr = fmt.Sprintf("B%d", sv-200) // subtract 200 to convert from NMEA to PRN.
+				} else if sv >= 211 && sv <= 246 { // Galileo, u-blox extended NMEA numbering.
+					svType = SAT_TYPE_GALILEO
+					svStr = fmt.Sprintf("E%d", sv-210) // subtract 210 to convert from NMEA to PRN.
+				} else {
 					svType = SAT_TYPE_UNKNOWN
 					svStr = fmt.Sprintf("U%d", sv)
 				}
@@ -1071,7 +2542,11 @@ func processNMEALine(l string) (sentenceUsed bool) {
 					thisSatellite.Type = uint8(svType)
 					//log.Printf("Creating new satellite %s from GSA message\n", svStr) // DEBUG
 				}
+				if svType == SAT_TYPE_SBAS {
+					lastSBASSolutionReport = stratuxClock.Time
+				}
 				thisSatellite.InSolution = true
+				thisSatellite.HasEphemeris = true
 				thisSatellite.TimeLastSolution = stratuxClock.Time
 				thisSatellite.TimeLastSeen = stratuxClock.Time    // implied, since this satellite is used in the position solution
 				thisSatellite.TimeLastTracked = stratuxClock.Time // implied, since this satellite is used in the position solution
@@ -1081,30 +2556,61 @@ func processNMEALine(l string) (sentenceUsed bool) {
 				satelliteMutex.Unlock()
 				// END OF PROTECTED BLOCK
 
+				gsaCycleSVs[svStr] = true
 			}
 		}
-		if sat < 12 || tmpSituation.Satellites < 13 { // GSA only reports up to 12 satellites in solution, so we don't want to overwrite higher counts based on updateConstellation().
-			tmpSituation.Satellites = uint16(sat)
+		if sat == 12 {
+			gsaCycleTruncated = true
+		}
+
+		// Unique satellites in solution across all GSA sentences of this fix.
+		var svSBAS bool    // used to indicate whether this fix contains a SBAS satellite
+		var svGLONASS bool // used to indicate whether this fix contains GLONASS satellites
+		for svID := range gsaCycleSVs {
+			svSBAS = svSBAS || svID[0] == 'S'
+			svGLONASS = svGLONASS || svID[0] == 'R'
+		}
+		total := uint16(len(gsaCycleSVs))
+		if !gsaCycleTruncated || tmpSituation.Satellites <= total { // GSA only reports up to 12 satellites in solution, so we don't want to overwrite higher counts based on updateConstellation().
+			tmpSituation.Satellites = total
 			if (tmpSituation.Quality == 2) && !svSBAS && !svGLONASS { // add one to the satellite count if we have a SBAS solution, but the GSA message doesn't track a SBAS satellite
 				tmpSituation.Satellites++
 			}
 		}
 		//log.Printf("There are %d satellites in solution from this GSA message\n", sat) // TESTING - DEBUG
 
+		// field 15: PDOP. Empty without a fix.
+		tmpSituation.PDOP = 0
+		if pdop, err := strconv.ParseFloat(x[15], 32); err == nil {
+			tmpSituation.PDOP = float32(pdop)
+		}
+
 		// field 16: HDOP
 		// Accuracy estimate
 		hdop, err1 := strconv.ParseFloat(x[16], 32)
 		if err1 != nil {
 			return false
 		}
+		tmpSituation.HDOP = float32(hdop)
+		satelliteMutex.Lock()
+		tmpSituation.AccuracyWeight, tmpSituation.SolutionMix = constellationAccuracyWeight()
+		satelliteMutex.Unlock()
+		if isGSTRecent() { // GST has the receiver's own error estimate. Keep it, rather than the HDOP rule of thumb.
+			mySituation.GPSSituationData = tmpSituation
+			return true
+		}
 		if tmpSituation.Quality == 2 {
 			tmpSituation.Accuracy = float32(hdop * 4.0) // Rough 95% confidence estimate for WAAS / DGPS solution
 		} else {
 			tmpSituation.Accuracy = float32(hdop * 8.0) // Rough 95% confidence estimate for 3D non-WAAS solution
 		}
+		tmpSituation.Accuracy *= tmpSituation.AccuracyWeight
 
 		// NACp estimate.
-		tmpSituation.NACp = calculateNACp(tmpSituation.Accuracy)
+		tmpSituation.NACp = calculateNACpHysteresis(tmpSituation.Accuracy, mySituation.NACp)
+		if tmpSituation.FixFrozen {
+			tmpSituation.NACp = 0 // See checkFrozenFix().
+		}
 
 		// field 17: VDOP
 		// accuracy estimate
@@ -1113,20 +2619,21 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			return false
 		}
 		tmpSituation.AccuracyVert = float32(vdop * 5) // rough estimate for 95% confidence
+		setUncertaintyRadius(&tmpSituation)
 
 		// We've made it this far, so that means we've processed "everything" and can now make the change to mySituation.
-		mySituation = tmpSituation
+		mySituation.GPSSituationData = tmpSituation
 		return true
 
 	}
 
-	if (x[0] == "GPGSV") || (x[0] == "GLGSV") { // GPS + SBAS or GLONASS satellites in view message. Galileo is TBD.
+	if (x[0] == "GPGSV") || (x[0] == "GLGSV") || (x[0] == "GAGSV") || (x[0] == "GBGSV") || (x[0] == "GQGSV") { // GPS + SBAS, GLONASS, Galileo, BeiDou or QZSS satellites in view message.
 		if len(x) < 4 {
 			return false
 		}
 
 		// field 1 = number of GSV messages of this type
-		msgNum, err := strconv.Atoi(x[2])
+		msgNum, err := strconv.Atoi(x[1])
 		if err != nil {
 			return false
 		}
@@ -1138,6 +2645,27 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			return false
 		}
 
+		// NMEA 4.10 and later add a signal ID after the satellite blocks, and send a separate group per signal
+		//  (e.g. L1 C/A and L2 CL), each listing the same satellites. Older firmware leaves it out.
+		lenGSV := len(x)
+		signalID := ""
+		if (lenGSV-4)%4 == 1 {
+			signalID = x[lenGSV-1]
+		}
+		groupKey := x[0] + "," + signalID
+
+		// A group must arrive in order. Start over on its first message, and drop it if one goes missing.
+		if msgIndex == 1 {
+			delete(gsvGroupSats, groupKey)
+			gsvGroupNext[groupKey] = 1
+		}
+		if msgIndex != gsvGroupNext[groupKey] || msgIndex > msgNum {
+			delete(gsvGroupSats, groupKey)
+			delete(gsvGroupNext, groupKey)
+			return false
+		}
+		gsvGroupNext[groupKey] = msgIndex + 1
+
 		// field 3 = number of GPS satellites tracked
 		/* Is this redundant if parsing from full constellation?
 		satTracked, err := strconv.Atoi(x[3])
@@ -1150,12 +2678,9 @@ func processNMEALine(l string) (sentenceUsed bool) {
 
 		// field 4-7 = repeating block with satellite id, elevation, azimuth, and signal strengh (Cno)
 
-		lenGSV := len(x)
 		satsThisMsg := (lenGSV - 4) / 4
 
-		if globalSettings.DEBUG {
-			log.Printf("%s message [%d of %d] is %v fields long and describes %v satellites\n", x[0], msgIndex, msgNum, lenGSV, satsThisMsg)
-		}
+		logf(LOG_TRACE, "%s message [%d of %d] is %v fields long and describes %v satellites (signal '%s')\n", x[0], msgIndex, msgNum, lenGSV, satsThisMsg, signalID)
 
 		var sv, elev, az, cno int
 		var svType uint8
@@ -1167,7 +2692,23 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			if err != nil {
 				return false
 			}
-			if sv < 33 { // indicates GPS
+			if x[0] == "GAGSV" && sv <= 36 { // Galileo, NMEA 4.1 numbering (PRN).
+				svType = SAT_TYPE_GALILEO
+				svStr = fmt.Sprintf("E%d", sv)
+			} else if x[0] == "GQGSV" && sv <= 10 { // QZSS, NMEA 4.11 numbering. Same IDs as NMEA 4.0 GSV.
+				svType = SAT_TYPE_QZSS
+				sv += 192
+				svStr = fmt.Sprintf("Q%d", sv)
+			} else if x[0] == "GQGSV" && sv >= 193 && sv <= 202 { // QZSS, NMEA 4.0 numbering.
+				svType = SAT_TYPE_QZSS
+				svStr = fmt.Sprintf("Q%d", sv)
+			} else if x[0] == "GBGSV" && sv <= 63 { // BeiDou, NMEA 4.1 numbering (PRN).
+				svType = SAT_TYPE_BEIDOU
+				svStr = fmt.Sprintf("B%d", sv)
+			} else if x[0] == "GBGSV" && sv >= 201 && sv <= 263 { // BeiDou, NMEA 4.0 numbering.
+				svType = SAT_TYPE_BEIDOU
+				svStr = fmt.Sprintf("B%d", sv-200) // subtract 200 to convert from NMEA to PRN.
+			} else if sv < 33 { // indicates GPS
 				svType = SAT_TYPE_GPS
 				svStr = fmt.Sprintf("G%d", sv)
 			} else if sv < 65 { // indicates SBAS: WAAS, EGNOS, MSAS, etc.
@@ -1176,45 +2717,70 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			} else if sv < 97 { // GLONASS
 				svType = SAT_TYPE_GLONASS
 				svStr = fmt.Sprintf("R%d", sv-64) // subtract 64 to convert from NMEA to PRN.
-			} else { // TO-DO: Galileo
+			} else if sv >= 183 && sv <= 192 { // QZSS SLAS (L1S). Augmentation only, like SBAS, so not counted as ranging.
+				svType = SAT_TYPE_SBAS
+				svStr = fmt.Sprintf("S%d", sv)
+			} else if sv >= 193 && sv <= 200 { // QZSS
+				svType = SAT_TYPE_QZSS
+				svStr = fmt.Sprintf("Q%d", sv)
+			} else if sv >= 201 && sv <= 210 { // BeiDou, NMEA 4.0 numbering. 211-235 overlap u-blox Galileo, so are only BeiDou with the GB talker.
+				svType = SAT_TYPE_BEIDOU
+				svStr = fmt.Sprintf("B%d", sv-200) // subtract 200 to convert from NMEA to PRN.
+			} else if sv >= 211 && sv <= 246 { // Galileo, u-blox extended NMEA numbering.
+				svType = SAT_TYPE_GALILEO
+				svStr = fmt.Sprintf("E%d", sv-210) // subtract 210 to convert from NMEA to PRN.
+			} else {
 				svType = SAT_TYPE_UNKNOWN
 				svStr = fmt.Sprintf("U%d", sv)
 			}
 
-			var thisSatellite SatelliteInfo
+			// field 5-7: elevation, azimuth, signal. Some firmwares leave elevation and azimuth blank if there's no
+			//  position fix, and signal is blank if the satellite isn't being received.
+			elev, err = strconv.Atoi(x[5+4*i])
+			if err != nil { // Represent as -999.
+				elev = -999
+			}
+			az, err = strconv.Atoi(x[6+4*i])
+			if err != nil { // UBX allows tracking up to 5(?) degrees below horizon. Represent invalid as -999.
+				az = -999
+			}
+			cno, err = strconv.Atoi(x[7+4*i])
+			if err != nil { // Represent as -99.
+				cno = -99
+			}
+			gsvGroupSats[groupKey] = append(gsvGroupSats[groupKey], gsvSatellite{svStr, sv, svType, elev, az, cno})
+		}
 
-			// START OF PROTECTED BLOCK
-			satelliteMutex.Lock()
+		// Only update 'Satellites' once the group is complete, so the whole sky view changes at once.
+		if msgIndex < msgNum {
+			return true
+		}
+		group := gsvGroupSats[groupKey]
+		delete(gsvGroupSats, groupKey)
+
+		// START OF PROTECTED BLOCK
+		satelliteMutex.Lock()
+		for i, gs := range group {
+			var thisSatellite SatelliteInfo
 
 			// Retrieve previous information on this satellite code.
-			if val, ok := Satellites[svStr]; ok { // if we've already seen this satellite identifier, copy it in to do updates
+			if val, ok := Satellites[gs.svStr]; ok { // if we've already seen this satellite identifier, copy it in to do updates
 				thisSatellite = val
-				//log.Printf("Satellite %s already seen. Retrieving from 'Satellites'.\n", svStr) // DEBUG
+				//log.Printf("Satellite %s already seen. Retrieving from 'Satellites'.\n", gs.svStr) // DEBUG
 			} else { // this satellite isn't in the Satellites data structure, so create it new
-				thisSatellite.SatelliteID = svStr
-				thisSatellite.SatelliteNMEA = uint8(sv)
-				thisSatellite.Type = uint8(svType)
-				//log.Printf("Creating new satellite %s\n", svStr) // DEBUG
+				thisSatellite.SatelliteID = gs.svStr
+				thisSatellite.SatelliteNMEA = uint8(gs.sv)
+				thisSatellite.Type = uint8(gs.svType)
+				//log.Printf("Creating new satellite %s\n", gs.svStr) // DEBUG
 			}
 			thisSatellite.TimeLastTracked = stratuxClock.Time
+			thisSatellite.Elevation = int16(gs.elev)
+			thisSatellite.Azimuth = int16(gs.az)
 
-			elev, err = strconv.Atoi(x[5+4*i]) // elevation
-			if err != nil {                    // some firmwares leave this blank if there's no position fix. Represent as -999.
-				elev = -999
-			}
-			thisSatellite.Elevation = int16(elev)
-
-			az, err = strconv.Atoi(x[6+4*i]) // azimuth
-			if err != nil {                  // UBX allows tracking up to 5(?) degrees below horizon. Some firmwares leave this blank if no position fix. Represent invalid as -999.
-				az = -999
-			}
-			thisSatellite.Azimuth = int16(az)
-
-			cno, err = strconv.Atoi(x[7+4*i]) // signal
-			if err != nil {                   // will be blank if satellite isn't being received. Represent as -99.
-				cno = -99
+			cno := bestGSVSignal(gs.svStr, signalID, gs.cno)
+			if cno == -99 { // will be blank if satellite isn't being received.
 				thisSatellite.InSolution = false // resets the "InSolution" status if the satellite disappears out of solution due to no signal. FIXME
-				//log.Printf("Satellite %s is no longer in solution due to cno parse error - GSV\n", svStr) // DEBUG
+				//log.Printf("Satellite %s is no longer in solution due to cno parse error - GSV\n", gs.svStr) // DEBUG
 			} else if cno > 0 {
 				thisSatellite.TimeLastSeen = stratuxClock.Time // Is this needed?
 			}
@@ -1225,31 +2791,32 @@ func processNMEALine(l string) (sentenceUsed bool) {
 
 			// hack workaround for GSA 12-sv limitation... if this is a SBAS satellite, we have a SBAS solution, and signal is greater than some arbitrary threshold, set InSolution
 			// drawback is this will show all tracked SBAS satellites as being in solution.
-			if thisSatellite.Type == SAT_TYPE_SBAS {
+			// Only used as a last resort, when neither PUBX,03 nor GSA has reported SBAS satellites in solution recently.
+			if thisSatellite.Type == SAT_TYPE_SBAS && stratuxClock.Since(lastSBASSolutionReport) > 10*time.Second {
 				if mySituation.Quality == 2 {
-					if thisSatellite.Signal > 16 {
+					if thisSatellite.Signal > int8(globalSettings.GPS_SBASMinSignal) && thisSatellite.Elevation >= int16(globalSettings.GPS_SBASMinElevation) {
 						thisSatellite.InSolution = true
 						thisSatellite.TimeLastSolution = stratuxClock.Time
 					}
 				} else { // quality == 0 or 1
 					thisSatellite.InSolution = false
-					//log.Printf("WAAS satellite %s is marked as out of solution GSV\n", svStr) // DEBUG
+					//log.Printf("WAAS satellite %s is marked as out of solution GSV\n", gs.svStr) // DEBUG
 				}
 			}
 
-			if globalSettings.DEBUG {
+			if logLevelEnabled(LOG_TRACE) {
 				inSolnStr := " "
 				if thisSatellite.InSolution {
 					inSolnStr = "+"
 				}
-				log.Printf("GSV: Satellite %s%s at index %d. Type = %d, NMEA-ID = %d, Elev = %d, Azimuth = %d, Cno = %d\n", inSolnStr, svStr, i, svType, sv, elev, az, cno) // remove later?
+				log.Printf("GSV: Satellite %s%s at index %d. Type = %d, NMEA-ID = %d, Elev = %d, Azimuth = %d, Cno = %d\n", inSolnStr, gs.svStr, i, gs.svType, gs.sv, gs.elev, gs.az, cno) // remove later?
 			}
 
 			Satellites[thisSatellite.SatelliteID] = thisSatellite // Update constellation with this satellite
-			updateConstellation()
-			satelliteMutex.Unlock()
-			// END OF PROTECTED BLOCK
 		}
+		updateConstellation()
+		satelliteMutex.Unlock()
+		// END OF PROTECTED BLOCK
 
 		return true
 	}
@@ -1258,47 +2825,485 @@ func processNMEALine(l string) (sentenceUsed bool) {
 	return false
 }
 
-func gpsSerialReader() {
-	defer serialPort.Close()
-	readyToInitGPS = false // TO-DO: replace with channel control to terminate goroutine when complete
+const (
+	maxNMEASentenceLen = 4096 // PUBX,03 with a full multi-GNSS constellation is well under this.
+	maxUBXPayloadLen   = 4096
+)
+
+/*
+	scanGPSFrames().
+		bufio.SplitFunc for the receiver's mixed NMEA/UBX stream. Returns one complete NMEA sentence
+		 (without the line ending) or one complete, checksum-verified UBX frame (including the header)
+		 per token. Partial sentences and frames are left in the scanner's buffer until the rest arrives,
+		 so reads that split a message at any byte boundary are reassembled. Bytes between messages,
+		 truncated sentences and UBX frames with a bad checksum are skipped.
+*/
+
+func scanGPSFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for i := 0; i < len(data); i++ {
+		if data[i] == '$' {
+			for j := i + 1; j < len(data); j++ {
+				switch data[j] {
+				case '\n':
+					end := j
+					if end > i && data[end-1] == '\r' {
+						end--
+					}
+					return j + 1, data[i:end], nil
+				case '$', 0xB5: // Start of the next message before the end of this one. Drop the truncated sentence.
+					return j, nil, nil
+				}
+			}
+			if atEOF || len(data)-i > maxNMEASentenceLen {
+				return len(data), nil, nil
+			}
+			return i, nil, nil // Wait for the rest of the sentence.
+		}
+
+		if data[i] == 0xB5 {
+			if len(data)-i < 6 { // Need the sync chars, class, ID and length to go any further.
+				if atEOF {
+					return len(data), nil, nil
+				}
+				return i, nil, nil
+			}
+			if data[i+1] != 0x62 {
+				continue
+			}
+			payloadLen := int(data[i+4]) | int(data[i+5])<<8
+			if payloadLen > maxUBXPayloadLen { // Not really a frame.
+				continue
+			}
+			frameLen := 6 + payloadLen + 2
+			if len(data)-i < frameLen {
+				if atEOF {
+					return len(data), nil, nil
+				}
+				return i, nil, nil // Wait for the rest of the frame.
+			}
+			chk := chksumUBX(data[i+2 : i+6+payloadLen])
+			if chk[0] != data[i+frameLen-2] || chk[1] != data[i+frameLen-1] {
+				continue
+			}
+			return i + frameLen, data[i : i+frameLen], nil
+		}
+	}
+	// Nothing that looks like the start of a message. Discard it all.
+	return len(data), nil, nil
+}
+
+var gpsLeapSecondsReported bool // Receiver reports its leap second status (PUBX,04), so UTC can be checked before use.
+
+var gpsWeekZero = time.Date(1980, time.January, 6, 0, 0, 0, 0, time.UTC) // Start of GPS week 0.
+
+// gpsWeekNumber returns the GPS week (no rollover at 1024) that UTC time t falls in.
+func gpsWeekNumber(t time.Time) int {
+	return int(t.Sub(gpsWeekZero).Hours() / (7 * 24))
+}
+
+var lastSystemTimeSet time.Time // stratuxClock time the system clock was last set from GPS.
+
+// setSystemTimeFromGPS sets the system clock if it's more than GPS_ClockSetThreshold seconds off from the GPS time,
+// at most once every GPS_ClockSetInterval seconds. If the receiver reports its leap second status, UTC from a
+// receiver that hasn't confirmed the leap second count isn't used.
+func setSystemTimeFromGPS(gpsTime time.Time) {
+	if !globalSettings.GPS_Set_System_Time { // Clock managed by something else (NTP, RTC). GPSTime is still kept.
+		return
+	}
+	if gpsLeapSecondsReported && !globalStatus.GPS_leap_seconds_valid {
+		return
+	}
+	// stratuxClock is monotonic, so this isn't upset by the clock change itself.
+	if !lastSystemTimeSet.IsZero() && stratuxClock.Since(lastSystemTimeSet) < time.Duration(globalSettings.GPS_ClockSetInterval)*time.Second {
+		return
+	}
+	threshold := time.Duration(globalSettings.GPS_ClockSetThreshold * float64(time.Second))
+	if time.Since(gpsTime) > threshold || time.Since(gpsTime) < -threshold {
+		setStr := gpsTime.Format("20060102 15:04:05.000") + " UTC"
+		log.Printf("setting system time to: '%s'\n", setStr)
+		lastSystemTimeSet = stratuxClock.Time
+		if err := exec.Command("date", "-s", setStr).Run(); err != nil {
+			log.Printf("Set Date failure: %s error\n", err)
+		} else {
+			log.Printf("Time set from GPS. Current time is %v\n", time.Now())
+		}
+	}
+}
+
+// processUBXFrame handles a complete UBX frame from scanGPSFrames(): NAV-PVT solutions, MON-HW status and CFG acknowledgements.
+func processUBXFrame(frame []byte) {
+	if frame[2] == 0x01 && frame[3] == 0x07 { // NAV-PVT.
+		processUBXNAVPVT(frame[6 : len(frame)-2])
+		return
+	}
+	if frame[2] == 0x0A && frame[3] == 0x09 { // MON-HW.
+		processUBXMONHW(frame[6 : len(frame)-2])
+		return
+	}
+	if frame[2] != 0x05 || len(frame) < 10 { // ACK class.
+		return
+	}
+	select { // Wake up anything waiting for this ACK. See waitUBXAck().
+	case ubxAckChan <- [3]byte{frame[3], frame[6], frame[7]}:
+	default:
+	}
+	if frame[3] == 0x00 { // ACK-NAK.
+		log.Printf("GPS rejected configuration message class 0x%02X, ID 0x%02X\n", frame[6], frame[7])
+	} else {
+		logf(LOG_DEBUG, "GPS acknowledged configuration message class 0x%02X, ID 0x%02X\n", frame[6], frame[7])
+	}
+}
+
+/*
+	processUBXNAVPVT().
+		Position, velocity and time from a UBX-NAV-PVT payload. Takes the place of PUBX,00 on u-blox receivers
+		 when ubxUseNavPVT(), at full resolution: position in 1e-7 deg, heights in mm and
+		 speeds in mm/s, where PUBX,00 has whole km/h. The altitude counts as "PUBX" for useAltitudeFrom().
+*/
+
+func processUBXNAVPVT(p []byte) bool {
+	if len(p) < 92 {
+		return false
+	}
+	mySituation.mu_GPS.Lock()
+	defer mySituation.mu_GPS.Unlock()
+	if globalSettings.DemoMode {
+		return false
+	}
+
+	tmpSituation := mySituation.GPSSituationData // If we decide to not use the data in this message, then don't make incomplete changes in mySituation.
+
+	fixType := p[20]
+	flags := p[21]
+	if flags&0x01 == 0 { // gnssFixOK.
+		return false
+	}
+	switch fixType {
+	case 2, 3: // 2D, 3D.
+		tmpSituation.Quality = 1
+		if flags&0x02 != 0 { // diffSoln.
+			tmpSituation.Quality = 2
+		}
+	case 1, 4: // Dead reckoning only, GNSS + dead reckoning.
+		tmpSituation.Quality = 6
+	default: // No fix, time only.
+		return false
+	}
+
+	hAcc := float64(binary.LittleEndian.Uint32(p[40:])) / 1000 // m, 1-sigma.
+	vAcc := float64(binary.LittleEndian.Uint32(p[44:])) / 1000 // m, 1-sigma.
+	tmpSituation.Accuracy = float32(hAcc * 2)                  // NACp is 95% confidence (2-sigma)
+	tmpSituation.NACp = calculateNACpHysteresis(tmpSituation.Accuracy, mySituation.NACp)
+	tmpSituation.AccuracyVert = float32(vAcc * 2)
+
+	nano := float64(int32(binary.LittleEndian.Uint32(p[16:])))
+	tmpSituation.LastFixSinceMidnightUTC = float64(3600*int(p[8])+60*int(p[9])+int(p[10])) + nano/1e9
+	if isStaleEpoch("NAV-PVT", tmpSituation.LastFixSinceMidnightUTC) {
+		return false
+	}
+	updateFixRate(tmpSituation.LastFixSinceMidnightUTC)
+
+	tmpSituation.Lng = float32(float64(int32(binary.LittleEndian.Uint32(p[24:]))) / 1e7)
+	tmpSituation.Lat = float32(float64(int32(binary.LittleEndian.Uint32(p[28:]))) / 1e7)
+	if !isValidLatLng(tmpSituation.Lat, tmpSituation.Lng) {
+		return false
+	}
+
+	hae := float64(int32(binary.LittleEndian.Uint32(p[32:]))) / 1000 // m
+	msl := float64(int32(binary.LittleEndian.Uint32(p[36:]))) / 1000 // m
+	altUpdated := useAltitudeFrom("PUBX")
+	if altUpdated {
+		tmpSituation.HeightAboveEllipsoid = float32(hae * 3.28084) // feet
+		tmpSituation.GeoidSep = float32((hae - msl) * 3.28084)
+		lastGeoidSepTime = stratuxClock.Time
+		tmpSituation.Alt = float32(msl * 3.28084)
+		lastPUBXAltitudeTime = stratuxClock.Time
+	}
+
+	tmpSituation.LastFixLocalTime = stratuxClock.Time
+
+	gSpeed := float64(int32(binary.LittleEndian.Uint32(p[60:]))) / 1000 // m/s
+	groundspeed := suppressGPSNoiseAtRest(gSpeed * 1.94384)             // convert to knots
+	setGroundSpeed(&tmpSituation, groundspeed)
+
+	tc := float64(int32(binary.LittleEndian.Uint32(p[64:]))) / 1e5 // Heading of motion, deg.
+	updateGroundTrack(&tmpSituation, groundspeed, tc)
+	tmpSituation.LastGroundTrackTime = stratuxClock.Time
+
+	velD := float64(int32(binary.LittleEndian.Uint32(p[56:]))) / 1000 // m/s, down.
+	gpsVertVel := float32(velD * -3.28084)                            // convert to ft/sec and positive = up
+	if isVertVelPlausible(gpsVertVel*60, "GPS") {
+		tmpSituation.GPSVertVel = float32(gpsVertVelFilter.add(float64(gpsVertVel), filterWindowSamples("vertvel")))
+		lastGPSVertVelTime = stratuxClock.Time
+	} // otherwise keep the last good value
+
+	sAcc := float64(binary.LittleEndian.Uint32(p[68:])) / 1000 // m/s, 1-sigma.
+	tmpSituation.VelocityAccuracy = float32(sAcc * 2)          // 95% confidence, like Accuracy.
+	tmpSituation.NACv = calculateNACv(tmpSituation.VelocityAccuracy)
+
+	tmpSituation.Satellites = uint16(p[23]) // numSV.
+
+	checkFrozenFix(&tmpSituation)
+	applyAntennaOffset(&tmpSituation, altUpdated)
+	setUncertaintyRadius(&tmpSituation)
+
+	if p[11]&0x03 == 0x03 { // validDate, validTime.
+		tmpSituation.GPSTime = time.Date(int(binary.LittleEndian.Uint16(p[4:])), time.Month(p[6]), int(p[7]), int(p[8]), int(p[9]), int(p[10]), int(nano), time.UTC)
+		tmpSituation.LastGPSTimeTime = stratuxClock.Time
+		tmpSituation.GPSWeek = gpsWeekNumber(tmpSituation.GPSTime)
+		tmpSituation.GPSLeapSeconds = globalStatus.GPS_leap_seconds
+	}
+	nmeaServerSynthesize(&tmpSituation)
+
+	mySituation.GPSSituationData = tmpSituation
+	logSituation()
+	return true
+}
+
+const (
+	ubxMonitorInterval = 10 * time.Second // How often MON-HW is polled.
+	ubxJamIndWarning   = 100              // MON-HW jamInd (0-255) at and above which CW jamming is reported.
+)
+
+var ubxAntennaStatusNames = []string{"INIT", "DONTKNOW", "OK", "SHORT", "OPEN"}
+var ubxJammingStateNames = []string{"unknown", "OK", "warning", "critical"}
+
+// ubxHardwareMonitor polls UBX-MON-HW from a connected u-blox receiver. The answer is handled by processUBXMONHW().
+func ubxHardwareMonitor() {
+	ticker := time.NewTicker(ubxMonitorInterval)
+	for {
+		<-ticker.C
+		if ubxReceiverConnected() {
+			writeUBX(0x0A, 0x09, nil)
+		}
+	}
+}
+
+/*
+	processUBXMONHW().
+		Antenna supervisor status and jamming indicators from a UBX-MON-HW payload, to globalStatus. Logs a
+		 warning when the antenna goes open or short circuit, or when jamming is detected, and when it clears.
+		 Antenna status is only meaningful with an active antenna supervisor; otherwise it reads DONTKNOW.
+*/
+
+func processUBXMONHW(p []byte) {
+	if len(p) < 60 {
+		return
+	}
+	antenna := "unknown"
+	if int(p[20]) < len(ubxAntennaStatusNames) {
+		antenna = ubxAntennaStatusNames[p[20]]
+	}
+	jammingState := ubxJammingStateNames[(p[22]>>2)&0x03]
+	jamInd := int(p[45])
+
+	antennaFault := func(a string) bool { return a == "SHORT" || a == "OPEN" }
+	if antenna != globalStatus.GPS_antenna_status && (antennaFault(antenna) || antennaFault(globalStatus.GPS_antenna_status)) {
+		logf(LOG_WARN, "GPS antenna status %s (was %s).\n", antenna, globalStatus.GPS_antenna_status)
+	}
+	jammed := jamInd >= ubxJamIndWarning || jammingState == "warning" || jammingState == "critical"
+	wasJammed := globalStatus.GPS_jamming_level >= ubxJamIndWarning || globalStatus.GPS_jamming_state == "warning" || globalStatus.GPS_jamming_state == "critical"
+	if jammed != wasJammed {
+		if jammed {
+			logf(LOG_WARN, "GPS jamming detected: indicator %d/255, state %s.\n", jamInd, jammingState)
+		} else {
+			logf(LOG_WARN, "GPS jamming cleared: indicator %d/255, state %s.\n", jamInd, jammingState)
+		}
+	}
+	globalStatus.GPS_antenna_status = antenna
+	globalStatus.GPS_jamming_level = jamInd
+	globalStatus.GPS_jamming_state = jammingState
+}
+
+// gpsQuitReader ends the stream (io.EOF) once quit is closed. The port's ReadTimeout bounds how long that takes.
+type gpsQuitReader struct {
+	r    io.Reader
+	quit <-chan struct{}
+}
+
+func (q gpsQuitReader) Read(p []byte) (int, error) {
+	select {
+	case <-q.quit:
+		return 0, io.EOF
+	default:
+		return q.r.Read(p)
+	}
+}
+
+/*
+	gpsSerialReader().
+		Reads and processes everything from 'port' until it fails, the GPS is disconnected or disabled, or
+		 'quit' is closed. Closes the port, then 'done', on exit. Started and stopped by pollGPS() through
+		 startGPSSerialReader() and stopGPSSerialReader(), so only one reader ever owns the port.
+*/
+
+func gpsSerialReader(port io.ReadCloser, quit <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	defer port.Close()
 
 	i := 0 //debug monitor
-	scanner := bufio.NewScanner(serialPort)
+	scanner := bufio.NewScanner(io.TeeReader(gpsQuitReader{port, quit}, gpsActivityWriter{}))
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := scanGPSFrames(data, atEOF)
+		logGPSRaw(data[:advance]) // Everything consumed, skipped bytes included, so the log stays verbatim.
+		return advance, token, err
+	})
 	for scanner.Scan() && globalStatus.GPS_connected && globalSettings.GPS_Enabled {
 		i++
-		if globalSettings.DEBUG && i%100 == 0 {
-			log.Printf("gpsSerialReader() scanner loop iteration i=%d\n", i) // debug monitor
+		if i%100 == 0 {
+			logf(LOG_TRACE, "gpsSerialReader() scanner loop iteration i=%d\n", i) // debug monitor
 		}
 
+		if frame := scanner.Bytes(); frame[0] == 0xB5 {
+			processUBXFrame(frame)
+			continue
+		}
 		s := scanner.Text()
+		logSynthesizedGSV() // All of the stream up to the end of this sentence has been logged.
 
 		if !processNMEALine(s) {
-			if globalSettings.DEBUG {
-				fmt.Printf("processNMEALine() exited early -- %s\n", s)
-			}
+			logf(LOG_TRACE, "processNMEALine() exited early -- %s\n", s)
 		}
 	}
 	if err := scanner.Err(); err != nil {
 		log.Printf("reading standard input: %s\n", err.Error())
 	}
 
-	if globalSettings.DEBUG {
-		log.Printf("Exiting gpsSerialReader() after i=%d loops\n", i) // debug monitor
-	}
+	logf(LOG_INFO, "Exiting gpsSerialReader() after i=%d loops\n", i) // debug monitor
 	globalStatus.GPS_connected = false
-	readyToInitGPS = true // TO-DO: replace with channel control to terminate goroutine when complete
 	return
 }
 
+// startGPSSerialReader starts a gpsSerialReader() on port, stopping any previous one first.
+func startGPSSerialReader(port io.ReadCloser) {
+	stopGPSSerialReader()
+	gpsReaderQuit = make(chan struct{})
+	gpsReaderDone = make(chan struct{})
+	gpsReaderPort = port
+	go gpsSerialReader(port, gpsReaderQuit, gpsReaderDone)
+}
+
+// stopGPSSerialReader stops the running gpsSerialReader(), if any, and waits for it to close its port. A reader
+// stuck in a read is unblocked by closing the port under it, and the port is never reopened before it has exited.
+func stopGPSSerialReader() {
+	if gpsReaderQuit == nil {
+		return
+	}
+	close(gpsReaderQuit)
+	select {
+	case <-gpsReaderDone:
+	case <-time.After(gpsReaderStopTimeout):
+		log.Printf("GPS: serial reader did not stop, closing its port.\n")
+		gpsReaderPort.Close()
+		<-gpsReaderDone
+	}
+	gpsReaderQuit = nil
+	gpsReaderDone = nil
+	gpsReaderPort = nil
+}
+
+// gpsActivityWriter sees everything read from the GPS, and notes the time for isGPSReceiving().
+type gpsActivityWriter struct{}
+
+var lastGPSByteTime time.Time // stratuxClock time anything was last read from the GPS. See isGPSReceiving().
+var lastGSVLogTime time.Time  // stratuxClock time synthesized GSV sentences were last added to the raw GPS log.
+
+func (w gpsActivityWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		lastGPSByteTime = stratuxClock.Time
+	}
+	return len(p), nil
+}
+
+// logGPSRaw copies bytes consumed from the GPS stream to gpsRawLogChan when raw logging is enabled.
+// Never blocks the reader - if gpsRawLogger() falls behind, data is dropped from the capture.
+func logGPSRaw(p []byte) {
+	if !globalSettings.GPS_RawLog || len(p) == 0 {
+		return
+	}
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	select {
+	case gpsRawLogChan <- buf:
+	default:
+		logf(LOG_DEBUG, "logGPSRaw: capture channel full, dropping %d bytes\n", len(p))
+	}
+}
+
+// logSynthesizedGSV records the merged constellation as GSV sentences in the raw log every GPS_GSVLogInterval
+// seconds, so that a replay reconstructs the full sky view. Must only be called between frames (see
+// gpsSerialReader()), so that the sentences never split a sentence or UBX frame from the receiver.
+func logSynthesizedGSV() {
+	interval := time.Duration(globalSettings.GPS_GSVLogInterval) * time.Second
+	if !globalSettings.GPS_RawLog || interval <= 0 || stratuxClock.Since(lastGSVLogTime) < interval {
+		return
+	}
+	lastGSVLogTime = stratuxClock.Time
+	var buf []byte
+	for _, gsv := range synthesizeGSV() {
+		buf = append(buf, gsv...)
+	}
+	logGPSRaw(buf)
+}
+
+/*
+	gpsRawLogger().
+		Writes the verbatim GPS serial stream (NMEA and binary UBX) to timestamped files in logDir
+		 for offline analysis. A new file is started every gpsRawLogMaxSize bytes, and the current
+		 file is closed when raw logging is turned off.
+*/
+
+func gpsRawLogger() {
+	var fp *os.File
+	var written int
+	timer := time.NewTicker(5 * time.Second)
+	for {
+		select {
+		case buf := <-gpsRawLogChan:
+			if fp == nil || written >= gpsRawLogMaxSize {
+				if fp != nil {
+					fp.Close()
+				}
+				fn := logDir + "gps_raw_" + time.Now().UTC().Format("20060102_150405") + ".bin"
+				os.MkdirAll(logDir, 0755)
+				var err error
+				fp, err = os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+				if err != nil {
+					log.Printf("Failed to open raw GPS log '%s': %s\n", fn, err.Error())
+					fp = nil
+					continue
+				}
+				log.Printf("Logging raw GPS data to %s\n", fn)
+				written = 0
+			}
+			n, err := fp.Write(buf)
+			if err != nil {
+				log.Printf("raw GPS log write error: %s\n", err.Error())
+			}
+			written += n
+		case <-timer.C:
+			if fp != nil && !globalSettings.GPS_RawLog {
+				fp.Close()
+				fp = nil
+			}
+		}
+	}
+}
+
 // updateConstellation(): Periodic cleanup and statistics calculation for 'Satellites'
 // data structure. Calling functions must protect this in a satelliteMutex.
 func updateConstellation() {
-	var sats, tracked, seen uint8
+	var sats, tracked, seen, ranging uint8
+	typeSats := make(map[uint8]uint16)
+	typeTracked := make(map[uint8]uint16)
 	for svStr, thisSatellite := range Satellites {
 		if stratuxClock.Since(thisSatellite.TimeLastTracked) > 10*time.Second { // remove stale satellites if they haven't been tracked for 10 seconds
 			delete(Satellites, svStr)
+			delete(satSNRHistory, svStr)
+			delete(gsvSignals, svStr)
 		} else { // satellite almanac data is "fresh" even if it isn't being received.
 			tracked++
+			typeTracked[thisSatellite.Type]++
 			if thisSatellite.Signal > 0 {
 				seen++
 			}
@@ -1308,53 +3313,687 @@ func updateConstellation() {
 			}
 			if thisSatellite.InSolution { // TESTING: Determine "In solution" from structure (fix for multi-GNSS overflow)
 				sats++
+				typeSats[thisSatellite.Type]++
+				if thisSatellite.Type != SAT_TYPE_SBAS { // SBAS only augments the solution.
+					ranging++
+				}
 			}
 			// do any other calculations needed for this satellite
 		}
 	}
+	sampleSNRTrend()
+	checkSignalPlausibility()
 	//log.Printf("Satellite counts: %d tracking channels, %d with >0 dB-Hz signal\n", tracked, seen) // DEBUG - REMOVE
 	//log.Printf("Satellite struct: %v\n", Satellites)                                               // DEBUG - REMOVE
 	mySituation.Satellites = uint16(sats)
 	mySituation.SatellitesTracked = uint16(tracked)
 	mySituation.SatellitesSeen = uint16(seen)
+	mySituation.SatellitesRanging = uint16(ranging)
+	setConstellationCounts(typeSats, typeTracked)
+	constellationInSolution = uint16(sats)
+}
+
+// setConstellationCounts sets the per-constellation satellite counts in mySituation, from counts by satellite Type.
+func setConstellationCounts(inSolution, tracked map[uint8]uint16) {
+	mySituation.SatellitesGPS = inSolution[SAT_TYPE_GPS]
+	mySituation.SatellitesGLONASS = inSolution[SAT_TYPE_GLONASS]
+	mySituation.SatellitesGalileo = inSolution[SAT_TYPE_GALILEO]
+	mySituation.SatellitesBeiDou = inSolution[SAT_TYPE_BEIDOU]
+	mySituation.SatellitesQZSS = inSolution[SAT_TYPE_QZSS]
+	mySituation.SatellitesSBAS = inSolution[SAT_TYPE_SBAS]
+	mySituation.SatellitesGPSTracked = tracked[SAT_TYPE_GPS]
+	mySituation.SatellitesGLONASSTracked = tracked[SAT_TYPE_GLONASS]
+	mySituation.SatellitesGalileoTracked = tracked[SAT_TYPE_GALILEO]
+	mySituation.SatellitesBeiDouTracked = tracked[SAT_TYPE_BEIDOU]
+	mySituation.SatellitesQZSSTracked = tracked[SAT_TYPE_QZSS]
+	mySituation.SatellitesSBASTracked = tracked[SAT_TYPE_SBAS]
+}
+
+// gsvSatellite is one satellite from a GSV sentence, held until the rest of its group arrives.
+type gsvSatellite struct {
+	svStr         string
+	sv            int
+	svType        uint8
+	elev, az, cno int
+}
+
+// GSV groups being assembled, by sentence type and signal ID ("GPGSV,1", or "GPGSV," before NMEA 4.10). Protected
+// by mySituation.mu_GPS.
+var gsvGroupSats map[string][]gsvSatellite
+var gsvGroupNext map[string]int // Index of the next message expected in each group.
+
+// gsvSignal is the signal strength last reported for one signal (band) of a satellite.
+type gsvSignal struct {
+	cno  int
+	time time.Time // stratuxClock time reported.
+}
+
+var gsvSignals map[string]map[string]gsvSignal // Satellite ID -> GSV signal ID -> last report. Protected by satelliteMutex.
+
+// bestGSVSignal records a satellite's signal strength on one signal ID and returns the strongest of its signals
+// reported in the last 3 seconds, so that a multi-band receiver's satellites are counted and shown once, with their
+// best signal. -99 if none is being received. Must be called with satelliteMutex held.
+func bestGSVSignal(svStr, signalID string, cno int) int {
+	if gsvSignals[svStr] == nil {
+		gsvSignals[svStr] = make(map[string]gsvSignal)
+	}
+	gsvSignals[svStr][signalID] = gsvSignal{cno, stratuxClock.Time}
+	best := -99
+	for id, sig := range gsvSignals[svStr] {
+		if stratuxClock.Since(sig.time) > 3*time.Second {
+			delete(gsvSignals[svStr], id)
+		} else if sig.cno > best {
+			best = sig.cno
+		}
+	}
+	return best
+}
+
+// FixTransition is one change of the fix type, for diagnosing intermittent fixes. See recordFixTransition().
+type FixTransition struct {
+	Time       time.Time // Local time of the change.
+	From       string
+	To         string
+	Satellites uint16 // In solution, at the change.
+}
+
+const fixHistoryLen = 100
+
+var gsaFixMode int // Fix mode from the last GSA: 2 = 2D, 3 = 3D. Protected by mySituation.mu_GPS.
+var fixHistory []FixTransition
+var fixHistoryMutex *sync.Mutex
+
+// fixType describes the current fix, e.g. "No Fix", "2D", "3D + SBAS". Uses the GSA fix mode where the receiver sends one.
+func fixType() string {
+	var t string
+	switch mySituation.Quality {
+	case 0:
+		return "No Fix"
+	case 6:
+		return "Dead Reckoning"
+	}
+	switch gsaFixMode {
+	case 2:
+		t = "2D"
+	case 3:
+		t = "3D"
+	default:
+		t = "Fix"
+	}
+	if mySituation.Quality == 2 {
+		t += " + SBAS"
+	}
+	return t
+}
+
+/*
+	recordFixTransition().
+		Called from updateStatus, with mySituation.mu_GPS held. Logs each change of fixType() with the
+		 satellite count, and keeps the last fixHistoryLen of them for /getFixHistory.
+*/
+
+func recordFixTransition() {
+	t := fixType()
+	if t == mySituation.FixType {
+		return
+	}
+	tr := FixTransition{time.Now(), mySituation.FixType, t, mySituation.Satellites}
+	if tr.From == "" {
+		tr.From = "No Fix"
+	}
+	mySituation.FixType = t
+	logf(LOG_WARN, "GPS fix: %s -> %s, %d satellites.\n", tr.From, tr.To, tr.Satellites) // Logged at the default level.
+	fixHistoryMutex.Lock()
+	fixHistory = append(fixHistory, tr)
+	if len(fixHistory) > fixHistoryLen {
+		fixHistory = fixHistory[len(fixHistory)-fixHistoryLen:]
+	}
+	fixHistoryMutex.Unlock()
+}
+
+// SNRSample is one point of a satellite's signal history, taken every snrSampleInterval.
+type SNRSample struct {
+	Time      time.Time // stratuxClock time of the sample.
+	Elevation int16
+	Azimuth   int16
+	Signal    int8
+}
+
+// SNRElevationBin is the average signal of all satellites seen in one snrElevationStep band of elevation.
+type SNRElevationBin struct {
+	Elevation int // Lower edge of the band, degrees.
+	AvgSignal float64
+	Samples   int
+}
+
+const (
+	snrSampleInterval = 30 * time.Second
+	snrHistoryLen     = 20 // 10 minutes per satellite.
+	snrElevationStep  = 10 // degrees
+)
+
+var satSNRHistory map[string][]SNRSample // Keyed like Satellites. Protected by satelliteMutex.
+var snrElevationSum [90/snrElevationStep + 1]float64
+var snrElevationCount [90/snrElevationStep + 1]int
+var lastSNRSampleTime time.Time
+
+const (
+	maxPlausibleCNo     = 60 // dB-Hz. Real GNSS signals stay well below this.
+	signalFaultMinSats  = 4  // Satellites with signal needed before identical values are suspicious.
+	signalFaultHoldTime = 10 * time.Second
+)
+
+var signalFaultSince time.Time // stratuxClock time the current signal fault was first seen. Zero if none.
+
+/*
+	checkSignalPlausibility().
+		Flags C/No values that look like a receiver firmware or parsing fault rather than real signals: every
+		 received satellite reporting the same value, or values above maxPlausibleCNo. The condition has to
+		 persist for signalFaultHoldTime before globalStatus.GPS_signal_warning is set, since a few satellites
+		 can legitimately match for a moment. Calling functions must hold satelliteMutex.
+*/
+
+func checkSignalPlausibility() {
+	var n, high int
+	var first int8
+	identical := true
+	for _, sat := range Satellites {
+		if sat.Signal <= 0 {
+			continue
+		}
+		if n == 0 {
+			first = sat.Signal
+		} else if sat.Signal != first {
+			identical = false
+		}
+		if sat.Signal > maxPlausibleCNo {
+			high++
+		}
+		n++
+	}
+
+	warning := ""
+	if n >= signalFaultMinSats && identical {
+		warning = fmt.Sprintf("All %d satellites report the same signal (%d dB-Hz). Possible receiver firmware or parsing fault.", n, first)
+	} else if high > 0 {
+		warning = fmt.Sprintf("%d satellite(s) report implausible signal above %d dB-Hz. Possible receiver firmware or parsing fault.", high, maxPlausibleCNo)
+	}
+
+	if warning == "" {
+		signalFaultSince = time.Time{}
+		globalStatus.GPS_signal_warning = ""
+		return
+	}
+	if signalFaultSince.IsZero() {
+		signalFaultSince = stratuxClock.Time
+	}
+	if stratuxClock.Since(signalFaultSince) >= signalFaultHoldTime {
+		if globalStatus.GPS_signal_warning == "" {
+			log.Printf("GPS: %s\n", warning)
+		}
+		globalStatus.GPS_signal_warning = warning
+	}
+}
+
+/*
+	sampleSNRTrend().
+		Keeps a short, low-rate history of each satellite's signal as it rises and sets, and a running
+		 average of signal by elevation across all satellites. A satellite that is consistently weak in one
+		 direction, or at elevations where others are strong, points to a null in the antenna pattern,
+		 blockage, or a poor ground plane. Calling functions must hold satelliteMutex.
+*/
+
+func sampleSNRTrend() {
+	if stratuxClock.Since(lastSNRSampleTime) < snrSampleInterval {
+		return
+	}
+	lastSNRSampleTime = stratuxClock.Time
+	for svStr, sat := range Satellites {
+		if sat.Signal <= 0 || sat.Elevation < 0 || sat.Elevation > 90 || sat.Azimuth == -999 {
+			continue
+		}
+		h := append(satSNRHistory[svStr], SNRSample{stratuxClock.Time, sat.Elevation, sat.Azimuth, sat.Signal})
+		if len(h) > snrHistoryLen {
+			h = h[len(h)-snrHistoryLen:]
+		}
+		satSNRHistory[svStr] = h
+
+		bin := int(sat.Elevation) / snrElevationStep
+		snrElevationSum[bin] += float64(sat.Signal)
+		snrElevationCount[bin]++
+	}
+}
+
+// getSNRByElevation returns the average signal per elevation band since startup. Calling functions must hold satelliteMutex.
+func getSNRByElevation() []SNRElevationBin {
+	ret := make([]SNRElevationBin, 0)
+	for i := range snrElevationSum {
+		if snrElevationCount[i] == 0 {
+			continue
+		}
+		ret = append(ret, SNRElevationBin{i * snrElevationStep, snrElevationSum[i] / float64(snrElevationCount[i]), snrElevationCount[i]})
+	}
+	return ret
 }
 
+var compassPoints = []string{"north", "northeast", "east", "southeast", "south", "southwest", "west", "northwest"}
+
+/*
+	geometryHDOP().
+		Approximate HDOP from the azimuth and elevation of the given satellites, from the diagonal of
+		 (H^T H)^-1 where each row of H is the line-of-sight unit vector (east, north, up) plus a clock term.
+		 Returns 0 if there are fewer than four satellites or the geometry is degenerate.
+*/
+
+func geometryHDOP(sats []SatelliteInfo) float64 {
+	if len(sats) < 4 {
+		return 0
+	}
+	var a [4][8]float64 // H^T H, augmented with the identity for Gauss-Jordan inversion.
+	for _, sat := range sats {
+		el := float64(sat.Elevation) * math.Pi / 180
+		az := float64(sat.Azimuth) * math.Pi / 180
+		h := [4]float64{math.Cos(el) * math.Sin(az), math.Cos(el) * math.Cos(az), math.Sin(el), 1}
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 4; j++ {
+				a[i][j] += h[i] * h[j]
+			}
+		}
+	}
+	for i := 0; i < 4; i++ {
+		a[i][4+i] = 1
+	}
+	for col := 0; col < 4; col++ {
+		pivot := col
+		for r := col + 1; r < 4; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-9 {
+			return 0
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		p := a[col][col]
+		for j := range a[col] {
+			a[col][j] /= p
+		}
+		for r := 0; r < 4; r++ {
+			if r == col {
+				continue
+			}
+			f := a[r][col]
+			for j := range a[r] {
+				a[r][j] -= f * a[col][j]
+			}
+		}
+	}
+	return math.Sqrt(a[0][4] + a[1][5])
+}
+
+/*
+	diagnoseGPSAccuracy().
+		Turns the accuracy, the geometry of the satellites in solution and their mean C/No into a short
+		 human-readable assessment of why accuracy is poor, e.g. "poor geometry: satellites clustered to
+		 the north" or "weak signal: mean C/No 22 dB-Hz". Satellites are "clustered" if they leave a gap
+		 of more than 180 degrees of azimuth.
+*/
+
+func diagnoseGPSAccuracy() string {
+	if !isGPSValid() {
+		return "no fix"
+	}
+	sats := make([]SatelliteInfo, 0)
+	var cnoSum float64
+	satelliteMutex.Lock()
+	for _, sat := range Satellites {
+		if sat.InSolution && sat.Elevation >= 0 && sat.Elevation <= 90 && sat.Azimuth >= 0 && sat.Azimuth < 360 {
+			sats = append(sats, sat)
+			cnoSum += float64(sat.Signal)
+		}
+	}
+	satelliteMutex.Unlock()
+	if len(sats) == 0 {
+		return fmt.Sprintf("accuracy %.0f m; no satellite geometry reported", mySituation.Accuracy)
+	}
+
+	problems := make([]string, 0)
+	hdop := geometryHDOP(sats)
+	if hdop == 0 || hdop > 2.5 {
+		geom := fmt.Sprintf("poor geometry: HDOP %.1f from %d satellites", hdop, len(sats))
+		if hdop == 0 {
+			geom = fmt.Sprintf("poor geometry: only %d usable satellites", len(sats))
+		}
+		// Find the largest empty arc of azimuth. The satellites are clustered opposite it.
+		az := make([]int, len(sats))
+		for i, sat := range sats {
+			az[i] = int(sat.Azimuth)
+		}
+		sort.Ints(az)
+		gap, gapMid := 0, 0
+		for i := range az {
+			next := az[(i+1)%len(az)]
+			if i == len(az)-1 {
+				next += 360
+			}
+			if next-az[i] > gap {
+				gap = next - az[i]
+				gapMid = az[i] + gap/2
+			}
+		}
+		if gap > 180 {
+			cluster := int(degreesHdg(radians(float64(gapMid + 180))))
+			geom += fmt.Sprintf(", satellites clustered to the %s", compassPoints[((cluster+22)%360)/45])
+		}
+		problems = append(problems, geom)
+	}
+	if cno := cnoSum / float64(len(sats)); cno < 30 {
+		problems = append(problems, fmt.Sprintf("weak signal: mean C/No %.0f dB-Hz", cno))
+	}
+	if len(problems) == 0 {
+		return fmt.Sprintf("accuracy %.0f m; geometry and signal good", mySituation.Accuracy)
+	}
+	return fmt.Sprintf("accuracy %.0f m; %s", mySituation.Accuracy, strings.Join(problems, "; "))
+}
+
+// nmeaLatLng formats a latitude or longitude as NMEA (d)ddmm.mmmmm and its hemisphere.
+func nmeaLatLng(v float64, degDigits int, pos, neg string) (string, string) {
+	hemi := pos
+	if v < 0 {
+		hemi = neg
+		v = -v
+	}
+	deg := math.Floor(v)
+	return fmt.Sprintf("%0*d%08.5f", degDigits, int(deg), (v-deg)*60), hemi
+}
+
+/*
+	synthesizeRMCGGA().
+		Builds GPRMC and GPGGA sentences for a position, for NMEA consumers when the receiver only sends
+		 PUBX or binary UBX. The time is the fix time; the date comes from GPSTime and is left empty if the
+		 receiver hasn't sent one yet.
+*/
+
+func synthesizeRMCGGA(s *GPSSituationData) [][]byte {
+	lat, ns := nmeaLatLng(float64(s.Lat), 2, "N", "S")
+	lng, ew := nmeaLatLng(float64(s.Lng), 3, "E", "W")
+	t := s.LastFixSinceMidnightUTC
+	hms := fmt.Sprintf("%02d%02d%05.2f", int(t/3600), int(math.Mod(t, 3600)/60), math.Mod(t, 60))
+	date := ""
+	if !s.GPSTime.IsZero() {
+		date = s.GPSTime.UTC().Format("020106")
+	}
+	mode := "A"
+	if s.Quality == 2 {
+		mode = "D"
+	} else if s.Quality == 6 {
+		mode = "E"
+	}
+
+	rmc := fmt.Sprintf("GPRMC,%s,A,%s,%s,%s,%s,%.2f,%.2f,%s,,,%s", hms, lat, ns, lng, ew, s.GroundSpeedF, s.TrueCourse, date, mode)
+	gga := fmt.Sprintf("GPGGA,%s,%s,%s,%s,%s,%d,%02d,%.1f,%.1f,M,%.1f,M,,", hms, lat, ns, lng, ew, s.Quality, s.Satellites,
+		s.HDOP, s.Alt/3.28084, s.GeoidSep/3.28084)
+	return [][]byte{makeNMEACmd(rmc), makeNMEACmd(gga)}
+}
+
+// NMEA talker used for synthesized GSV sentences, per constellation. SBAS is reported with GPS, as receivers do.
+var gsvTalkers = map[uint8]string{
+	SAT_TYPE_GPS:     "GP",
+	SAT_TYPE_SBAS:    "GP",
+	SAT_TYPE_GLONASS: "GL",
+	SAT_TYPE_GALILEO: "GA",
+	SAT_TYPE_BEIDOU:  "GB",
+	SAT_TYPE_QZSS:    "GP", // NMEA 4.0 IDs 193-200, as u-blox 8 sends them.
+}
+
+type satellitesByNMEA []SatelliteInfo
+
+func (s satellitesByNMEA) Len() int           { return len(s) }
+func (s satellitesByNMEA) Less(i, j int) bool { return s[i].SatelliteNMEA < s[j].SatelliteNMEA }
+func (s satellitesByNMEA) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+/*
+	synthesizeGSV().
+		Builds GSV sentences covering every satellite in 'Satellites', grouped by talker. The receiver
+		 fragments satellites across GSV and PUBX,03 (and drops the ones it can't fit); this gives NMEA
+		 consumers the merged multi-GNSS view instead. Satellites of unknown type are left out, since
+		 they have no talker. Used by NMEA outputs when globalSettings.NMEA_SynthesizedGSV is set.
+*/
+
+func synthesizeGSV() [][]byte {
+	byTalker := make(map[string][]SatelliteInfo)
+	satelliteMutex.Lock()
+	for _, sat := range Satellites {
+		if talker, ok := gsvTalkers[sat.Type]; ok {
+			byTalker[talker] = append(byTalker[talker], sat)
+		}
+	}
+	satelliteMutex.Unlock()
+
+	talkers := make([]string, 0, len(byTalker))
+	for talker := range byTalker {
+		talkers = append(talkers, talker)
+	}
+	sort.Strings(talkers)
+
+	ret := make([][]byte, 0)
+	for _, talker := range talkers {
+		sats := byTalker[talker]
+		sort.Sort(satellitesByNMEA(sats))
+		numMsgs := (len(sats) + 3) / 4 // Four satellites per sentence.
+		for m := 0; m < numMsgs; m++ {
+			end := m*4 + 4
+			if end > len(sats) {
+				end = len(sats)
+			}
+			cmd := fmt.Sprintf("%sGSV,%d,%d,%02d", talker, numMsgs, m+1, len(sats))
+			for _, sat := range sats[m*4 : end] {
+				elev, az, snr := "", "", ""
+				if sat.Elevation != -999 {
+					elev = fmt.Sprintf("%02d", sat.Elevation)
+				}
+				if sat.Azimuth != -999 {
+					az = fmt.Sprintf("%03d", sat.Azimuth)
+				}
+				if sat.Signal > 0 {
+					snr = fmt.Sprintf("%02d", sat.Signal)
+				}
+				cmd += fmt.Sprintf(",%02d,%s,%s,%s", sat.SatelliteNMEA, elev, az, snr)
+			}
+			ret = append(ret, makeNMEACmd(cmd))
+		}
+	}
+	return ret
+}
+
+// gpsDisconnectGrace returns how long the GPS may go without output before being considered disconnected.
+func gpsDisconnectGrace() time.Duration {
+	if globalSettings.GPS_DisconnectGrace <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(globalSettings.GPS_DisconnectGrace) * time.Second
+}
+
+// isGPSConnected reports whether a valid NMEA message has been received within the grace period.
 func isGPSConnected() bool {
-	return stratuxClock.Since(mySituation.LastValidNMEAMessageTime) < 5*time.Second
+	return stratuxClock.Since(mySituation.LastValidNMEAMessageTime) < gpsDisconnectGrace()
 }
 
-// isGPSValid returns true only if a valid position fix has been seen in the last 15 seconds,
-// and if the GPS subsystem has recently detected a GPS device.
+// isGPSReceiving reports whether any bytes at all have come from the GPS within the grace period. Only when
+// this fails is the receiver treated as disconnected and reopened; a receiver that is sending nothing but bad
+// sentences for a while (noise) keeps its connection, and its ephemeris.
+func isGPSReceiving() bool {
+	return stratuxClock.Since(lastGPSByteTime) < gpsDisconnectGrace()
+}
+
+var gpsFixValid bool          // Debounced fix state returned by isGPSValid().
+var gpsFixGoodSince time.Time // stratuxClock time the fix has been continuously present since. Zero while absent.
+var gpsFixLastGood time.Time  // stratuxClock time the fix was last present.
+
+// isGPSValid returns true only if a position fix has been present for GPS_FixAcquireTime seconds, and hasn't
+// been missing for GPS_FixHoldTime seconds since, so that a dropped sentence or a momentary "no fix" doesn't
+// toggle the state. The fix is present while one was seen in the last 3 seconds with Quality > 0. Losing the
+// GPS device, or an SBAS dominated solution, invalidates it at once.
 // If false, 'Quality` is set to 0 ("No fix"), as is the number of satellites in solution.
 func isGPSValid() bool {
-	isValid := false
-	if (stratuxClock.Since(mySituation.LastFixLocalTime) < 15*time.Second) && globalStatus.GPS_connected && mySituation.Quality > 0 {
-		isValid = true
+	if !globalStatus.GPS_connected || isSBASDominated() {
+		gpsFixValid = false
+		gpsFixGoodSince = time.Time{}
+	} else if stratuxClock.Since(mySituation.LastFixLocalTime) < 3*time.Second && mySituation.Quality > 0 {
+		if gpsFixGoodSince.IsZero() {
+			gpsFixGoodSince = stratuxClock.Time
+		}
+		gpsFixLastGood = stratuxClock.Time
+		if stratuxClock.Since(gpsFixGoodSince) >= time.Duration(globalSettings.GPS_FixAcquireTime)*time.Second {
+			gpsFixValid = true
+		}
 	} else {
+		gpsFixGoodSince = time.Time{}
+		if stratuxClock.Since(gpsFixLastGood) >= time.Duration(globalSettings.GPS_FixHoldTime)*time.Second {
+			gpsFixValid = false
+		}
+	}
+	if !gpsFixValid && gpsFixGoodSince.IsZero() { // Not while a fix is being acquired, or it never would be.
 		mySituation.Quality = 0
 		mySituation.Satellites = 0
+		mySituation.UncertaintyRadiusValid = false
+	}
+	return gpsFixValid
+}
+
+var sbasDominatedLogged bool
+var lastSBASSolutionReport time.Time // stratuxClock time of the last authoritative SBAS in-solution report (PUBX,03 or GSA). Protected by mySituation.mu_GPS.
+var constellationInSolution uint16   // Satellites flagged in solution, including SBAS, as of the last updateConstellation().
+
+// isSBASDominated reports whether the solution has fewer than globalSettings.GPS_MinRangingSatellites non-SBAS
+// satellites. Geostationary SBAS satellites give almost no geometry, so such a "fix" is degenerate. Only applies
+// when the receiver reports which satellites are in solution (GSA or PUBX,03).
+func isSBASDominated() bool {
+	need := uint16(globalSettings.GPS_MinRangingSatellites)
+	dominated := need > 0 && constellationInSolution > 0 && mySituation.SatellitesRanging < need
+	if dominated && !sbasDominatedLogged {
+		log.Printf("GPS: rejecting fix with only %d non-SBAS satellites in solution (%d total, need %d).\n", mySituation.SatellitesRanging, constellationInSolution, need)
 	}
-	return isValid
+	sbasDominatedLogged = dominated
+	return dominated
+}
+
+/*
+	updateColdStartStatus().
+		Detects a receiver that is doing a cold start (no almanac or ephemeris, e.g. after weeks of storage)
+		 so that the UI can explain the long time to first fix instead of looking broken. A cold start is
+		 assumed if there's no fix and either the last fix recorded in gpsLastFixLocation is older than
+		 gpsColdStartAge, or the receiver has been connected for longer than gpsAcquireGrace without
+		 decoding ephemeris for enough satellites. With no gpsLastFixLocation (e.g. a fresh install) the last
+		 fix age is unknown and only the ephemeris test is used.
+
+		The time remaining is a rough estimate: satellites that are being received but have no ephemeris yet
+		 need about gpsEphemerisTime to decode, in parallel; each missing satellite that isn't being received
+		 at all adds another gpsEphemerisTime or so for the receiver to find it. Capped at gpsAlmanacTime.
+
+		Note that before the first fix the system clock is only as good as fake-hwclock, so the last fix age
+		 is an underestimate.
+*/
+
+func updateColdStartStatus() {
+	if isGPSValid() {
+		gpsLastFix = time.Now()
+		if time.Since(gpsLastFixSaved) > 10*time.Minute { // Don't write to the SD card on every fix.
+			if err := ioutil.WriteFile(gpsLastFixLocation, []byte(gpsLastFix.Format(time.RFC3339)+"\n"), 0644); err != nil {
+				log.Printf("can't save last GPS fix time %s: %s\n", gpsLastFixLocation, err.Error())
+			}
+			gpsLastFixSaved = gpsLastFix
+		}
+		if globalStatus.GPS_cold_start {
+			log.Printf("GPS: first fix after cold start, %s after connecting.\n", stratuxClock.Since(gpsConnectedTime))
+		}
+		globalStatus.GPS_cold_start = false
+		globalStatus.GPS_acquisition_status = ""
+		globalStatus.GPS_acquisition_eta = 0
+		return
+	}
+	if !globalStatus.GPS_connected {
+		globalStatus.GPS_cold_start = false
+		globalStatus.GPS_acquisition_status = ""
+		globalStatus.GPS_acquisition_eta = 0
+		return
+	}
+
+	var withEphemeris, receiving int
+	satelliteMutex.Lock()
+	for _, sat := range Satellites {
+		if sat.HasEphemeris {
+			withEphemeris++
+		} else if sat.Signal > 0 {
+			receiving++
+		}
+	}
+	satelliteMutex.Unlock()
+
+	needed := gpsSatsNeededForFix - withEphemeris
+	staleAlmanac := !gpsLastFix.IsZero() && time.Since(gpsLastFix) > gpsColdStartAge
+	slowAcquisition := stratuxClock.Since(gpsConnectedTime) > gpsAcquireGrace && needed > 0
+	if !staleAlmanac && !slowAcquisition {
+		globalStatus.GPS_cold_start = false
+		globalStatus.GPS_acquisition_status = "Acquiring satellites"
+		globalStatus.GPS_acquisition_eta = 0
+		return
+	}
+
+	if !globalStatus.GPS_cold_start {
+		log.Printf("GPS: cold start detected (last fix %v, %d satellites with ephemeris, %d more receiving).\n", gpsLastFix, withEphemeris, receiving)
+	}
+	globalStatus.GPS_cold_start = true
+	globalStatus.GPS_acquisition_status = "Acquiring satellites, this may take a few minutes (cold start)"
+
+	eta := time.Duration(0)
+	if needed > 0 {
+		eta = gpsEphemerisTime
+		if receiving < needed {
+			eta += time.Duration(needed-receiving) * gpsEphemerisTime
+		}
+	}
+	if eta > gpsAlmanacTime {
+		eta = gpsAlmanacTime
+	}
+	globalStatus.GPS_acquisition_eta = int(eta.Seconds())
 }
 
 func isGPSGroundTrackValid() bool {
 	return stratuxClock.Since(mySituation.LastGroundTrackTime) < 15*time.Second
 }
 
+// isGPSVertVelValid reports whether GPSVertVel is current. Only u-blox receivers (PUBX,00) report it.
+func isGPSVertVelValid() bool {
+	return stratuxClock.Since(lastGPSVertVelTime) < 15*time.Second
+}
+
 func isGPSClockValid() bool {
 	return stratuxClock.Since(mySituation.LastGPSTimeTime) < 15*time.Second
 }
 
 func pollGPS() {
-	readyToInitGPS = true //TO-DO: Implement more robust method (channel control) to kill zombie serial readers
 	timer := time.NewTicker(4 * time.Second)
 	for {
 		<-timer.C
 		// GPS enabled, was not connected previously?
-		if globalSettings.GPS_Enabled && !globalStatus.GPS_connected && readyToInitGPS { //TO-DO: Implement more robust method (channel control) to kill zombie serial readers
-			globalStatus.GPS_connected = initGPSSerial()
+		if globalSettings.GPS_Enabled && !globalStatus.GPS_connected {
+			stopGPSSerialReader() // Make sure the old reader has let go of the port before reopening it.
+			var port io.ReadCloser
+			if replay := os.Getenv("STRATUX_GPS_REPLAY"); replay != "" {
+				port = openGPSReplay(replay)
+			} else if globalSettings.GPS_Network_Source != "" {
+				if conn := openGPSNetwork(globalSettings.GPS_Network_Source); conn != nil {
+					port = conn
+				}
+			} else if initGPSSerial() {
+				port = serialPort
+			}
+			globalStatus.GPS_connected = port != nil
 			if globalStatus.GPS_connected {
-				go gpsSerialReader()
+				gpsConnectedTime = stratuxClock.Time
+				lastGPSByteTime = stratuxClock.Time // Start the grace period.
+				startGPSSerialReader(port)
 			}
 		}
 	}
@@ -1362,8 +4001,25 @@ func pollGPS() {
 
 func initGPS() {
 	mySituation.mu_GPS = &sync.Mutex{}
+	mySituation.AccuracyWeight = 1.0
 	satelliteMutex = &sync.Mutex{}
 	Satellites = make(map[string]SatelliteInfo)
+	satSNRHistory = make(map[string][]SNRSample)
+	fixHistoryMutex = &sync.Mutex{}
+	gsvGroupSats = make(map[string][]gsvSatellite)
+	gsvGroupNext = make(map[string]int)
+	gsvSignals = make(map[string]map[string]gsvSignal)
+	gpsRawLogChan = make(chan []byte, 1024)
+	ubxAckChan = make(chan [3]byte, 4)
+	if buf, err := ioutil.ReadFile(gpsLastFixLocation); err == nil {
+		gpsLastFix, _ = time.Parse(time.RFC3339, strings.TrimSpace(string(buf)))
+	}
+
+	if len(globalSettings.GPS_DisabledSentences) > 0 {
+		log.Printf("GPS: ignoring NMEA sentences %s\n", strings.Join(globalSettings.GPS_DisabledSentences, ", "))
+	}
 
+	go gpsRawLogger()
 	go pollGPS()
+	go ubxHardwareMonitor()
 }
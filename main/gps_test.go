@@ -0,0 +1,657 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gps_test.go: Tests for the GPS stream framing and NMEA parsing helpers.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// resetGPSTestState puts the GPS state back to what initGPS() leaves, without starting any goroutines. stratuxClock
+// is stopped an hour after "boot", so tests control time by advancing stratuxClock.Time themselves.
+func resetGPSTestState() {
+	globalSettings = settings{}
+	defaultSettings()
+	globalSettings.GPS_Set_System_Time = false
+	globalStatus = status{}
+	stratuxClock = &monotonic{Time: time.Time{}.Add(time.Hour)}
+
+	mySituation = SituationData{}
+	mySituation.mu_GPS = &sync.Mutex{}
+	mySituation.mu_Attitude = &sync.Mutex{}
+	mySituation.AccuracyWeight = 1.0
+	satelliteMutex = &sync.Mutex{}
+	Satellites = make(map[string]SatelliteInfo)
+	satSNRHistory = make(map[string][]SNRSample)
+	fixHistoryMutex = &sync.Mutex{}
+	fixHistory = nil
+	gsvGroupSats = make(map[string][]gsvSatellite)
+	gsvGroupNext = make(map[string]int)
+	gsvSignals = make(map[string]map[string]gsvSignal)
+
+	gsaCycleOpen = false
+	gpsCurrentEpoch, gpsEpochValid, gpsEpochTime = 0, false, time.Time{}
+	gpsFixInterval, lastFixEpoch = 0, 0
+	gpsFixValid, gpsFixGoodSince, gpsFixLastGood = false, time.Time{}, time.Time{}
+	lastPUBXAltitudeTime, lastGeoidSepTime = time.Time{}, time.Time{}
+	groundTrackSamples, groundTrackNext, lastDisplayCourseTime = [len(groundTrackSamples)]groundTrackSample{}, 0, time.Time{}
+	gpsVertVelFilter, lastGPSVertVelTime = movingAverage{}, time.Time{}
+	lastGSTTime, gsaFixMode = time.Time{}, 0
+	lastSBASSolutionReport, constellationInSolution = time.Time{}, 0
+	talkerLastSeen = make(map[string]time.Time)
+	talkerSkipLogged = make(map[string]bool)
+}
+
+// processNMEALines feeds sentences to processNMEALine, advancing stratuxClock by step before each one.
+func processNMEALines(step time.Duration, lines ...string) {
+	for _, l := range lines {
+		stratuxClock.Time = stratuxClock.Time.Add(step)
+		processNMEALine(l)
+	}
+}
+
+func TestScanGPSFramesOneByteAtATime(t *testing.T) {
+	// NAV-PVT style payload containing bytes that look like NMEA framing, to make sure a UBX frame is
+	//  taken by its length and not split on '$' or '\n'.
+	payload := []byte{'$', 0x01, '\n', 0x02, '\r', 0xB5, 0x62, 0x00}
+	pvt := makeUBXCFG(0x01, 0x07, uint16(len(payload)), payload)
+	ack := makeUBXCFG(0x05, 0x01, 2, []byte{0x06, 0x24})
+	badChk := makeUBXCFG(0x05, 0x01, 2, []byte{0x06, 0x08})
+	badChk[len(badChk)-1]++
+
+	var in bytes.Buffer
+	in.WriteString("garbage\r\n")
+	in.WriteString("$GPGGA,174505.00,3356.76600,S,15110.63200,E,1,08,1.00,21.0,M,22.1,M,,*7F\r\n")
+	in.Write(pvt)
+	in.WriteString("$GPVTG,270.0,T,,M,10.0,N,18.5,K,A*05\n") // No CR.
+	in.Write(badChk)
+	in.WriteString("$GPRMC,174506.00,A,3356") // Truncated by the next sentence.
+	in.WriteString("$GPGSA,A,3,02,05,12,25,,,,,,,,,2.0,1.2,1.6*37\r\n")
+	in.Write(ack)
+	in.WriteString("$GPGSV,3,3,09,29,35,245,40*4A") // Truncated by EOF.
+
+	want := [][]byte{
+		[]byte("$GPGGA,174505.00,3356.76600,S,15110.63200,E,1,08,1.00,21.0,M,22.1,M,,*7F"),
+		pvt,
+		[]byte("$GPVTG,270.0,T,,M,10.0,N,18.5,K,A*05"),
+		[]byte("$GPGSA,A,3,02,05,12,25,,,,,,,,,2.0,1.2,1.6*37"),
+		ack,
+	}
+
+	scanner := bufio.NewScanner(iotest.OneByteReader(bytes.NewReader(in.Bytes())))
+	scanner.Split(scanGPSFrames)
+	var got [][]byte
+	for scanner.Scan() {
+		got = append(got, append([]byte(nil), scanner.Bytes()...))
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("scanner error: %s", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d frames, want %d: %q", len(got), len(want), got)
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("frame %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestMultiGSASatelliteCount(t *testing.T) {
+	resetGPSTestState()
+
+	// One fix from a u-blox M8N with NMEA 4.1 output: a GNGSA per constellation (system ID in the last field),
+	//  then the next sentence of the cycle. GPS includes SBAS PRN 133 (NMEA 46).
+	processNMEALines(10*time.Millisecond,
+		"$GNGSA,A,3,02,05,12,25,29,46,,,,,,,1.60,0.90,1.32,1*05", // GPS
+		"$GNGSA,A,3,67,68,77,78,,,,,,,,,1.60,0.90,1.32,2*0C",     // GLONASS
+		"$GNGSA,A,3,04,11,19,,,,,,,,,,1.60,0.90,1.32,3*01",       // Galileo
+		"$GNVTG,270.0,T,,M,10.0,N,18.5,K,A*1B",
+	)
+	if mySituation.Satellites != 13 {
+		t.Errorf("Satellites after a GPS+GLONASS+Galileo GSA cycle: got %d, want 13", mySituation.Satellites)
+	}
+	for _, id := range []string{"G2", "G29", "S133", "R3", "R14", "E4", "E19"} {
+		if sat, ok := Satellites[id]; !ok || !sat.InSolution {
+			t.Errorf("satellite %s missing or not in solution", id)
+		}
+	}
+
+	// The next fix starts a new count rather than adding to the last one.
+	processNMEALines(time.Second, "$GNGSA,A,3,05,12,,,,,,,,,,,1.60,0.90,1.32,1*09")
+	if mySituation.Satellites != 2 {
+		t.Errorf("Satellites after the next GSA cycle: got %d, want 2", mySituation.Satellites)
+	}
+}
+
+func TestGGANoFixKeepsLastFix(t *testing.T) {
+	resetGPSTestState()
+
+	stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+	if !processNMEALine("$GPGGA,174505.00,3356.76600,S,15110.63200,E,1,08,1.00,21.0,M,22.1,M,,*7F") {
+		t.Fatalf("valid GGA rejected")
+	}
+	want := mySituation.GPSSituationData
+
+	stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+	if processNMEALine("$GPGGA,174506.00,3400.00000,S,15100.00000,E,0,08,1.00,50.0,M,22.1,M,,*7E") {
+		t.Errorf("quality 0 GGA accepted")
+	}
+	got := mySituation.GPSSituationData
+	if got.Lat != want.Lat || got.Lng != want.Lng || got.Alt != want.Alt || got.Quality != want.Quality {
+		t.Errorf("quality 0 GGA changed the fix: got %v, %v, %v ft, quality %d, want %v, %v, %v ft, quality %d",
+			got.Lat, got.Lng, got.Alt, got.Quality, want.Lat, want.Lng, want.Alt, want.Quality)
+	}
+	if got.LastFixLocalTime != want.LastFixLocalTime || got.LastFixSinceMidnightUTC != want.LastFixSinceMidnightUTC {
+		t.Errorf("quality 0 GGA refreshed the fix time")
+	}
+}
+
+func TestPUBXGroundSpeed(t *testing.T) {
+	tests := []struct {
+		sentence string
+		knots    float64
+		rounded  uint16
+	}{
+		{"$PUBX,00,174501.00,4726.98800,N,12218.52800,W,137.160,D3,2.1,3.4,100.008,180.00,-1.500,,1.10,1.80,1.20,9,0,0*52", 54.0, 54},
+		{"$PUBX,00,174501.00,4726.98800,N,12218.52800,W,137.160,D3,2.1,3.4,9.260,180.00,-1.500,,1.10,1.80,1.20,9,0,0*56", 5.0, 5},
+	}
+	for _, tt := range tests {
+		resetGPSTestState()
+		stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+		if !processNMEALine(tt.sentence) {
+			t.Fatalf("PUBX,00 rejected: %s", tt.sentence)
+		}
+		if math.Abs(float64(mySituation.GroundSpeedF)-tt.knots) > 0.001 || mySituation.GroundSpeed != tt.rounded {
+			t.Errorf("%s: GroundSpeedF %v, GroundSpeed %d, want %v, %d", tt.sentence, mySituation.GroundSpeedF, mySituation.GroundSpeed, tt.knots, tt.rounded)
+		}
+	}
+}
+
+func TestGGAUnitsToFeet(t *testing.T) {
+	for _, tt := range []struct {
+		units string
+		want  float64
+	}{
+		{"M", 3.28084},
+		{"F", 1.0},
+		{"", 3.28084}, // Unknown, assumed to be meters.
+	} {
+		if got := ggaUnitsToFeet(tt.units, "altitude"); got != tt.want {
+			t.Errorf("ggaUnitsToFeet(%q) = %v, want %v", tt.units, got, tt.want)
+		}
+	}
+
+	// A GGA in feet isn't converted again.
+	resetGPSTestState()
+	stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+	if !processNMEALine("$GPGGA,174505.00,3356.76600,S,15110.63200,E,1,08,1.00,100.0,F,72.5,F,,*4C") {
+		t.Fatalf("GGA in feet rejected")
+	}
+	if mySituation.Alt != 100 || mySituation.GeoidSep != 72.5 {
+		t.Errorf("GGA in feet: Alt %v ft, GeoidSep %v ft, want 100 ft, 72.5 ft", mySituation.Alt, mySituation.GeoidSep)
+	}
+}
+
+func TestIsStaleEpoch(t *testing.T) {
+	resetGPSTestState()
+	for i, tt := range []struct {
+		fixTime float64
+		stale   bool
+	}{
+		{100.0, false},
+		{100.0, false}, // Another sentence from the same fix.
+		{99.0, true},   // Delayed from the previous fix.
+		{101.0, false},
+		{100.5, true},
+		{86399.5, true}, // Just before midnight, so earlier than 101 s after it, not nearly a day later.
+		{102.0, false},
+	} {
+		stratuxClock.Time = stratuxClock.Time.Add(100 * time.Millisecond)
+		if got := isStaleEpoch("GPGGA", tt.fixTime); got != tt.stale {
+			t.Errorf("step %d: isStaleEpoch(%v) = %v, want %v", i, tt.fixTime, got, tt.stale)
+		}
+	}
+
+	// Midnight rollover.
+	resetGPSTestState()
+	for i, tt := range []struct {
+		fixTime float64
+		stale   bool
+	}{
+		{86399.0, false},
+		{86399.5, false},
+		{0.5, false},
+		{86399.5, true},
+		{1.0, false},
+	} {
+		stratuxClock.Time = stratuxClock.Time.Add(100 * time.Millisecond)
+		if got := isStaleEpoch("GPGGA", tt.fixTime); got != tt.stale {
+			t.Errorf("midnight step %d: isStaleEpoch(%v) = %v, want %v", i, tt.fixTime, got, tt.stale)
+		}
+	}
+
+	// With nothing newer for 3 seconds, the receiver's clock is assumed to have been corrected.
+	stratuxClock.Time = stratuxClock.Time.Add(4 * time.Second)
+	if isStaleEpoch("GPGGA", 0.5) {
+		t.Errorf("epoch not restarted after 4 s")
+	}
+
+	// Interleaved sentences: the delayed RMC from the previous fix doesn't overwrite the newer GGA position.
+	resetGPSTestState()
+	processNMEALines(100*time.Millisecond,
+		"$GPGGA,174505.00,3356.76600,S,15110.63200,E,1,08,1.00,21.0,M,22.1,M,,*7F",
+		"$GPGGA,174506.00,3356.76700,S,15110.63300,E,1,08,1.00,22.0,M,22.1,M,,*7F",
+	)
+	lat, lng := mySituation.Lat, mySituation.Lng
+	stratuxClock.Time = stratuxClock.Time.Add(100 * time.Millisecond)
+	if processNMEALine("$GPRMC,174505.00,A,3356.76600,S,15110.63200,E,022.4,084.4,161026,003.1,W*5E") {
+		t.Errorf("RMC from the previous fix accepted")
+	}
+	if mySituation.Lat != lat || mySituation.Lng != lng {
+		t.Errorf("RMC from the previous fix moved the position to %v, %v", mySituation.Lat, mySituation.Lng)
+	}
+}
+
+func TestFixTimeDelta(t *testing.T) {
+	for _, tt := range []struct{ from, to, want float64 }{
+		{100, 101, 1},
+		{101, 100, -1},
+		{86399.5, 0.5, 1},  // Across midnight.
+		{0.5, 86399.5, -1}, // Back across midnight.
+		{86000, 400, 800},
+		{0, 43199, 43199},
+		{0, 43200, -43200}, // Deltas are between -12 h and +12 h.
+	} {
+		if got := fixTimeDelta(tt.from, tt.to); got != tt.want {
+			t.Errorf("fixTimeDelta(%v, %v) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+
+	// The fix rate measured across midnight.
+	resetGPSTestState()
+	for _, fixTime := range []float64{86398.5, 86399.0, 86399.5, 0.0, 0.5, 1.0} {
+		updateFixRate(fixTime)
+	}
+	if globalStatus.GPS_fix_rate != 2 {
+		t.Errorf("fix rate across midnight: got %v Hz, want 2 Hz", globalStatus.GPS_fix_rate)
+	}
+}
+
+var gsvGroup = []string{
+	"$GPGSV,3,1,09,02,67,310,45,05,41,052,44,06,22,128,38,09,15,220,35*78",
+	"$GPGSV,3,2,09,12,55,175,46,17,30,280,41,19,12,080,33,25,48,010,43*77",
+	"$GPGSV,3,3,09,29,35,245,40*4A",
+}
+
+func TestGSVGroupAssembly(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts []int // Indexes into gsvGroup, in the order they arrive.
+		want  int   // Satellites in the Satellites map afterwards.
+	}{
+		{"in order", []int{0, 1, 2}, 9},
+		{"out of order", []int{0, 2, 1}, 0},
+		{"missing second part", []int{0, 2}, 0},
+		{"missing first part", []int{1, 2}, 0},
+		{"restarted after a missing part", []int{0, 2, 0, 1, 2}, 9},
+	}
+	for _, tt := range tests {
+		resetGPSTestState()
+		for i, part := range tt.parts {
+			stratuxClock.Time = stratuxClock.Time.Add(10 * time.Millisecond)
+			processNMEALine(gsvGroup[part])
+			if i < len(tt.parts)-1 && len(Satellites) != 0 {
+				t.Errorf("%s: %d satellites before the group was complete", tt.name, len(Satellites))
+			}
+		}
+		if len(Satellites) != tt.want {
+			t.Errorf("%s: %d satellites, want %d", tt.name, len(Satellites), tt.want)
+		}
+	}
+
+	// Satellites from every part of the group, with their elevation, azimuth and signal.
+	for _, want := range []SatelliteInfo{
+		{SatelliteID: "G2", Elevation: 67, Azimuth: 310, Signal: 45},
+		{SatelliteID: "G17", Elevation: 30, Azimuth: 280, Signal: 41},
+		{SatelliteID: "G29", Elevation: 35, Azimuth: 245, Signal: 40},
+	} {
+		got, ok := Satellites[want.SatelliteID]
+		if !ok {
+			t.Errorf("%s missing", want.SatelliteID)
+			continue
+		}
+		if got.Elevation != want.Elevation || got.Azimuth != want.Azimuth || got.Signal != want.Signal || got.Type != SAT_TYPE_GPS {
+			t.Errorf("%s: elevation %d, azimuth %d, signal %d, type %d, want %d, %d, %d, GPS", want.SatelliteID,
+				got.Elevation, got.Azimuth, got.Signal, got.Type, want.Elevation, want.Azimuth, want.Signal)
+		}
+	}
+}
+
+func TestGQGSVQZSS(t *testing.T) {
+	for _, tt := range []struct {
+		sentence string
+		ids      []string
+	}{
+		{"$GQGSV,1,1,02,193,65,160,42,195,40,200,38*73", []string{"Q193", "Q195"}}, // NMEA 4.0 numbering.
+		{"$GQGSV,1,1,02,02,65,160,42,03,40,200,38,1*69", []string{"Q194", "Q195"}}, // NMEA 4.11, numbered from 1.
+	} {
+		resetGPSTestState()
+		stratuxClock.Time = stratuxClock.Time.Add(10 * time.Millisecond)
+		processNMEALine(tt.sentence)
+		if len(Satellites) != len(tt.ids) {
+			t.Errorf("%s: %d satellites, want %d", tt.sentence, len(Satellites), len(tt.ids))
+		}
+		if mySituation.SatellitesTracked != uint16(len(tt.ids)) || mySituation.SatellitesQZSSTracked != uint16(len(tt.ids)) {
+			t.Errorf("%s: SatellitesTracked %d, SatellitesQZSSTracked %d, want %d", tt.sentence, mySituation.SatellitesTracked,
+				mySituation.SatellitesQZSSTracked, len(tt.ids))
+		}
+		for _, id := range tt.ids {
+			if sat, ok := Satellites[id]; !ok || sat.Type != SAT_TYPE_QZSS {
+				t.Errorf("%s: %s missing or not QZSS (%+v)", tt.sentence, id, sat)
+			}
+		}
+	}
+}
+
+// TestNMEAConcurrentWithAttitude runs the NMEA parser from two goroutines alongside an attitude writer and the
+// status updates that share mySituation. Run with -race.
+func TestNMEAConcurrentWithAttitude(t *testing.T) {
+	resetGPSTestState()
+	lines := []string{
+		"$PUBX,00,174501.00,4726.98800,N,12218.52800,W,137.160,D3,2.1,3.4,100.008,180.00,-1.500,,1.10,1.80,1.20,9,0,0*52",
+		"$GPGGA,174505.00,3356.76600,S,15110.63200,E,1,08,1.00,21.0,M,22.1,M,,*7F",
+		"$GPRMC,174506.00,A,3356.76600,S,15110.63200,E,022.4,084.4,161026,003.1,W*5D",
+		"$GPGSA,A,3,02,05,12,25,,,,,,,,,2.0,1.2,1.6*37",
+		"$GPGSV,3,1,09,02,67,310,45,05,41,052,44,06,22,128,38,09,15,220,35*78",
+		"$GPGSV,3,2,09,12,55,175,46,17,30,280,41,19,12,080,33,25,48,010,43*77",
+		"$GPGSV,3,3,09,29,35,245,40*4A",
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 2; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				processNMEALine(lines[i%len(lines)])
+			}
+		}()
+	}
+	wg.Add(2)
+	go func() { // As attitudeReaderSender does.
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			mySituation.mu_Attitude.Lock()
+			mySituation.Pitch = float64(i)
+			mySituation.Roll = -float64(i)
+			mySituation.LastAttitudeTime = stratuxClock.Time
+			mySituation.mu_Attitude.Unlock()
+		}
+	}()
+	go func() { // As updateStatus does.
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			mySituation.mu_GPS.Lock()
+			mySituation.AccuracyDiagnosis = diagnoseGPSAccuracy()
+			recordFixTransition()
+			mySituation.mu_GPS.Unlock()
+		}
+	}()
+	wg.Wait()
+}
+
+// pipePort is an in-memory GPS port that signals the first read, and records whether it has been closed.
+type pipePort struct {
+	*io.PipeReader
+	reading chan struct{}
+	closed  bool
+}
+
+func (p *pipePort) Read(b []byte) (int, error) {
+	select {
+	case <-p.reading:
+	default:
+		close(p.reading)
+	}
+	return p.PipeReader.Read(b)
+}
+
+func (p *pipePort) Close() error {
+	p.closed = true
+	return p.PipeReader.Close()
+}
+
+func TestStopGPSSerialReader(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		sending bool // Whether the GPS keeps sending, or the reader is left blocked in a read.
+	}{
+		{"sending", true},
+		{"blocked in a read", false},
+	} {
+		resetGPSTestState()
+		globalSettings.GPS_Enabled = true
+		globalStatus.GPS_connected = true
+		gpsReaderStopTimeout = 200 * time.Millisecond
+
+		r, w := io.Pipe()
+		port := &pipePort{PipeReader: r, reading: make(chan struct{})}
+		startGPSSerialReader(port)
+		done := gpsReaderDone
+		if tt.sending {
+			go func() {
+				for {
+					if _, err := w.Write([]byte("$GPVTG,270.0,T,,M,10.0,N,18.5,K,A*05\r\n")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		<-port.reading
+
+		stopGPSSerialReader()
+		select {
+		case <-done:
+		default:
+			t.Fatalf("%s: stopGPSSerialReader() returned before the reader exited", tt.name)
+		}
+		if !port.closed {
+			t.Errorf("%s: port not closed", tt.name)
+		}
+		if gpsReaderQuit != nil || gpsReaderDone != nil || gpsReaderPort != nil {
+			t.Errorf("%s: reader state not cleared", tt.name)
+		}
+		w.Close()
+	}
+	gpsReaderStopTimeout = 10 * time.Second
+}
+
+func TestMagneticVariation(t *testing.T) {
+	for _, tt := range []struct {
+		v, ew string
+		want  float32
+		ok    bool
+	}{
+		{"003.1", "W", -3.1, true},
+		{"003.1", "E", 3.1, true},
+		{"012.0", "E", 12, true},
+		{"", "W", 0, false},
+		{"003.1", "", 0, false},
+		{"abc", "E", 0, false},
+	} {
+		got, ok := parseMagneticVariation(tt.v, tt.ew)
+		if ok != tt.ok || math.Abs(float64(got-tt.want)) > 1e-5 {
+			t.Errorf("parseMagneticVariation(%q, %q) = %v, %v, want %v, %v", tt.v, tt.ew, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	for _, tt := range []struct {
+		course, variation float32
+		valid             bool
+		want              float32
+	}{
+		{84.4, -3.1, true, 87.5},
+		{84.4, 3.1, true, 81.3},
+		{358, -3.1, true, 1.1},
+		{1, 3.1, true, 357.9},
+		{84.4, -3.1, false, 84.4},
+	} {
+		s := GPSSituationData{TrueCourse: tt.course, MagneticVariation: tt.variation, MagneticVariationValid: tt.valid}
+		updateMagneticCourse(&s)
+		if math.Abs(float64(s.MagneticCourse-tt.want)) > 1e-4 {
+			t.Errorf("updateMagneticCourse(%v, %v, %v): %v, want %v", tt.course, tt.variation, tt.valid, s.MagneticCourse, tt.want)
+		}
+	}
+
+	// The RMC example from test-data/gps/nmea-cases.nmea.
+	resetGPSTestState()
+	stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+	if !processNMEALine("$GPRMC,174506.00,A,3356.76600,S,15110.63200,E,022.4,084.4,161026,003.1,W*5D") {
+		t.Fatalf("valid RMC rejected")
+	}
+	if !mySituation.MagneticVariationValid || math.Abs(float64(mySituation.MagneticVariation+3.1)) > 1e-5 {
+		t.Errorf("RMC MagneticVariation %v (valid %v), want -3.1", mySituation.MagneticVariation, mySituation.MagneticVariationValid)
+	}
+	if math.Abs(float64(mySituation.MagneticCourse-87.5)) > 1e-4 {
+		t.Errorf("RMC MagneticCourse %v, want 87.5", mySituation.MagneticCourse)
+	}
+}
+
+// TestOutOfRangePositionRejected checks that a fix off the globe, or NaN, leaves the previous position alone.
+func TestOutOfRangePositionRejected(t *testing.T) {
+	resetGPSTestState()
+	stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+	if !processNMEALine("$GPGGA,174505.00,3356.76600,S,15110.63200,E,1,08,1.00,21.0,M,22.1,M,,*7F") {
+		t.Fatalf("valid GGA rejected")
+	}
+	want := mySituation.GPSSituationData
+	epoch, fixEpoch := gpsCurrentEpoch, lastFixEpoch
+
+	for _, tt := range []struct {
+		sentence   string
+		checkEpoch bool // GGA and GNS check the position before the fix time counts towards the epoch and fix rate.
+	}{
+		{"$GPGGA,174506.00,9156.76600,N,15110.63200,E,1,08,1.00,21.0,M,22.1,M,,*69", true},     // Latitude 91.9.
+		{"$GPGGA,174507.00,33NaN,S,15110.63200,E,1,08,1.00,21.0,M,22.1,M,,*06", true},          // NaN latitude.
+		{"$GNGNS,174508.00,3356.76600,S,181NaN,E,AANN,08,1.00,21.0,22.1,,,V*48", true},         // NaN longitude.
+		{"$GPRMC,174509.00,A,9956.76600,N,15110.63200,E,022.4,084.4,161026,003.1,W*4F", false}, // Latitude 99.9.
+	} {
+		stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+		if processNMEALine(tt.sentence) {
+			t.Errorf("%s: accepted", tt.sentence)
+		}
+		if mySituation.Lat != want.Lat || mySituation.Lng != want.Lng || mySituation.LastFixLocalTime != want.LastFixLocalTime {
+			t.Errorf("%s: position changed to %v, %v", tt.sentence, mySituation.Lat, mySituation.Lng)
+		}
+		if tt.checkEpoch && (gpsCurrentEpoch != epoch || lastFixEpoch != fixEpoch) {
+			t.Errorf("%s: epoch advanced to %v (fix rate epoch %v)", tt.sentence, gpsCurrentEpoch, lastFixEpoch)
+		}
+	}
+}
+
+// TestUBXDynModel checks the CFG-NAV5 dynModel, and that building the configuration (as the saved configuration
+// check does) doesn't log it.
+func TestUBXDynModel(t *testing.T) {
+	defer func(s string) { globalSettings.GPS_DynModel = s }(globalSettings.GPS_DynModel)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tt := range []struct {
+		setting string
+		want    byte
+	}{
+		{"", 0x07},
+		{"Airborne4g", 0x08},
+		{"Pedestrian", 0x03},
+		{"Warp", 0x07},
+	} {
+		globalSettings.GPS_DynModel = tt.setting
+		for _, m := range ubxConfigMessages() {
+			if m.class == 0x06 && m.id == 0x24 && m.payload[2] != tt.want {
+				t.Errorf("%q: dynModel %d, want %d", tt.setting, m.payload[2], tt.want)
+			}
+		}
+	}
+	if bytes.Contains(buf.Bytes(), []byte("dynamic")) {
+		t.Errorf("ubxConfigMessages() logged: %s", buf.String())
+	}
+}
+
+// TestGSTEnabled checks that a configured u-blox sends GST on UART1 and USB each fix, and that GST sets the accuracy.
+func TestGSTEnabled(t *testing.T) {
+	resetGPSTestState()
+	for _, m := range ubxMsgRates {
+		if m.name != "GST" {
+			continue
+		}
+		if got, want := ubxMsgRatePayload(m), []byte{0xF0, 0x07, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00}; !bytes.Equal(got, want) {
+			t.Errorf("GST CFG-MSG payload % X, want % X", got, want)
+		}
+	}
+
+	processNMEALines(time.Second,
+		"$GPGGA,174505.00,3356.76600,S,15110.63200,E,1,08,1.00,21.0,M,22.1,M,,*7F",
+		"$GPGST,174505.00,1.2,2.0,1.5,30,1.5,2.0,3.0*78")
+	if !isGSTRecent() || math.Abs(float64(mySituation.Accuracy)-5) > 0.01 || math.Abs(float64(mySituation.AccuracyVert)-6) > 0.01 {
+		t.Errorf("after GST: recent %v, accuracy %v m, vertical %v m, want true, 5 m, 6 m",
+			isGSTRecent(), mySituation.Accuracy, mySituation.AccuracyVert)
+	}
+}
+
+// TestFixTransitionLogged checks that fix transitions reach the log at the default log level.
+func TestFixTransitionLogged(t *testing.T) {
+	resetGPSTestState()
+	globalSettings.LogLevel = "warn"
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	mySituation.Quality = 1
+	gsaFixMode = 3
+	recordFixTransition()
+	if !bytes.Contains(buf.Bytes(), []byte("GPS fix: No Fix -> 3D")) {
+		t.Errorf("fix transition not logged: %q", buf.String())
+	}
+}
+
+// TestGroundTrackOneSamplePerFix sends RMC, VTG and PUBX,00 velocities for each 10 Hz fix. An 8 s track window must
+// still reach back 8 s.
+func TestGroundTrackOneSamplePerFix(t *testing.T) {
+	resetGPSTestState()
+	globalSettings.GPS_FilterWindows = map[string]float32{"track": 8}
+	globalSettings.GPS_TrackMinSpeed = 5
+
+	var s GPSSituationData
+	for i := 0; i < 100; i++ { // 10 s. North for the first 3 s, then east.
+		stratuxClock.Time = stratuxClock.Time.Add(100 * time.Millisecond)
+		s.LastFixSinceMidnightUTC = 64000 + float64(i)/10
+		course := 0.0
+		if i >= 30 {
+			course = 90
+		}
+		for j := 0; j < 3; j++ {
+			updateGroundTrack(&s, 50, course)
+		}
+	}
+	// The last 8 s, ends included: 11 fixes north and 70 east.
+	if want := degrees(math.Atan2(70, 11)); math.Abs(float64(s.TrueCourse)-want) > 0.5 {
+		t.Errorf("TrueCourse %.1f, want %.1f", s.TrueCourse, want)
+	}
+}
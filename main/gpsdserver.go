@@ -0,0 +1,303 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gpsdserver.go: gpsd-compatible JSON server (TPV and SKY reports) for standard gpsd clients.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gpsdPort        = 2947
+	gpsdClientQueue = 16 // Reports buffered per client. A client that falls this far behind is dropped.
+	gpsdDevice      = "stratux"
+)
+
+type gpsdClient struct {
+	conn     net.Conn
+	ch       chan []byte
+	watching bool // Sent ?WATCH={"enable":true}. Protected by gpsdClientsMutex.
+}
+
+var gpsdClientsMutex sync.Mutex
+var gpsdClients = make(map[*gpsdClient]bool) // Protected by gpsdClientsMutex.
+
+type gpsdTPV struct {
+	Class  string  `json:"class"`
+	Device string  `json:"device"`
+	Mode   int     `json:"mode"` // 1 no fix, 2 2D, 3 3D.
+	Time   string  `json:"time,omitempty"`
+	Ept    float64 `json:"ept,omitempty"`
+	Lat    float64 `json:"lat,omitempty"`
+	Lon    float64 `json:"lon,omitempty"`
+	Alt    float64 `json:"alt,omitempty"` // m, MSL.
+	AltHAE float64 `json:"altHAE,omitempty"`
+	Epx    float64 `json:"epx,omitempty"` // m, 95%.
+	Epy    float64 `json:"epy,omitempty"`
+	Epv    float64 `json:"epv,omitempty"`
+	Track  float64 `json:"track"`
+	Speed  float64 `json:"speed"` // m/s.
+	Climb  float64 `json:"climb"` // m/s.
+}
+
+type gpsdSatellite struct {
+	PRN  uint8 `json:"PRN"`
+	El   int16 `json:"el"`
+	Az   int16 `json:"az"`
+	Ss   int8  `json:"ss"`
+	Used bool  `json:"used"`
+}
+
+type gpsdSKY struct {
+	Class      string          `json:"class"`
+	Device     string          `json:"device"`
+	Hdop       float32         `json:"hdop,omitempty"`
+	Pdop       float32         `json:"pdop,omitempty"`
+	Satellites []gpsdSatellite `json:"satellites"`
+}
+
+// makeGPSDTPV snapshots mySituation as a gpsd TPV report.
+func makeGPSDTPV() gpsdTPV {
+	mySituation.mu_GPS.Lock()
+	defer mySituation.mu_GPS.Unlock()
+	tpv := gpsdTPV{Class: "TPV", Device: gpsdDevice, Mode: 1}
+	if !isGPSValid() {
+		return tpv
+	}
+	tpv.Mode = 3
+	if gsaFixMode == 2 {
+		tpv.Mode = 2
+	}
+	if isGPSClockValid() {
+		tpv.Time = mySituation.GPSTime.UTC().Format("2006-01-02T15:04:05.000Z")
+		tpv.Ept = 0.005
+	}
+	tpv.Lat = float64(mySituation.Lat)
+	tpv.Lon = float64(mySituation.Lng)
+	tpv.Alt = float64(mySituation.Alt) / 3.28084
+	tpv.AltHAE = float64(mySituation.HeightAboveEllipsoid) / 3.28084
+	tpv.Epx = float64(mySituation.Accuracy)
+	tpv.Epy = float64(mySituation.Accuracy)
+	tpv.Epv = float64(mySituation.AccuracyVert)
+	if isGPSGroundTrackValid() {
+		tpv.Track = float64(mySituation.TrueCourse)
+		tpv.Speed = float64(mySituation.GroundSpeedF) / 1.94384
+	}
+	tpv.Climb = float64(mySituation.GPSVertVel) / 3.28084
+	return tpv
+}
+
+// makeGPSDSKY snapshots the constellation as a gpsd SKY report.
+func makeGPSDSKY() gpsdSKY {
+	sky := gpsdSKY{Class: "SKY", Device: gpsdDevice, Satellites: make([]gpsdSatellite, 0)}
+	mySituation.mu_GPS.Lock()
+	sky.Hdop = mySituation.HDOP
+	sky.Pdop = mySituation.PDOP
+	mySituation.mu_GPS.Unlock()
+
+	satelliteMutex.Lock()
+	sats := make([]SatelliteInfo, 0, len(Satellites))
+	for _, sat := range Satellites {
+		sats = append(sats, sat)
+	}
+	satelliteMutex.Unlock()
+	sort.Sort(satellitesByNMEA(sats))
+	for _, sat := range sats {
+		s := gpsdSatellite{PRN: sat.SatelliteNMEA, El: sat.Elevation, Az: sat.Azimuth, Ss: sat.Signal, Used: sat.InSolution}
+		if s.Ss < 0 {
+			s.Ss = 0
+		}
+		sky.Satellites = append(sky.Satellites, s)
+	}
+	return sky
+}
+
+// gpsdSend queues a report for one client. A client whose queue is full is disconnected. Called with gpsdClientsMutex held.
+func gpsdSend(c *gpsdClient, msg []byte) {
+	select {
+	case c.ch <- msg:
+	default:
+		log.Printf("gpsd server: %s not keeping up, disconnecting.\n", c.conn.RemoteAddr())
+		delete(gpsdClients, c)
+		close(c.ch)
+	}
+}
+
+func gpsdMarshal(v interface{}) []byte {
+	j, _ := json.Marshal(v)
+	return append(j, '\r', '\n')
+}
+
+func gpsdVersion() []byte {
+	return gpsdMarshal(map[string]interface{}{"class": "VERSION", "release": "stratux-" + stratuxVersion, "rev": stratuxBuild,
+		"proto_major": 3, "proto_minor": 11})
+}
+
+func gpsdDevices() []byte {
+	return gpsdMarshal(map[string]interface{}{"class": "DEVICES",
+		"devices": []map[string]interface{}{{"class": "DEVICE", "path": gpsdDevice, "driver": globalStatus.GPS_detected_type}}})
+}
+
+/*
+	gpsdCommand().
+		Handles one command line from a client. Supports the subset of the gpsd protocol that clients use
+		 to get reports: ?WATCH (enable/disable), ?POLL, ?VERSION and ?DEVICES. Other commands get an ERROR.
+*/
+
+func gpsdCommand(c *gpsdClient, line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	cmd := strings.TrimSuffix(line, ";")
+	arg := ""
+	if i := strings.Index(cmd, "="); i >= 0 {
+		cmd, arg = cmd[:i], cmd[i+1:]
+	}
+
+	gpsdClientsMutex.Lock()
+	defer gpsdClientsMutex.Unlock()
+	if !gpsdClients[c] {
+		return
+	}
+	switch cmd {
+	case "?WATCH":
+		watch := struct {
+			Enable *bool `json:"enable"`
+		}{}
+		if arg != "" {
+			json.Unmarshal([]byte(arg), &watch)
+		}
+		c.watching = watch.Enable == nil || *watch.Enable
+		gpsdSend(c, gpsdDevices())
+		gpsdSend(c, gpsdMarshal(map[string]interface{}{"class": "WATCH", "enable": c.watching, "json": c.watching}))
+	case "?POLL":
+		gpsdSend(c, gpsdMarshal(map[string]interface{}{"class": "POLL", "time": time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+			"active": 1, "tpv": []gpsdTPV{makeGPSDTPV()}, "sky": []gpsdSKY{makeGPSDSKY()}}))
+	case "?VERSION":
+		gpsdSend(c, gpsdVersion())
+	case "?DEVICES":
+		gpsdSend(c, gpsdDevices())
+	default:
+		gpsdSend(c, gpsdMarshal(map[string]string{"class": "ERROR", "message": fmt.Sprintf("Unrecognized request '%s'", cmd)}))
+	}
+}
+
+func gpsdRemoveClient(c *gpsdClient) {
+	gpsdClientsMutex.Lock()
+	if gpsdClients[c] {
+		delete(gpsdClients, c)
+		close(c.ch)
+	}
+	gpsdClientsMutex.Unlock()
+}
+
+func gpsdClientWriter(c *gpsdClient) {
+	defer c.conn.Close()
+	for msg := range c.ch {
+		c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.conn.Write(msg); err != nil {
+			gpsdRemoveClient(c)
+			for range c.ch { // Drain until closed.
+			}
+			return
+		}
+	}
+}
+
+func gpsdClientReader(c *gpsdClient) {
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		gpsdCommand(c, scanner.Text())
+	}
+	gpsdRemoveClient(c)
+}
+
+func gpsdServerAccept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return // Listener closed.
+		}
+		log.Printf("gpsd server: client %s connected.\n", conn.RemoteAddr())
+		c := &gpsdClient{conn: conn, ch: make(chan []byte, gpsdClientQueue)}
+		gpsdClientsMutex.Lock()
+		gpsdClients[c] = true
+		gpsdSend(c, gpsdVersion())
+		gpsdClientsMutex.Unlock()
+		go gpsdClientWriter(c)
+		go gpsdClientReader(c)
+	}
+}
+
+/*
+	gpsdServer().
+		Listens on gpsdPort while globalSettings.GPSD_Enabled is set, following changes at runtime. Clients
+		 that have sent ?WATCH get a TPV and a SKY report every second, built from snapshots of mySituation
+		 and Satellites taken under their usual mutexes.
+*/
+
+func gpsdServer() {
+	var ln net.Listener
+	listenFailed := false
+	ticker := time.NewTicker(1 * time.Second)
+	for {
+		<-ticker.C
+		if ln != nil && !globalSettings.GPSD_Enabled {
+			ln.Close()
+			ln = nil
+			gpsdClientsMutex.Lock()
+			for c := range gpsdClients {
+				delete(gpsdClients, c)
+				close(c.ch)
+			}
+			gpsdClientsMutex.Unlock()
+			log.Printf("gpsd server: stopped.\n")
+		}
+		if ln == nil && globalSettings.GPSD_Enabled {
+			var err error
+			ln, err = net.Listen("tcp", fmt.Sprintf(":%d", gpsdPort))
+			if err != nil {
+				if !listenFailed {
+					log.Printf("gpsd server: can't listen on port %d: %s\n", gpsdPort, err.Error())
+					listenFailed = true
+				}
+				ln = nil
+				continue
+			}
+			listenFailed = false
+			log.Printf("gpsd server: listening on port %d.\n", gpsdPort)
+			go gpsdServerAccept(ln)
+		}
+		if ln == nil {
+			continue
+		}
+
+		tpv := gpsdMarshal(makeGPSDTPV())
+		sky := gpsdMarshal(makeGPSDSKY())
+		gpsdClientsMutex.Lock()
+		for c := range gpsdClients {
+			if c.watching {
+				gpsdSend(c, tpv)
+				if gpsdClients[c] {
+					gpsdSend(c, sky)
+				}
+			}
+		}
+		gpsdClientsMutex.Unlock()
+	}
+}
@@ -0,0 +1,71 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gpsnetwork.go: GPS input from an NMEA stream over TCP, in place of a serial receiver.
+*/
+
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	gpsNetworkMinBackoff  = 4 * time.Second
+	gpsNetworkMaxBackoff  = 60 * time.Second
+	gpsNetworkReadTimeout = 2500 * time.Millisecond // Same as the serial port, so gpsSerialReader() can notice 'quit'.
+)
+
+var gpsNetworkBackoff = gpsNetworkMinBackoff
+var gpsNetworkNextTry time.Time // stratuxClock time of the next connection attempt.
+
+// gpsNetworkConn gives a TCP connection the read behaviour of the serial port: a read with no data returns
+// after gpsNetworkReadTimeout with nothing, rather than blocking forever.
+type gpsNetworkConn struct {
+	net.Conn
+}
+
+func (c gpsNetworkConn) Read(p []byte) (int, error) {
+	c.SetReadDeadline(time.Now().Add(gpsNetworkReadTimeout))
+	n, err := c.Conn.Read(p)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return n, nil
+	}
+	return n, err
+}
+
+/*
+	openGPSNetwork().
+		Connects to the NMEA source at addr (host:port, globalSettings.GPS_Network_Source), for
+		 gpsSerialReader() to read in place of a serial port. Failed attempts back off from
+		 gpsNetworkMinBackoff to gpsNetworkMaxBackoff; nil is returned until the next attempt is due.
+		 When the source closes the connection the reader exits, GPS_connected drops, and pollGPS()
+		 comes back here to reconnect.
+*/
+
+func openGPSNetwork(addr string) *gpsNetworkConn {
+	if stratuxClock.Time.Before(gpsNetworkNextTry) {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		log.Printf("GPS: can't connect to network source %s: %s. Retrying in %s.\n", addr, err.Error(), gpsNetworkBackoff)
+		gpsNetworkNextTry = stratuxClock.Time.Add(gpsNetworkBackoff)
+		gpsNetworkBackoff *= 2
+		if gpsNetworkBackoff > gpsNetworkMaxBackoff {
+			gpsNetworkBackoff = gpsNetworkMaxBackoff
+		}
+		return nil
+	}
+	gpsNetworkBackoff = gpsNetworkMinBackoff
+	gpsIsUblox = false // Nothing to configure.
+	globalStatus.GPS_device = addr
+	globalStatus.GPS_detected_type = "network"
+	log.Printf("GPS: connected to network source %s\n", addr)
+	return &gpsNetworkConn{conn}
+}
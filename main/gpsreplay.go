@@ -0,0 +1,118 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gpsreplay.go: Replays a recorded GPS session (e.g. a GPS_RawLog capture) in place of the receiver,
+	 for reproducing parser problems without the hardware.
+*/
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const gpsReplayMaxPause = 5 * time.Second // Longest pause between fixes. Gaps in the recording are skipped.
+
+var gpsReplayFinished bool // Set at the end of a replay that doesn't loop, so pollGPS() doesn't start it again.
+
+// gpsReplay reads a recording line by line, pausing between fixes for as long as the fix times say.
+type gpsReplay struct {
+	f       *os.File
+	r       *bufio.Reader
+	loop    bool
+	lastFix float64
+	hasFix  bool
+	pending string // Rest of a line that didn't fit in the caller's buffer.
+}
+
+/*
+	openGPSReplay().
+		Opens the recording named by STRATUX_GPS_REPLAY, to be read by gpsSerialReader() in place of the
+		 serial port. Lines go through the same scanGPSFrames() / processNMEALine() path as live data, paced
+		 in real time using the fix times in the sentences. With STRATUX_GPS_REPLAY_LOOP=1 the recording
+		 starts over at the end, otherwise the GPS is disconnected and stays so.
+*/
+
+func openGPSReplay(path string) io.ReadCloser {
+	if gpsReplayFinished {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("GPS replay: %s\n", err.Error())
+		return nil
+	}
+	gpsIsUblox = false // Nothing to configure.
+	log.Printf("GPS: replaying %s\n", path)
+	return &gpsReplay{f: f, r: bufio.NewReader(f), loop: os.Getenv("STRATUX_GPS_REPLAY_LOOP") == "1"}
+}
+
+// nmeaFixTime returns the fix time (seconds since midnight UTC) of a position sentence.
+func nmeaFixTime(line string) (float64, bool) {
+	x := strings.Split(line, ",")
+	var t string
+	switch {
+	case len(x) > 2 && strings.HasSuffix(x[0], "GGA"), len(x) > 2 && strings.HasSuffix(x[0], "RMC"):
+		t = x[1]
+	case len(x) > 3 && x[0] == "$PUBX" && x[1] == "00":
+		t = x[2]
+	default:
+		return 0, false
+	}
+	hr, min, sec, ok := parseNMEATime(t)
+	if !ok {
+		return 0, false
+	}
+	return float64(3600*hr+60*min) + sec, true
+}
+
+func (g *gpsReplay) Read(p []byte) (int, error) {
+	if len(g.pending) > 0 {
+		n := copy(p, g.pending)
+		g.pending = g.pending[n:]
+		return n, nil
+	}
+	line, err := g.r.ReadString('\n')
+	if err == io.EOF && len(line) == 0 {
+		if !g.loop {
+			log.Printf("GPS replay: end of recording.\n")
+			gpsReplayFinished = true
+			return 0, io.EOF
+		}
+		if _, err := g.f.Seek(0, 0); err != nil {
+			return 0, err
+		}
+		g.r.Reset(g.f)
+		g.hasFix = false
+		return 0, nil
+	} else if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	if t, ok := nmeaFixTime(strings.TrimSpace(line)); ok {
+		if g.hasFix {
+			dt := time.Duration(fixTimeDelta(g.lastFix, t) * float64(time.Second))
+			if dt > 0 && dt <= gpsReplayMaxPause {
+				time.Sleep(dt)
+			}
+		}
+		g.lastFix = t
+		g.hasFix = true
+	}
+
+	n := copy(p, line)
+	g.pending = line[n:]
+	return n, nil
+}
+
+func (g *gpsReplay) Close() error {
+	return g.f.Close()
+}
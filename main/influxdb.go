@@ -0,0 +1,111 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	influxdb.go: Optional output of situation data as InfluxDB line protocol, for Grafana dashboards.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+	makeInfluxLine().
+		Formats the key SituationData fields as one InfluxDB line protocol point in the "situation"
+		 measurement. Fields from GPS, AHRS and the pressure sensor are only included while valid.
+*/
+
+func makeInfluxLine() string {
+	fields := make([]string, 0)
+
+	if isGPSValid() {
+		fields = append(fields,
+			fmt.Sprintf("lat=%f", mySituation.Lat),
+			fmt.Sprintf("lng=%f", mySituation.Lng),
+			fmt.Sprintf("alt=%f", mySituation.Alt),
+			fmt.Sprintf("speed=%di", mySituation.GroundSpeed),
+			fmt.Sprintf("course=%f", mySituation.TrueCourse),
+			fmt.Sprintf("nacp=%di", mySituation.NACp),
+			fmt.Sprintf("sats=%di", mySituation.Satellites),
+			fmt.Sprintf("hdop=%f", mySituation.HDOP),
+			fmt.Sprintf("pdop=%f", mySituation.PDOP))
+	}
+	if isAHRSValid() {
+		fields = append(fields,
+			fmt.Sprintf("pitch=%f", mySituation.Pitch),
+			fmt.Sprintf("roll=%f", mySituation.Roll))
+	}
+	if isTempPressValid() {
+		fields = append(fields,
+			fmt.Sprintf("temp=%f", mySituation.Temp),
+			fmt.Sprintf("pressure_alt=%f", mySituation.Pressure_alt))
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("situation %s %d\n", strings.Join(fields, ","), time.Now().UnixNano())
+}
+
+// influxClient is used for HTTP writes. The timeout stops an unresponsive server from stalling influxSender().
+var influxClient = &http.Client{Timeout: 5 * time.Second}
+
+// sendInfluxLine writes a point to globalSettings.Influx_URL, either "udp://host:port" or an HTTP write endpoint
+// such as "http://host:8086/write?db=stratux".
+func sendInfluxLine(line string) error {
+	u, err := url.Parse(globalSettings.Influx_URL)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "udp":
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte(line))
+		return err
+	case "http", "https":
+		resp, err := influxClient.Post(globalSettings.Influx_URL, "text/plain", bytes.NewBufferString(line))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("HTTP status %s", resp.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported scheme '%s'", u.Scheme)
+}
+
+func influxSender() {
+	for {
+		interval := globalSettings.Influx_Interval
+		if interval < 1 {
+			interval = 1
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		if !globalSettings.Influx_Enabled || len(globalSettings.Influx_URL) == 0 {
+			continue
+		}
+		line := makeInfluxLine()
+		if len(line) == 0 {
+			continue
+		}
+		if err := sendInfluxLine(line); err != nil {
+			logf(LOG_DEBUG, "InfluxDB output to %s: %s\n", globalSettings.Influx_URL, err.Error())
+		}
+	}
+}
@@ -0,0 +1,54 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	loglevel.go: Leveled logging, so that GPS/AHRS diagnostics can be enabled without per-satellite spam.
+*/
+
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+const (
+	LOG_ERROR = iota
+	LOG_WARN
+	LOG_INFO  // Connection and configuration events.
+	LOG_DEBUG // Same as the DEBUG setting.
+	LOG_TRACE // Per-sentence and per-satellite detail.
+)
+
+var logLevelNames = map[string]int{
+	"error": LOG_ERROR,
+	"warn":  LOG_WARN,
+	"info":  LOG_INFO,
+	"debug": LOG_DEBUG,
+	"trace": LOG_TRACE,
+}
+
+// logLevel returns the level set by globalSettings.LogLevel. DEBUG raises it to at least LOG_DEBUG.
+func logLevel() int {
+	level, ok := logLevelNames[strings.ToLower(globalSettings.LogLevel)]
+	if !ok {
+		level = LOG_WARN
+	}
+	if globalSettings.DEBUG && level < LOG_DEBUG {
+		level = LOG_DEBUG
+	}
+	return level
+}
+
+func logLevelEnabled(level int) bool {
+	return level <= logLevel()
+}
+
+// logf logs the message if level is enabled.
+func logf(level int, format string, v ...interface{}) {
+	if logLevelEnabled(level) {
+		log.Printf(format, v...)
+	}
+}
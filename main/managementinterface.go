@@ -176,6 +176,174 @@ func handleSatellitesRequest(w http.ResponseWriter, r *http.Request) {
 	satelliteMutex.Unlock()
 }
 
+// AJAX call - /getFixHistory. Responds with the recent changes of GPS fix type, oldest first.
+func handleFixHistoryRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	fixHistoryMutex.Lock()
+	historyJSON, err := json.Marshal(&fixHistory)
+	fixHistoryMutex.Unlock()
+	if err != nil {
+		log.Printf("Error sending fix history JSON data: %s\n", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", historyJSON)
+}
+
+// AJAX call - /getSNRTrend. Responds with the recent signal history of each satellite, and the average signal by elevation.
+func handleSNRTrendRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	satelliteMutex.Lock()
+	trend := struct {
+		History     map[string][]SNRSample
+		ByElevation []SNRElevationBin
+	}{satSNRHistory, getSNRByElevation()}
+	trendJSON, err := json.Marshal(&trend)
+	satelliteMutex.Unlock()
+	if err != nil {
+		log.Printf("Error sending SNR trend JSON data: %s\n", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", trendJSON)
+}
+
+// AJAX call - /setPressureAlt. Accepts {"Pressure_alt": ft, "QNH": hPa} from an external altimeter. QNH is optional.
+func handlePressureAltSetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		return
+	}
+	var msg struct {
+		Pressure_alt *float64
+		QNH          float64
+	}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || msg.Pressure_alt == nil {
+		http.Error(w, "expected {\"Pressure_alt\": ft}", http.StatusBadRequest)
+		return
+	}
+	if !setExternalPressureAlt(*msg.Pressure_alt, msg.QNH) {
+		http.Error(w, "external pressure altitude disabled or rejected", http.StatusConflict)
+	}
+}
+
+// AJAX call - /setAltimeter. Accepts {"AltimeterSetting": hPa or inHg} for IndicatedAlt.
+func handleAltimeterSetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		return
+	}
+	var msg struct {
+		AltimeterSetting *float64
+	}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || msg.AltimeterSetting == nil {
+		http.Error(w, "expected {\"AltimeterSetting\": hPa or inHg}", http.StatusBadRequest)
+		return
+	}
+	if !setAltimeterSetting(*msg.AltimeterSetting) {
+		http.Error(w, "altimeter setting out of range", http.StatusConflict)
+	}
+}
+
+// AJAX call - /setAirspeed. Accepts {"TAS": kt, "WindSpeed": kt} from an external air data source. WindSpeed is optional.
+func handleAirspeedSetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		return
+	}
+	var msg struct {
+		TAS       *float64
+		WindSpeed *float64
+	}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || msg.TAS == nil {
+		http.Error(w, "expected {\"TAS\": kt}", http.StatusBadRequest)
+		return
+	}
+	wind := -1.0
+	if msg.WindSpeed != nil {
+		wind = *msg.WindSpeed
+	}
+	if !setExternalAirspeed(*msg.TAS, wind) {
+		http.Error(w, "airspeed rejected", http.StatusConflict)
+	}
+}
+
+// AJAX call - /calibrateAHRS. Starts an IMU bias calibration. The aircraft must be stationary and level.
+// Progress is reported in the IMU_calibration status field.
+func handleAHRSCalibrateRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		return
+	}
+	if err := startIMUCalibration(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// AJAX call - /calibrateMag. {"Action": "start"} starts collecting magnetometer samples while the unit is rotated
+// through all orientations; {"Action": "finish"} fits and saves the calibration. Results are in the Mag_calibration
+// and Mag_calibration_spread status fields.
+func handleMagCalibrateRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		return
+	}
+	var msg struct {
+		Action string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "expected {\"Action\": \"start\"|\"finish\"}", http.StatusBadRequest)
+		return
+	}
+	var err error
+	switch msg.Action {
+	case "start":
+		err = startMagCalibration()
+	case "finish":
+		err = finishMagCalibration()
+	default:
+		http.Error(w, "expected {\"Action\": \"start\"|\"finish\"}", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// AJAX call - /resetGPS. {"Mode": "hot"|"warm"|"cold"|"factory"} restarts a u-blox receiver. See resetGPS().
+func handleGPSResetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		return
+	}
+	var msg struct {
+		Mode string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "expected {\"Mode\": \"hot\"|\"warm\"|\"cold\"|\"factory\"}", http.StatusBadRequest)
+		return
+	}
+	if err := resetGPS(msg.Mode); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// AJAX call - /clearGPSConfig. Erases the configuration saved in the u-blox receiver. See clearSavedGPSConfig().
+func handleGPSConfigClearRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		return
+	}
+	if err := clearSavedGPSConfig(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
 // AJAX call - /getSettings. Responds with all stratux.conf data.
 func handleSettingsGetRequest(w http.ResponseWriter, r *http.Request) {
 	setNoCache(w)
@@ -221,6 +389,8 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 						globalSettings.AHRS_Enabled = val.(bool)
 					case "DEBUG":
 						globalSettings.DEBUG = val.(bool)
+					case "LogLevel":
+						globalSettings.LogLevel = val.(string)
 					case "DisplayTrafficSource":
 						globalSettings.DisplayTrafficSource = val.(bool)
 					case "ReplayLog":
@@ -228,8 +398,155 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 						if v != globalSettings.ReplayLog { // Don't mark the files unless there is a change.
 							globalSettings.ReplayLog = v
 						}
+					case "GPS_RawLog":
+						globalSettings.GPS_RawLog = val.(bool)
+					case "GPS_GSVLogInterval":
+						globalSettings.GPS_GSVLogInterval = int(val.(float64))
 					case "PPM":
 						globalSettings.PPM = int(val.(float64))
+					case "MaxVertVel":
+						globalSettings.MaxVertVel = int(val.(float64))
+					case "GPS_FrozenFixTimeout":
+						globalSettings.GPS_FrozenFixTimeout = int(val.(float64))
+					case "GPS_FixAcquireTime":
+						globalSettings.GPS_FixAcquireTime = int(val.(float64))
+					case "GPS_FixHoldTime":
+						globalSettings.GPS_FixHoldTime = int(val.(float64))
+					case "GPS_FrozenFixInvalidate":
+						globalSettings.GPS_FrozenFixInvalidate = val.(bool)
+					case "GPS_AltitudeSource":
+						globalSettings.GPS_AltitudeSource = val.(string)
+					case "Influx_Enabled":
+						globalSettings.Influx_Enabled = val.(bool)
+					case "Influx_URL":
+						globalSettings.Influx_URL = val.(string)
+					case "Influx_Interval":
+						globalSettings.Influx_Interval = int(val.(float64))
+					case "TrackLog_Enabled":
+						globalSettings.TrackLog_Enabled = val.(bool)
+					case "TrackLog_KML":
+						globalSettings.TrackLog_KML = val.(bool)
+					case "TrackLog_Interval":
+						globalSettings.TrackLog_Interval = int(val.(float64))
+					case "GPS_AntennaOffsetFwd":
+						globalSettings.GPS_AntennaOffsetFwd = float32(val.(float64))
+					case "GPS_AntennaOffsetRight":
+						globalSettings.GPS_AntennaOffsetRight = float32(val.(float64))
+					case "GPS_AntennaOffsetUp":
+						globalSettings.GPS_AntennaOffsetUp = float32(val.(float64))
+					case "GPS_DisabledSentences":
+						disabled := make([]string, 0)
+						for _, sentence := range val.([]interface{}) {
+							disabled = append(disabled, sentence.(string))
+						}
+						globalSettings.GPS_DisabledSentences = disabled
+					case "GPS_MaxCourseSlewRate":
+						globalSettings.GPS_MaxCourseSlewRate = float32(val.(float64))
+					case "GPS_TrackMinSpeed":
+						globalSettings.GPS_TrackMinSpeed = float32(val.(float64))
+					case "ReportRawValues":
+						globalSettings.ReportRawValues = val.(bool)
+					case "GPS_TalkerPrecedence":
+						talkers := make([]string, 0)
+						for _, talker := range val.([]interface{}) {
+							talkers = append(talkers, talker.(string))
+						}
+						globalSettings.GPS_TalkerPrecedence = talkers
+					case "AHRS_AutoTrim":
+						globalSettings.AHRS_AutoTrim = val.(bool)
+					case "AHRS_AutoTrimTimeConstant":
+						globalSettings.AHRS_AutoTrimTimeConstant = int(val.(float64))
+					case "AHRS_Orientation":
+						globalSettings.AHRS_Orientation = val.(string)
+					case "AHRS_OrientationMatrix":
+						matrix := make([]float64, 0)
+						for _, v := range val.([]interface{}) {
+							matrix = append(matrix, v.(float64))
+						}
+						globalSettings.AHRS_OrientationMatrix = matrix
+					case "HeartbeatInterval":
+						globalSettings.HeartbeatInterval = int(val.(float64))
+					case "GPS_MinRangingSatellites":
+						globalSettings.GPS_MinRangingSatellites = int(val.(float64))
+					case "GPS_SBASMinSignal":
+						globalSettings.GPS_SBASMinSignal = int(val.(float64))
+					case "GPS_SBASMinElevation":
+						globalSettings.GPS_SBASMinElevation = int(val.(float64))
+					case "GPS_FilterWindows":
+						windows := make(map[string]float32)
+						for name, v := range val.(map[string]interface{}) {
+							windows[name] = float32(v.(float64))
+						}
+						globalSettings.GPS_FilterWindows = windows
+					case "DemoMode":
+						globalSettings.DemoMode = val.(bool)
+					case "GPS_RejectStaleEpochs":
+						globalSettings.GPS_RejectStaleEpochs = val.(bool)
+					case "GPS_MeasRate":
+						globalSettings.GPS_MeasRate = int(val.(float64))
+					case "GPS_NavRate":
+						globalSettings.GPS_NavRate = int(val.(float64))
+					case "GPS_TimeRef":
+						globalSettings.GPS_TimeRef = int(val.(float64))
+					case "AHRS_GlitchHoldTime":
+						globalSettings.AHRS_GlitchHoldTime = int(val.(float64))
+					case "ExternalPressure_Enabled":
+						globalSettings.ExternalPressure_Enabled = val.(bool)
+					case "AltimeterSetting":
+						setAltimeterSetting(val.(float64))
+					case "GPS_Constellations":
+						constellations := make([]string, 0)
+						for _, c := range val.([]interface{}) {
+							constellations = append(constellations, c.(string))
+						}
+						globalSettings.GPS_Constellations = constellations
+						go setGNSSConstellations()
+					case "GPS_DynModel":
+						globalSettings.GPS_DynModel = val.(string)
+					case "GPS_PreferHighRate":
+						if globalSettings.GPS_PreferHighRate != val.(bool) {
+							globalSettings.GPS_PreferHighRate = val.(bool)
+							go setGPSHighRate()
+						}
+					case "GPS_DisconnectGrace":
+						globalSettings.GPS_DisconnectGrace = int(val.(float64))
+					case "OwnshipVelocity":
+						globalSettings.OwnshipVelocity = val.(bool)
+					case "GPS_NavPVT":
+						globalSettings.GPS_NavPVT = val.(bool)
+					case "GPS_Device":
+						globalSettings.GPS_Device = val.(string)
+					case "GPS_Baud":
+						globalSettings.GPS_Baud = int(val.(float64))
+					case "GPS_PowerSave":
+						globalSettings.GPS_PowerSave = val.(bool)
+					case "GPS_SaveConfig":
+						globalSettings.GPS_SaveConfig = val.(bool)
+					case "NMEA_SynthesizedGSV":
+						globalSettings.NMEA_SynthesizedGSV = val.(bool)
+					case "NMEAServer_Enabled":
+						globalSettings.NMEAServer_Enabled = val.(bool)
+					case "NMEAServer_Port":
+						globalSettings.NMEAServer_Port = int(val.(float64))
+					case "NMEA_FLARMOwnship":
+						globalSettings.NMEA_FLARMOwnship = val.(bool)
+					case "NMEA_AltitudeSource":
+						globalSettings.NMEA_AltitudeSource = val.(string)
+					case "GPSD_Enabled":
+						globalSettings.GPSD_Enabled = val.(bool)
+					case "GPS_Set_System_Time":
+						globalSettings.GPS_Set_System_Time = val.(bool)
+					case "GPS_ClockSetThreshold":
+						globalSettings.GPS_ClockSetThreshold = val.(float64)
+					case "GPS_ClockSetInterval":
+						globalSettings.GPS_ClockSetInterval = int(val.(float64))
+					case "GPS_Network_Source":
+						if globalSettings.GPS_Network_Source != val.(string) {
+							globalSettings.GPS_Network_Source = val.(string)
+							globalStatus.GPS_connected = false // Reconnect to the new source.
+						}
+					case "GPS_NACpHysteresis":
+						globalSettings.GPS_NACpHysteresis = float32(val.(float64))
 					case "WatchList":
 						globalSettings.WatchList = val.(string)
 					case "OwnshipModeS":
@@ -248,6 +565,14 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 							continue
 						}
 						globalSettings.OwnshipModeS = fmt.Sprintf("%02X%02X%02X", hexn[0], hexn[1], hexn[2])
+					case "OwnshipCallsign":
+						// GDL90 allows up to 8 characters: digits, upper case letters and space.
+						vals := strings.ToUpper(strings.TrimSpace(val.(string)))
+						if len(vals) > 8 || strings.Trim(vals, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 ") != "" {
+							log.Printf("handleSettingsSetRequest:OwnshipCallsign: invalid callsign '%s'\n", val.(string))
+							continue
+						}
+						globalSettings.OwnshipCallsign = vals
 					default:
 						log.Printf("handleSettingsSetRequest:json: unrecognized key:%s\n", key)
 					}
@@ -476,8 +801,17 @@ func managementInterface() {
 	http.HandleFunc("/getSituation", handleSituationRequest)
 	http.HandleFunc("/getTowers", handleTowersRequest)
 	http.HandleFunc("/getSatellites", handleSatellitesRequest)
+	http.HandleFunc("/getSNRTrend", handleSNRTrendRequest)
+	http.HandleFunc("/getFixHistory", handleFixHistoryRequest)
 	http.HandleFunc("/getSettings", handleSettingsGetRequest)
 	http.HandleFunc("/setSettings", handleSettingsSetRequest)
+	http.HandleFunc("/setPressureAlt", handlePressureAltSetRequest)
+	http.HandleFunc("/setAirspeed", handleAirspeedSetRequest)
+	http.HandleFunc("/setAltimeter", handleAltimeterSetRequest)
+	http.HandleFunc("/calibrateAHRS", handleAHRSCalibrateRequest)
+	http.HandleFunc("/calibrateMag", handleMagCalibrateRequest)
+	http.HandleFunc("/resetGPS", handleGPSResetRequest)
+	http.HandleFunc("/clearGPSConfig", handleGPSConfigClearRequest)
 	http.HandleFunc("/shutdown", handleShutdownRequest)
 	http.HandleFunc("/reboot", handleRebootRequest)
 	http.HandleFunc("/getClients", handleClientsGetRequest)
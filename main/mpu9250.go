@@ -1,9 +1,14 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,7 +23,59 @@ var magXcal, magYcal, magZcal float64
 
 var i2cbus embd.I2CBus
 
+// The Pi's I2C bus clock is set from the device tree at boot, by dtparam=i2c_arm_baudrate (or its old name
+// i2c1_baudrate) in /boot/config.txt, and can't be changed while running. The Stratux image sets 400 kHz; a stock
+// Pi runs at 100 kHz.
+const bootConfigFile = "/boot/config.txt"
+const i2cClockFrequency = "/sys/class/i2c-adapter/i2c-1/of_node/clock-frequency" // Big endian uint32, Hz.
+
+// setI2CBaudrate returns config (the contents of bootConfigFile) with the I2C bus clock set to hz, and whether
+// that changed anything.
+func setI2CBaudrate(config string, hz int) (string, bool) {
+	lines := strings.Split(config, "\n")
+	found, changed := false, false
+	for i, l := range lines {
+		for _, param := range []string{"dtparam=i2c_arm_baudrate=", "dtparam=i2c1_baudrate="} {
+			if !strings.HasPrefix(strings.TrimSpace(l), param) {
+				continue
+			}
+			found = true
+			if want := param + strconv.Itoa(hz); strings.TrimSpace(l) != want {
+				lines[i] = want
+				changed = true
+			}
+		}
+	}
+	if found {
+		return strings.Join(lines, "\n"), changed
+	}
+	if config != "" && !strings.HasSuffix(config, "\n") {
+		config += "\n"
+	}
+	return config + "dtparam=i2c_arm_baudrate=" + strconv.Itoa(hz) + "\n", true
+}
+
 func initI2C() error {
+	if globalSettings.I2C_Speed > 0 {
+		// Slowing the bus down helps on long runs or with several devices attached. It takes effect at the next boot.
+		if buf, err := ioutil.ReadFile(bootConfigFile); err != nil {
+			log.Printf("initI2C(): couldn't read %s: %s\n", bootConfigFile, err.Error())
+		} else if config, changed := setI2CBaudrate(string(buf), globalSettings.I2C_Speed); changed {
+			// Written to a temporary file and renamed, so that a power loss can't leave a truncated config.txt.
+			err := ioutil.WriteFile(bootConfigFile+".tmp", []byte(config), 0644)
+			if err == nil {
+				err = os.Rename(bootConfigFile+".tmp", bootConfigFile)
+			}
+			if err != nil {
+				log.Printf("initI2C(): couldn't set I2C bus speed to %d Hz in %s: %s\n", globalSettings.I2C_Speed, bootConfigFile, err.Error())
+			} else {
+				log.Printf("I2C bus speed set to %d Hz in %s. Reboot to apply.\n", globalSettings.I2C_Speed, bootConfigFile)
+			}
+		}
+	}
+	if buf, err := ioutil.ReadFile(i2cClockFrequency); err == nil && len(buf) == 4 {
+		log.Printf("I2C bus speed: %d Hz\n", binary.BigEndian.Uint32(buf))
+	}
 	i2cbus = embd.NewI2CBus(1) //TODO: error checking.
 	return nil
 }
@@ -74,8 +131,25 @@ func initMPU9250() {
 	globalSettings.AHRS_Enabled = true
 	mySituation.mu_Attitude = &sync.Mutex{}
 
-	//TODO: Calibration.
+	configureMPU9250()
+
+	hardwareSelfTest()
+
+	if !globalStatus.Magnetometer_connected {
+		log.Printf("magnetometer is offline.\n")
+		return
+	}
 
+	imuReaderQuit = make(chan struct{})
+	lastIMURestartTime = stratuxClock.Time
+	go readRawData(imuReaderQuit)
+	go calculateAttitude()
+	go imuWatchdog()
+	//go calculateHeading()
+}
+
+func configureMPU9250() {
+	//TODO: Calibration.
 	setSetting(0x6B, 0x80) // Reset.
 	time.Sleep(100 * time.Millisecond)
 	setSetting(0x6B, 0x01) // Clock source.
@@ -103,67 +177,477 @@ func initMPU9250() {
 	setSetting(0x1B, 0x00) // Set gyro sensitivity to 250dps.
 	setSetting(0x1C, 0x00) // Set accelerometer scale to +/- 2G.
 	setSetting(0x1D, 0x02) // Set Accel 1000 Hz sample rate.
+}
 
-	if !checkMagConnection() {
-		log.Printf("magnetometer is offline.\n")
+var imuStillSince time.Time // stratuxClock time since which the IMU has shown no rotation or acceleration.
+
+const (
+	imuStillRate  = 2.0  // deg/s. Below this on all axes counts as no rotation.
+	imuStillAccel = 0.05 // g. Total acceleration within this of 1 g counts as unaccelerated.
+	imuStillTime  = 3 * time.Second
+)
+
+// updateIMUStationary tracks whether the IMU has been still (no rotation, 1 g total acceleration) for imuStillTime.
+// Takes gyro rates in deg/s and accelerations in g.
+func updateIMUStationary(gx, gy, gz, ax, ay, az float64) {
+	still := math.Abs(gx) < imuStillRate && math.Abs(gy) < imuStillRate && math.Abs(gz) < imuStillRate &&
+		math.Abs(math.Sqrt(ax*ax+ay*ay+az*az)-1.0) < imuStillAccel
+	if !still || imuStillSince.IsZero() {
+		imuStillSince = stratuxClock.Time
+	}
+	mySituation.AHRSStationary = still && stratuxClock.Since(imuStillSince) >= imuStillTime
+}
+
+/*
+	IMU mounting orientation.
+		Each matrix rotates a vector from the sensor's axes to the aircraft's axes, where "FlatForward" (the
+		 identity) is the board lying flat, component side up, with its X axis towards the nose. Set with
+		 globalSettings.AHRS_Orientation, or "Custom" for a row-major 3x3 matrix in AHRS_OrientationMatrix.
+*/
+
+var imuOrientations = map[string][3][3]float64{
+	"FlatForward":  {{1, 0, 0}, {0, 1, 0}, {0, 0, 1}},
+	"FlatBackward": {{-1, 0, 0}, {0, -1, 0}, {0, 0, 1}}, // Yawed 180 degrees.
+	"FlatLeft":     {{0, -1, 0}, {1, 0, 0}, {0, 0, 1}},  // Yawed 90 degrees, X axis towards the left wing.
+	"FlatRight":    {{0, 1, 0}, {-1, 0, 0}, {0, 0, 1}},  // Yawed 90 degrees, X axis towards the right wing.
+	"UpsideDown":   {{1, 0, 0}, {0, -1, 0}, {0, 0, -1}}, // Rolled 180 degrees, X axis still towards the nose.
+	"EdgeLeft":     {{1, 0, 0}, {0, 0, -1}, {0, 1, 0}},  // Rolled 90 degrees onto its left edge.
+	"EdgeRight":    {{1, 0, 0}, {0, 0, 1}, {0, -1, 0}},  // Rolled 90 degrees onto its right edge.
+	"Vertical":     {{0, 0, 1}, {0, 1, 0}, {-1, 0, 0}},  // Pitched 90 degrees, standing on its back edge (e.g. on a panel).
+}
+
+// imuOrientationMatrix returns the sensor-to-aircraft rotation for the configured mounting. Unknown names are the identity.
+func imuOrientationMatrix() [3][3]float64 {
+	if globalSettings.AHRS_Orientation == "Custom" && len(globalSettings.AHRS_OrientationMatrix) == 9 {
+		var m [3][3]float64
+		for i, v := range globalSettings.AHRS_OrientationMatrix {
+			m[i/3][i%3] = v
+		}
+		return m
+	}
+	if m, ok := imuOrientations[globalSettings.AHRS_Orientation]; ok {
+		return m
+	}
+	return imuOrientations["FlatForward"]
+}
+
+// rotateIMUVector applies the orientation matrix m to a sensor vector.
+func rotateIMUVector(m [3][3]float64, x, y, z float64) (float64, float64, float64) {
+	return m[0][0]*x + m[0][1]*y + m[0][2]*z,
+		m[1][0]*x + m[1][1]*y + m[1][2]*z,
+		m[2][0]*x + m[2][1]*y + m[2][2]*z
+}
+
+/*
+	IMU bias calibration.
+		startIMUCalibration() averages the gyro and accelerometer over imuCalibrationTime while the aircraft
+		 sits still and level. The averages, less 1 g straight down, are the biases. They're saved to the
+		 settings file (AHRS_GyroBias, AHRS_AccelBias) and subtracted from every sample by readRawData().
+		 Progress is in globalStatus.IMU_calibration.
+*/
+
+const (
+	imuCalibrationTime     = 5 * time.Second
+	imuCalibrationMaxTilt  = 0.1 // g of horizontal acceleration. About 6 degrees off level.
+	imuCalibrationMaxRate  = 2.0 // deg/s deviation of a gyro sample from the running average.
+	imuCalibrationMaxAccel = 0.05
+)
+
+var imuCalMutex sync.Mutex
+var imuCalibrating bool
+var imuCalSum [6]float64 // gx, gy, gz (deg/s), ax, ay, az (g).
+var imuCalCount int
+var imuCalStart time.Time
+
+// startIMUCalibration starts a bias calibration. The aircraft must be stationary and level until it completes.
+func startIMUCalibration() error {
+	if stratuxClock.Since(lastIMUReadTime) > 1*time.Second {
+		return fmt.Errorf("no IMU data")
+	}
+	if !mySituation.AHRSStationary {
+		return fmt.Errorf("aircraft is not stationary")
+	}
+	imuCalMutex.Lock()
+	defer imuCalMutex.Unlock()
+	imuCalSum = [6]float64{}
+	imuCalCount = 0
+	imuCalStart = stratuxClock.Time
+	imuCalibrating = true
+	globalStatus.IMU_calibration = "running"
+	log.Printf("IMU calibration started.\n")
+	return nil
+}
+
+// endIMUCalibration stops a calibration with the given status. Called with imuCalMutex held.
+func endIMUCalibration(status string) {
+	imuCalibrating = false
+	globalStatus.IMU_calibration = status
+	log.Printf("IMU calibration %s.\n", status)
+}
+
+// calibrateIMUSample adds a sample to a running calibration. Rates in deg/s, accelerations in g, both without bias correction.
+func calibrateIMUSample(gx, gy, gz, ax, ay, az float64) {
+	imuCalMutex.Lock()
+	defer imuCalMutex.Unlock()
+	if !imuCalibrating {
+		return
+	}
+	sample := [6]float64{gx, gy, gz, ax, ay, az}
+	if imuCalCount >= 10 {
+		for i, v := range sample {
+			limit := imuCalibrationMaxRate
+			if i >= 3 {
+				limit = imuCalibrationMaxAccel
+			}
+			if math.Abs(v-imuCalSum[i]/float64(imuCalCount)) > limit {
+				endIMUCalibration("failed: aircraft moved")
+				return
+			}
+		}
+	}
+	for i, v := range sample {
+		imuCalSum[i] += v
+	}
+	imuCalCount++
+	if stratuxClock.Since(imuCalStart) < imuCalibrationTime {
 		return
 	}
 
-	go readRawData()
-	go calculateAttitude()
-	//go calculateHeading()
+	var mean [6]float64
+	for i := range mean {
+		mean[i] = imuCalSum[i] / float64(imuCalCount)
+	}
+	if math.Sqrt(mean[3]*mean[3]+mean[4]*mean[4]) > imuCalibrationMaxTilt {
+		endIMUCalibration("failed: not level")
+		return
+	}
+	globalSettings.AHRS_GyroBias = []float64{mean[0], mean[1], mean[2]}
+	globalSettings.AHRS_AccelBias = []float64{mean[3], mean[4], mean[5] - 1.0}
+	go saveSettings()
+	endIMUCalibration("complete")
 }
 
-func readRawData() {
-	timer := time.NewTicker(2 * time.Millisecond)
+// removeIMUBias subtracts the calibrated biases from a sample. Rates in deg/s, accelerations in g.
+func removeIMUBias(gx, gy, gz, ax, ay, az float64) (float64, float64, float64, float64, float64, float64) {
+	if b := globalSettings.AHRS_GyroBias; len(b) == 3 {
+		gx, gy, gz = gx-b[0], gy-b[1], gz-b[2]
+	}
+	if b := globalSettings.AHRS_AccelBias; len(b) == 3 {
+		ax, ay, az = ax-b[0], ay-b[1], az-b[2]
+	}
+	return gx, gy, gz, ax, ay, az
+}
+
+/*
+	Magnetometer calibration.
+		startMagCalibration() starts collecting magnetometer samples while the unit is slowly rotated through
+		 all orientations. finishMagCalibration() fits a hard-iron offset (centre of the min/max box on each
+		 axis) and a soft-iron scale (axis radius relative to the mean radius), saves them to AHRS_MagOffset
+		 and AHRS_MagScale, and reports a quality figure: the spread of the corrected field strength over all
+		 samples, as a percentage of its mean. Below about 5% is good; above magCalibrationMaxSpread the
+		 calibration is rejected. readRawData() applies the calibration before AHRSupdate().
+*/
+
+const (
+	magCalibrationMaxSamples = 5000
+	magCalibrationDecimation = 10   // Keep one magnetometer sample in this many.
+	magCalibrationMaxSpread  = 15.0 // Percent.
+)
+
+var magCalMutex sync.Mutex
+var magCalibrating bool
+var magCalSamples [][3]float64
+var magCalCount int
+
+// startMagCalibration starts collecting magnetometer samples, discarding any from a previous attempt.
+func startMagCalibration() error {
+	if stratuxClock.Since(lastIMUReadTime) > 1*time.Second {
+		return fmt.Errorf("no IMU data")
+	}
+	magCalMutex.Lock()
+	defer magCalMutex.Unlock()
+	magCalSamples = make([][3]float64, 0, magCalibrationMaxSamples)
+	magCalCount = 0
+	magCalibrating = true
+	globalStatus.Mag_calibration = "running"
+	log.Printf("Magnetometer calibration started.\n")
+	return nil
+}
+
+// magCalibrationSample adds an uncalibrated magnetometer sample to a running calibration.
+func magCalibrationSample(mx, my, mz float64) {
+	magCalMutex.Lock()
+	defer magCalMutex.Unlock()
+	if !magCalibrating || len(magCalSamples) >= magCalibrationMaxSamples {
+		return
+	}
+	magCalCount++
+	if magCalCount%magCalibrationDecimation == 0 {
+		magCalSamples = append(magCalSamples, [3]float64{mx, my, mz})
+	}
+}
+
+// finishMagCalibration ends sample collection and fits and saves the calibration, if it is good enough.
+func finishMagCalibration() error {
+	magCalMutex.Lock()
+	defer magCalMutex.Unlock()
+	if !magCalibrating {
+		return fmt.Errorf("magnetometer calibration not running")
+	}
+	magCalibrating = false
+	fail := func(err error) error {
+		globalStatus.Mag_calibration = "failed: " + err.Error()
+		log.Printf("Magnetometer calibration %s.\n", globalStatus.Mag_calibration)
+		return err
+	}
+	if len(magCalSamples) < 100 {
+		return fail(fmt.Errorf("too few samples"))
+	}
+
+	minV, maxV := magCalSamples[0], magCalSamples[0]
+	for _, m := range magCalSamples {
+		for i := 0; i < 3; i++ {
+			minV[i] = math.Min(minV[i], m[i])
+			maxV[i] = math.Max(maxV[i], m[i])
+		}
+	}
+	var offset, radius [3]float64
+	for i := 0; i < 3; i++ {
+		offset[i] = (maxV[i] + minV[i]) / 2
+		radius[i] = (maxV[i] - minV[i]) / 2
+		if radius[i] <= 0 {
+			return fail(fmt.Errorf("not rotated on all axes"))
+		}
+	}
+	meanRadius := (radius[0] + radius[1] + radius[2]) / 3
+	var scale [3]float64
+	for i := 0; i < 3; i++ {
+		if radius[i] < meanRadius/2 {
+			return fail(fmt.Errorf("not rotated on all axes"))
+		}
+		scale[i] = meanRadius / radius[i]
+	}
+
+	// Quality: spread of the corrected field strength.
+	field := make([]float64, len(magCalSamples))
+	for j, m := range magCalSamples {
+		x, y, z := (m[0]-offset[0])*scale[0], (m[1]-offset[1])*scale[1], (m[2]-offset[2])*scale[2]
+		field[j] = math.Sqrt(x*x + y*y + z*z)
+	}
+	fieldMean, _ := mean(field)
+	fieldStdev, _ := stdev(field)
+	spread := 100 * fieldStdev / fieldMean
+	globalStatus.Mag_calibration_spread = spread
+	if spread > magCalibrationMaxSpread {
+		return fail(fmt.Errorf("field strength spread %.1f%%", spread))
+	}
+
+	globalSettings.AHRS_MagOffset = []float64{offset[0], offset[1], offset[2]}
+	globalSettings.AHRS_MagScale = []float64{scale[0], scale[1], scale[2]}
+	go saveSettings()
+	globalStatus.Mag_calibration = "complete"
+	log.Printf("Magnetometer calibration complete. Offset %v, scale %v, spread %.1f%%.\n", offset, scale, spread)
+	return nil
+}
+
+// applyMagCalibration removes the hard-iron offset and soft-iron scale from a magnetometer sample.
+func applyMagCalibration(mx, my, mz float64) (float64, float64, float64) {
+	if o := globalSettings.AHRS_MagOffset; len(o) == 3 {
+		mx, my, mz = mx-o[0], my-o[1], mz-o[2]
+	}
+	if k := globalSettings.AHRS_MagScale; len(k) == 3 {
+		mx, my, mz = mx*k[0], my*k[1], mz*k[2]
+	}
+	return mx, my, mz
+}
+
+// Low-pass filtered IMU values for the AHRS report (see attitudeReaderSender()). Updated by readRawData().
+var imuYawRate float64 // deg/s, gyro Z.
+var imuAccelY float64  // g, lateral.
+var imuAccelZ float64  // g, vertical.
+var imuGLoad float64   // g, magnitude of the acceleration vector.
+
+const imuReportFilter = 0.02 // Low-pass coefficient per sample. ~0.1 s time constant at 500 Hz.
+
+// filterIMUReportValues low-pass filters the raw gyro Z rate (deg/s) and accelerations (g) used for the AHRS report.
+func filterIMUReportValues(gz, ax, ay, az float64) {
+	imuYawRate += imuReportFilter * (gz - imuYawRate)
+	imuAccelY += imuReportFilter * (ay - imuAccelY)
+	imuAccelZ += imuReportFilter * (az - imuAccelZ)
+	imuGLoad += imuReportFilter * (math.Sqrt(ax*ax+ay*ay+az*az) - imuGLoad)
+}
+
+// imuReaderQuit tells the current readRawData() goroutine to exit. A reader that is stuck in an I2C
+// transaction sees it as soon as the transaction returns, so an abandoned reader doesn't race its replacement.
+var imuReaderQuit chan struct{}
+var lastIMUReadTime time.Time    // stratuxClock time of the last complete IMU sample. Only readRawData() (and demo mode) sets it.
+var lastIMURestartTime time.Time // stratuxClock time the current IMU reader was started.
+var imuReadErrors int            // Consecutive IMU samples dropped because of read errors.
+
+// imuStallTime is how long imuWatchdog() waits for a sample, from the last one or from starting the reader, before
+// restarting the reader. It is also the longest AHRS_GlitchHoldTime isAHRSValid() honours.
+const imuStallTime = 2 * time.Second
+
+// imuReaderStalled reports whether the IMU reader should be restarted, and if so records the restart time. A new
+// reader gets imuStallTime to deliver its first sample. lastIMUReadTime is left alone, so that a restart doesn't
+// make the frozen attitude look valid again.
+func imuReaderStalled() bool {
+	if stratuxClock.Since(lastIMUReadTime) < imuStallTime || stratuxClock.Since(lastIMURestartTime) < imuStallTime {
+		return false
+	}
+	lastIMURestartTime = stratuxClock.Time
+	return true
+}
 
+/*
+	imuWatchdog().
+		An I2C fault can leave readRawData() blocked in a read, and the embd calls can't be given a
+		 timeout, so the attitude silently freezes. If no IMU sample has been read for imuStallTime,
+		 abandon the stuck reader, reconfigure the MPU9250 and start a new reader.
+*/
+
+func imuWatchdog() {
+	timer := time.NewTicker(1 * time.Second)
 	for {
 		<-timer.C
+		if !imuReaderStalled() {
+			continue
+		}
+		log.Printf("IMU reader stalled (no sample for %s). Restarting AHRS.\n", stratuxClock.Since(lastIMUReadTime))
+		close(imuReaderQuit)
+		imuReaderQuit = make(chan struct{})
+		go func(quit chan struct{}) {
+			configureMPU9250()
+			readRawData(quit)
+		}(imuReaderQuit)
+	}
+}
+
+/*
+	readRawData().
+		Reads the MPU9250 every 2 ms until quit is closed, and feeds each sample to AHRSupdate(). This is the
+		 only place the raw IMU samples are seen, so everything done per sample is done here rather than in
+		 attitudeReaderSender: rotation to the aircraft frame, bias removal, and the filtered yaw rate,
+		 slip/skid and G load that attitudeReaderSender reports.
+*/
+
+func readRawData(quit chan struct{}) {
+	timer := time.NewTicker(2 * time.Millisecond)
+	defer timer.Stop()
+
+	// A sample with any failed register read is dropped, and the AHRS holds its last good attitude. See isAHRSValid().
+	sampleOK := true
+	check := func(err error) {
+		if err != nil {
+			sampleOK = false
+			chkErr(err)
+		}
+	}
+
+	// Every bus access checks quit first. A reader abandoned by imuWatchdog() then stops touching the bus
+	//  as soon as its stuck transaction returns, instead of racing configureMPU9250() in its replacement.
+	quitting := func() bool {
+		select {
+		case <-quit:
+			return true
+		default:
+			return false
+		}
+	}
+	readWord := func(reg byte) uint16 {
+		if quitting() {
+			sampleOK = false
+			return 0
+		}
+		v, err := i2cbus.ReadWordFromReg(0x68, reg)
+		check(err)
+		return v
+	}
+	readByte := func(reg byte) byte {
+		if quitting() {
+			sampleOK = false
+			return 0
+		}
+		v, err := i2cbus.ReadByteFromReg(0x68, reg)
+		check(err)
+		return v
+	}
+	writeSetting := func(reg, val byte) {
+		if !quitting() {
+			setSetting(reg, val)
+		}
+	}
+
+	for {
+		select {
+		case <-quit:
+			log.Printf("IMU reader exiting.\n")
+			return
+		case <-timer.C:
+		}
+		sampleOK = true
 		// Get accelerometer data.
-		x_acc, err := i2cbus.ReadWordFromReg(0x68, 0x3B)
-		chkErr(err)
-		y_acc, err := i2cbus.ReadWordFromReg(0x68, 0x3D)
-		chkErr(err)
-		z_acc, err := i2cbus.ReadWordFromReg(0x68, 0x3F)
+		x_acc := readWord(0x3B)
+		y_acc := readWord(0x3D)
+		z_acc := readWord(0x3F)
 
 		// currently manually setting resolution
-		x_acc_f := float64(int16(x_acc)) * 0.00006103515625
-		y_acc_f := float64(int16(y_acc)) * 0.00006103515625
-		z_acc_f := float64(int16(z_acc)) * 0.00006103515625
+		orientation := imuOrientationMatrix()
+		x_acc_f, y_acc_f, z_acc_f := rotateIMUVector(orientation,
+			float64(int16(x_acc))*0.00006103515625, float64(int16(y_acc))*0.00006103515625, float64(int16(z_acc))*0.00006103515625)
 
 		// Get gyro data.
-		x_gyro, err := i2cbus.ReadWordFromReg(0x68, 0x43)
-		chkErr(err)
-		y_gyro, err := i2cbus.ReadWordFromReg(0x68, 0x45)
-		chkErr(err)
-		z_gyro, err := i2cbus.ReadWordFromReg(0x68, 0x47)
+		x_gyro := readWord(0x43)
+		y_gyro := readWord(0x45)
+		z_gyro := readWord(0x47)
 
-		x_gyro_f := float64(int16(x_gyro)) * math.Pi / 131.0
-		y_gyro_f := float64(int16(y_gyro)) * math.Pi / 131.0
-		z_gyro_f := float64(int16(z_gyro)) * math.Pi / 131.0
+		x_gyro_r, y_gyro_r, z_gyro_r := rotateIMUVector(orientation, float64(int16(x_gyro))/131.0, float64(int16(y_gyro))/131.0, float64(int16(z_gyro))/131.0) // deg/s
+		calibrateIMUSample(x_gyro_r, y_gyro_r, z_gyro_r, x_acc_f, y_acc_f, z_acc_f)
+		x_gyro_r, y_gyro_r, z_gyro_r, x_acc_f, y_acc_f, z_acc_f = removeIMUBias(x_gyro_r, y_gyro_r, z_gyro_r, x_acc_f, y_acc_f, z_acc_f)
+		x_gyro_f := x_gyro_r * math.Pi
+		y_gyro_f := y_gyro_r * math.Pi
+		z_gyro_f := z_gyro_r * math.Pi
 
 		// Get magnetometer data.
-		setSetting(0x25, 0x0C|0x80) // Set the I2C slave addres of AK8963 and set for read.
-		setSetting(0x26, 0x03)      // I2C slave 0 register address from where to begin data transfer.
-		setSetting(0x27, 0x87)      // Read 7 bytes from the magnetometer (HX+HY+HZ+ST2).
-		x_mag, err := i2cbus.ReadWordFromReg(0x68, 0x49)
-		chkErr(err)
-		y_mag, err := i2cbus.ReadWordFromReg(0x68, 0x4B)
-		chkErr(err)
-		z_mag, err := i2cbus.ReadWordFromReg(0x68, 0x4D)
-
-		st2, err := i2cbus.ReadByteFromReg(0x68, 0x4F) // ST2 register. Unlatch measurement data for next sample.
-		chkErr(err)
+		writeSetting(0x25, 0x0C|0x80) // Set the I2C slave addres of AK8963 and set for read.
+		writeSetting(0x26, 0x03)      // I2C slave 0 register address from where to begin data transfer.
+		writeSetting(0x27, 0x87)      // Read 7 bytes from the magnetometer (HX+HY+HZ+ST2).
+		x_mag := readWord(0x49)
+		y_mag := readWord(0x4B)
+		z_mag := readWord(0x4D)
+
+		st2 := readByte(0x4F) // ST2 register. Unlatch measurement data for next sample.
+
+		if quitting() {
+			log.Printf("IMU reader exiting.\n")
+			return
+		}
+		if !sampleOK {
+			imuReadErrors++
+			if imuReadErrors == 1 || imuReadErrors%100 == 0 {
+				log.Printf("IMU read error (%d in a row). Holding last attitude.\n", imuReadErrors)
+			}
+			globalStatus.IMU_read_errors = imuReadErrors
+			continue
+		}
+		imuReadErrors = 0
+		globalStatus.IMU_read_errors = 0
+		lastIMUReadTime = stratuxClock.Time
 
 		if st2&0x08 != 0 { // Measurement overflow. HOFL.
 			fmt.Printf("mag: measurement overflow\n")
 			continue // Don't use measurement.
 		}
 
-		x_mag_f := float64(int16(y_mag)) * 1.28785103785104 * magXcal
-		y_mag_f := float64(int16(x_mag)) * 1.28785103785104 * magYcal
-		z_mag_f := float64(int16(-z_mag)) * 1.28785103785104 * magZcal
+		x_mag_f, y_mag_f, z_mag_f := rotateIMUVector(orientation,
+			float64(int16(y_mag))*1.28785103785104*magXcal,
+			float64(int16(x_mag))*1.28785103785104*magYcal,
+			float64(int16(-z_mag))*1.28785103785104*magZcal)
+		magCalibrationSample(x_mag_f, y_mag_f, z_mag_f)
+		x_mag_f, y_mag_f, z_mag_f = applyMagCalibration(x_mag_f, y_mag_f, z_mag_f)
 
+		updateIMUStationary(x_gyro_r, y_gyro_r, z_gyro_r, x_acc_f, y_acc_f, z_acc_f)
+		filterIMUReportValues(z_gyro_r, x_acc_f, y_acc_f, z_acc_f)
 		AHRSupdate(convertToRadians(x_gyro_f), convertToRadians(y_gyro_f), convertToRadians(z_gyro_f), float64(x_acc_f), float64(y_acc_f), float64(z_acc_f), float64(x_mag_f), float64(y_mag_f), float64(z_mag_f))
 	}
 }
@@ -0,0 +1,34 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	mpu9250_test.go: Tests for the I2C bus speed setting.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestSetI2CBaudrate(t *testing.T) {
+	image := "dtparam=i2c1=on\ndtparam=i2c1_baudrate=400000\ndtparam=i2c_arm_baudrate=400000\n\ndtoverlay=pi3-miniuart-bt\n"
+	for _, tt := range []struct {
+		name, config string
+		hz           int
+		want         string
+		wantChanged  bool
+	}{
+		{"Stratux image", image, 100000,
+			"dtparam=i2c1=on\ndtparam=i2c1_baudrate=100000\ndtparam=i2c_arm_baudrate=100000\n\ndtoverlay=pi3-miniuart-bt\n", true},
+		{"already set", image, 400000, image, false},
+		{"not set", "dtparam=i2c_arm=on", 50000, "dtparam=i2c_arm=on\ndtparam=i2c_arm_baudrate=50000\n", true},
+	} {
+		got, changed := setI2CBaudrate(tt.config, tt.hz)
+		if got != tt.want || changed != tt.wantChanged {
+			t.Errorf("%s: got %q, %v, want %q, %v", tt.name, got, changed, tt.want, tt.wantChanged)
+		}
+	}
+}
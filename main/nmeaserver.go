@@ -0,0 +1,220 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	nmeaserver.go: TCP server streaming the GPS NMEA sentences (and optional FLARM-style ownship sentences) to external consumers.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const nmeaClientQueue = 256 // Sentences buffered per client. A client that falls this far behind is dropped.
+
+type nmeaClient struct {
+	conn net.Conn
+	ch   chan []byte
+}
+
+var nmeaClientsMutex sync.Mutex
+var nmeaClients = make(map[*nmeaClient]bool) // Protected by nmeaClientsMutex.
+
+var lastNMEAPositionTime time.Time // stratuxClock time the receiver last sent RMC or GGA. Protected by mySituation.mu_GPS.
+
+/*
+	nmeaServerSend().
+		Queues one NMEA sentence for every connected client. Never blocks: a client whose queue is full is
+		 disconnected, so a slow consumer can't hold up the GPS reader or the other clients.
+*/
+
+func nmeaServerSend(sentence []byte) {
+	nmeaClientsMutex.Lock()
+	defer nmeaClientsMutex.Unlock()
+	for c := range nmeaClients {
+		select {
+		case c.ch <- sentence:
+		default:
+			log.Printf("NMEA server: %s not keeping up, disconnecting.\n", c.conn.RemoteAddr())
+			delete(nmeaClients, c)
+			close(c.ch)
+		}
+	}
+}
+
+// nmeaServerSendLine forwards a valid sentence from the receiver. The receiver's GSV sentences are replaced by the
+// merged constellation when globalSettings.NMEA_SynthesizedGSV is set (see nmeaServer()).
+func nmeaServerSendLine(l string, sentenceType string) {
+	if !globalSettings.NMEAServer_Enabled {
+		return
+	}
+	if strings.HasSuffix(sentenceType, "GSV") && globalSettings.NMEA_SynthesizedGSV {
+		return
+	}
+	if strings.HasSuffix(sentenceType, "RMC") || strings.HasSuffix(sentenceType, "GGA") {
+		lastNMEAPositionTime = stratuxClock.Time
+	}
+	nmeaServerSend([]byte(strings.TrimSpace(l) + "\r\n"))
+}
+
+/*
+	nmeaServerSynthesize().
+		Sends the GPRMC and GPGGA from synthesizeRMCGGA() for a position that came from GNS, PUBX,00 or UBX
+		 NAV-PVT, for consumers that only understand RMC and GGA. Skipped while the receiver is sending
+		 its own RMC or GGA, so that they aren't duplicated.
+*/
+
+func nmeaServerSynthesize(s *GPSSituationData) {
+	if !globalSettings.NMEAServer_Enabled || stratuxClock.Since(lastNMEAPositionTime) < 3*time.Second {
+		return
+	}
+	for _, sentence := range synthesizeRMCGGA(s) {
+		nmeaServerSend(sentence)
+	}
+}
+
+/*
+	makeFLARMOwnship().
+		Builds the Garmin $PGRMZ altitude and a FLARM $PFLAU status sentence for EFBs that take ownship
+		 altitude from a FLARM stream. PGRMZ carries pressure altitude, or GPS altitude when
+		 globalSettings.NMEA_AltitudeSource is "GPS" or the pressure sensor isn't valid. PFLAU reports the
+		 number of traffic targets, no transmitter and no alarm. ok is false with neither altitude valid.
+*/
+
+func makeFLARMOwnship() (sentences [][]byte, ok bool) {
+	mySituation.mu_GPS.Lock()
+	gpsValid := isGPSValid()
+	gpsAlt := mySituation.Alt
+	groundSpeed := mySituation.GroundSpeed
+	mySituation.mu_GPS.Unlock()
+
+	var alt float64
+	fix := 2 // Garmin: 2 = user (here barometric) altitude, 3 = GPS altitude.
+	if isTempPressValid() && globalSettings.NMEA_AltitudeSource != "GPS" {
+		alt = mySituation.Pressure_alt
+	} else if gpsValid {
+		alt = float64(gpsAlt)
+		fix = 3
+	} else {
+		return nil, false
+	}
+
+	trafficMutex.Lock()
+	rx := len(traffic)
+	trafficMutex.Unlock()
+	gps := 0 // FLARM: 0 = no fix, 1 = fix on ground, 2 = fix airborne.
+	if gpsValid {
+		gps = 1
+		if groundSpeed >= 30 {
+			gps = 2
+		}
+	}
+
+	return [][]byte{
+		makeNMEACmd(fmt.Sprintf("PGRMZ,%d,f,%d", int(alt), fix)),
+		makeNMEACmd(fmt.Sprintf("PFLAU,%d,0,%d,1,0,,0,,,", rx, gps)),
+	}, true
+}
+
+func nmeaClientWriter(c *nmeaClient) {
+	defer c.conn.Close()
+	for sentence := range c.ch {
+		c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.conn.Write(sentence); err != nil {
+			log.Printf("NMEA server: %s disconnected: %s\n", c.conn.RemoteAddr(), err.Error())
+			nmeaClientsMutex.Lock()
+			if nmeaClients[c] {
+				delete(nmeaClients, c)
+				close(c.ch)
+			}
+			nmeaClientsMutex.Unlock()
+			for range c.ch { // Drain until closed.
+			}
+			return
+		}
+	}
+}
+
+// nmeaServerDisconnectAll drops every client, e.g. when the server is disabled.
+func nmeaServerDisconnectAll() {
+	nmeaClientsMutex.Lock()
+	defer nmeaClientsMutex.Unlock()
+	for c := range nmeaClients {
+		delete(nmeaClients, c)
+		close(c.ch)
+	}
+}
+
+func nmeaServerAccept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return // Listener closed.
+		}
+		log.Printf("NMEA server: client %s connected.\n", conn.RemoteAddr())
+		c := &nmeaClient{conn: conn, ch: make(chan []byte, nmeaClientQueue)}
+		nmeaClientsMutex.Lock()
+		nmeaClients[c] = true
+		nmeaClientsMutex.Unlock()
+		go nmeaClientWriter(c)
+	}
+}
+
+/*
+	nmeaServer().
+		Listens on globalSettings.NMEAServer_Port while globalSettings.NMEAServer_Enabled is set, following
+		 changes to either at runtime. Also sends the merged constellation as GSV once a second when
+		 globalSettings.NMEA_SynthesizedGSV is set, and PGRMZ/PFLAU when globalSettings.NMEA_FLARMOwnship is.
+*/
+
+func nmeaServer() {
+	var ln net.Listener
+	port := 0
+	failedPort := 0 // Last port that couldn't be opened, so the error is only logged once.
+	ticker := time.NewTicker(1 * time.Second)
+	for {
+		<-ticker.C
+		if ln != nil && (!globalSettings.NMEAServer_Enabled || port != globalSettings.NMEAServer_Port) {
+			ln.Close()
+			ln = nil
+			nmeaServerDisconnectAll()
+			log.Printf("NMEA server: stopped listening on port %d.\n", port)
+		}
+		if ln == nil && globalSettings.NMEAServer_Enabled {
+			port = globalSettings.NMEAServer_Port
+			var err error
+			ln, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+			if err != nil {
+				if failedPort != port {
+					log.Printf("NMEA server: can't listen on port %d: %s\n", port, err.Error())
+					failedPort = port
+				}
+				ln = nil
+				continue
+			}
+			failedPort = 0
+			log.Printf("NMEA server: listening on port %d.\n", port)
+			go nmeaServerAccept(ln)
+		}
+		if ln != nil && globalSettings.NMEA_SynthesizedGSV && isGPSValid() {
+			for _, gsv := range synthesizeGSV() {
+				nmeaServerSend(gsv)
+			}
+		}
+		if ln != nil && globalSettings.NMEA_FLARMOwnship {
+			if sentences, ok := makeFLARMOwnship(); ok {
+				for _, sentence := range sentences {
+					nmeaServerSend(sentence)
+				}
+			}
+		}
+	}
+}
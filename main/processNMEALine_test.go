@@ -0,0 +1,174 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	processNMEALine_test.go: Tests for processNMEALine(), against test-data/gps/nmea-cases.nmea.
+*/
+
+package main
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const nmeaCasesFile = "../test-data/gps/nmea-cases.nmea"
+
+// nmeaCase returns the sentence in nmeaCasesFile that starts with prefix.
+func nmeaCase(t *testing.T, prefix string) string {
+	f, err := os.Open(nmeaCasesFile)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if l := strings.TrimSpace(scanner.Text()); strings.HasPrefix(l, prefix) {
+			return l
+		}
+	}
+	t.Fatalf("no sentence starting %q in %s", prefix, nmeaCasesFile)
+	return ""
+}
+
+func TestProcessNMEALine(t *testing.T) {
+	type fix struct {
+		Lat, Lng    float32
+		Alt         float32 // Feet MSL, to within altTolerance.
+		GroundSpeed uint16
+		TrueCourse  float32
+		Quality     uint8
+		Satellites  uint16
+	}
+	tests := []struct {
+		name         string
+		setup        []string // Prefixes of sentences processed first.
+		sentences    []string // Prefixes of the sentences under test, one second apart.
+		used         bool     // What processNMEALine() returns for each of them.
+		unchanged    bool     // mySituation.GPSSituationData must be as setup left it...
+		goodChecksum bool     // ...apart from LastValidNMEAMessage, which shows the receiver is talking. See isGPSConnected().
+		want         fix
+		altTolerance float32
+	}{
+		{
+			name:      "PUBX,00, north and west",
+			sentences: []string{"$PUBX,00"},
+			used:      true,
+			want:      fix{47.4498, -122.3088, 517, 54, 180, 2, 9},
+			// The geoid separation comes from the coarse table in geoid.go.
+			altTolerance: 10,
+		},
+		{
+			name:         "PUBX,00, 03 and 04",
+			sentences:    []string{"$PUBX,00", "$PUBX,03", "$PUBX,04"},
+			used:         true,
+			want:         fix{47.4498, -122.3088, 517, 54, 180, 2, 2}, // PUBX,03 recounts from the satellites it marks used.
+			altTolerance: 10,
+		},
+		{
+			name:         "GGA, south and east",
+			sentences:    []string{"$GPGGA,174505"},
+			used:         true,
+			want:         fix{-33.9461, 151.1772, 69, 0, 0, 1, 0},
+			altTolerance: 0.5,
+		},
+		{
+			name:         "GNS",
+			sentences:    []string{"$GNGNS"},
+			used:         true,
+			want:         fix{-33.9461, 151.1772, 69, 0, 0, 1, 8},
+			altTolerance: 0.5,
+		},
+		{
+			name:      "RMC",
+			sentences: []string{"$GPRMC,174506"},
+			used:      true,
+			want:      fix{-33.9461, 151.1772, 0, 22, 84.4, 0, 0},
+		},
+		{
+			name:      "VTG",
+			sentences: []string{"$GPVTG"},
+			used:      true,
+			want:      fix{0, 0, 0, 10, 270, 0, 0},
+		},
+		{
+			name:      "GSA",
+			sentences: []string{"$GPGSA"},
+			used:      true,
+			want:      fix{Satellites: 4},
+		},
+		{
+			name:      "GSV group", // Satellites in view, but not in solution.
+			sentences: []string{"$GPGSV,3,1", "$GPGSV,3,2", "$GPGSV,3,3"},
+			used:      true,
+		},
+		{
+			name:         "short GGA",
+			setup:        []string{"$GPGGA,174505"},
+			sentences:    []string{"$GPGGA,174507"},
+			unchanged:    true,
+			goodChecksum: true,
+		},
+		{
+			name:         "RMC without a fix",
+			setup:        []string{"$GPGGA,174505"},
+			sentences:    []string{"$GPRMC,174508"},
+			unchanged:    true,
+			goodChecksum: true,
+		},
+		{
+			name:      "bad checksum",
+			setup:     []string{"$GPGGA,174505"},
+			sentences: []string{"$GPGGA,174509"},
+			unchanged: true,
+		},
+	}
+
+	for _, tt := range tests {
+		resetGPSTestState()
+		for _, p := range tt.setup {
+			processNMEALines(time.Second, nmeaCase(t, p))
+		}
+		before := mySituation.GPSSituationData
+		for _, p := range tt.sentences {
+			stratuxClock.Time = stratuxClock.Time.Add(time.Second)
+			if used := processNMEALine(nmeaCase(t, p)); used != tt.used {
+				t.Errorf("%s: processNMEALine(%s...) = %v, want %v", tt.name, p, used, tt.used)
+			}
+		}
+
+		if tt.unchanged {
+			if tt.goodChecksum {
+				before.LastValidNMEAMessage = mySituation.LastValidNMEAMessage
+				before.LastValidNMEAMessageTime = mySituation.LastValidNMEAMessageTime
+			}
+			if mySituation.GPSSituationData != before {
+				t.Errorf("%s: mySituation changed:\n%+v\nwas\n%+v", tt.name, mySituation.GPSSituationData, before)
+			}
+			continue
+		}
+		got := fix{mySituation.Lat, mySituation.Lng, mySituation.Alt, mySituation.GroundSpeed, mySituation.TrueCourse,
+			mySituation.Quality, mySituation.Satellites}
+		if math.Abs(float64(got.Lat-tt.want.Lat)) > 1e-4 || math.Abs(float64(got.Lng-tt.want.Lng)) > 1e-4 ||
+			math.Abs(float64(got.Alt-tt.want.Alt)) > float64(tt.altTolerance) ||
+			math.Abs(float64(got.TrueCourse-tt.want.TrueCourse)) > 1e-3 || got.GroundSpeed != tt.want.GroundSpeed ||
+			got.Quality != tt.want.Quality || got.Satellites != tt.want.Satellites {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestGSVCasesInView checks that the GSV group in nmeaCasesFile leaves all of its satellites in view.
+func TestGSVCasesInView(t *testing.T) {
+	resetGPSTestState()
+	processNMEALines(10*time.Millisecond, nmeaCase(t, "$GPGSV,3,1"), nmeaCase(t, "$GPGSV,3,2"), nmeaCase(t, "$GPGSV,3,3"))
+	if len(Satellites) != 9 || mySituation.SatellitesTracked != 9 || mySituation.SatellitesSeen != 9 {
+		t.Errorf("%d satellites, %d tracked, %d seen, want 9", len(Satellites), mySituation.SatellitesTracked, mySituation.SatellitesSeen)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	selftest.go: One-shot startup probe of GPS, pressure sensor, IMU and magnetometer presence.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	BMP_I2C_ADDR     = 0x77 // BMP180/BMP280/BME280 default address.
+	BMP_I2C_ADDR_ALT = 0x76 // BMP280/BME280 with SDO low.
+	BMP_REG_CHIPID   = 0xD0
+	MPU_I2C_ADDR     = 0x68
+	MPU_REG_WHOAMI   = 0x75
+	BMP180_CHIPID    = 0x55
+	BMP280_CHIPID    = 0x58
+	BME280_CHIPID    = 0x60
+	MPU6050_WHOAMI   = 0x68 // Also reported by the MPU9150.
+	MPU9250_WHOAMI   = 0x71
+	MPU9255_WHOAMI   = 0x73
+	selfTestNotFound = "not found"
+)
+
+var pressureSensorAddr byte = BMP_I2C_ADDR // I2C address the pressure sensor was found at.
+
+// probePressureSensor reads the chip ID register of a Bosch pressure sensor and returns its name. Both the default
+// address and the BMP280/BME280 alternate address are tried, and pressureSensorAddr is set to where it answered.
+func probePressureSensor() string {
+	id, err := i2cbus.ReadByteFromReg(BMP_I2C_ADDR, BMP_REG_CHIPID)
+	pressureSensorAddr = BMP_I2C_ADDR
+	if err != nil {
+		id, err = i2cbus.ReadByteFromReg(BMP_I2C_ADDR_ALT, BMP_REG_CHIPID)
+		pressureSensorAddr = BMP_I2C_ADDR_ALT
+	}
+	if err != nil {
+		return selfTestNotFound
+	}
+	switch id {
+	case BMP180_CHIPID:
+		return "BMP180"
+	case BMP280_CHIPID:
+		return "BMP280"
+	case BME280_CHIPID:
+		return "BME280"
+	}
+	return fmt.Sprintf("unknown (chip id 0x%02X)", id)
+}
+
+// probeIMU reads the WHO_AM_I register of an InvenSense IMU and returns its name.
+func probeIMU() string {
+	id, err := i2cbus.ReadByteFromReg(MPU_I2C_ADDR, MPU_REG_WHOAMI)
+	if err != nil {
+		return selfTestNotFound
+	}
+	switch id {
+	case MPU6050_WHOAMI:
+		return "MPU6050/MPU9150"
+	case MPU9250_WHOAMI:
+		return "MPU9250"
+	case MPU9255_WHOAMI:
+		return "MPU9255"
+	}
+	return fmt.Sprintf("unknown (who-am-i 0x%02X)", id)
+}
+
+/*
+	hardwareSelfTest().
+		Probes each piece of attached hardware once at startup, records the result in globalStatus
+		 and logs a one-line summary. The I2C bus and the MPU I2C master must already be configured
+		 so that the magnetometer behind the MPU can be reached.
+*/
+
+func hardwareSelfTest() {
+	if device, gpsType, _, ok := detectGPSDevice(); ok {
+		globalStatus.GPS_device = device
+		globalStatus.GPS_detected_type = gpsType
+	} else {
+		globalStatus.GPS_device = selfTestNotFound
+		globalStatus.GPS_detected_type = selfTestNotFound
+	}
+
+	globalStatus.Pressure_sensor = probePressureSensor()
+	globalStatus.IMU_sensor = probeIMU()
+	globalStatus.Magnetometer_connected = globalStatus.IMU_sensor != selfTestNotFound && checkMagConnection()
+
+	missing := make([]string, 0)
+	if globalStatus.GPS_device == selfTestNotFound {
+		missing = append(missing, "GPS")
+	}
+	if globalStatus.Pressure_sensor == selfTestNotFound {
+		missing = append(missing, "pressure sensor")
+	}
+	if globalStatus.IMU_sensor == selfTestNotFound {
+		missing = append(missing, "IMU")
+	}
+	if !globalStatus.Magnetometer_connected {
+		missing = append(missing, "magnetometer")
+	}
+	missingStr := "none"
+	if len(missing) > 0 {
+		missingStr = strings.Join(missing, ", ")
+	}
+
+	log.Printf("self-test: GPS=%s (%s), baro=%s, IMU=%s, magnetometer=%t. Missing: %s\n", globalStatus.GPS_device, globalStatus.GPS_detected_type,
+		globalStatus.Pressure_sensor, globalStatus.IMU_sensor, globalStatus.Magnetometer_connected, missingStr)
+}
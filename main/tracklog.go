@@ -0,0 +1,151 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New"" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	tracklog.go: Flight track recording to GPX (and optionally KML) files in logDir, for reviewing flights.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	gpxHeader = "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+		"<gpx version=\"1.0\" creator=\"Stratux\" xmlns=\"http://www.topografix.com/GPX/1/0\">\n" +
+		"<trk><name>%s</name><trkseg>\n"
+	gpxFooter = "</trkseg></trk>\n</gpx>\n"
+	kmlHeader = "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+		"<kml xmlns=\"http://www.opengis.net/kml/2.2\">\n" +
+		"<Document><name>%s</name><Placemark><name>%s</name>\n" +
+		"<LineString><altitudeMode>absolute</altitudeMode><coordinates>\n"
+	kmlFooter = "</coordinates></LineString></Placemark></Document>\n</kml>\n"
+)
+
+// trackFile is a track log being written. The closing tags are rewritten after every point, so the file on disk is
+// always complete.
+type trackFile struct {
+	fp     *os.File
+	footer string
+	offset int64 // Where the next point goes, i.e. the start of the footer.
+}
+
+func openTrackFile(fn, header, footer string) (*trackFile, error) {
+	fp, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	t := &trackFile{fp: fp, footer: footer}
+	if err := t.append(header); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// append writes s followed by the footer, and syncs so that a power loss keeps the track up to this point.
+func (t *trackFile) append(s string) error {
+	if _, err := t.fp.WriteAt([]byte(s+t.footer), t.offset); err != nil {
+		return err
+	}
+	t.offset += int64(len(s))
+	return t.fp.Sync()
+}
+
+func (t *trackFile) close() {
+	if t != nil {
+		t.fp.Close()
+	}
+}
+
+/*
+	makeTrackPoints().
+		Snapshots mySituation as a GPX trkpt and a KML coordinate. ok is false when there is no valid fix.
+		 The timestamp is GPS time when valid, otherwise the system clock.
+*/
+
+func makeTrackPoints() (gpx, kml string, ts time.Time, ok bool) {
+	mySituation.mu_GPS.Lock()
+	defer mySituation.mu_GPS.Unlock()
+	if !isGPSValid() {
+		return "", "", ts, false
+	}
+	ts = time.Now().UTC()
+	if isGPSClockValid() {
+		ts = mySituation.GPSTime.UTC()
+	}
+	altM := float64(mySituation.Alt) / 3.28084
+	gpx = fmt.Sprintf("<trkpt lat=\"%.7f\" lon=\"%.7f\"><ele>%.1f</ele><time>%s</time>", mySituation.Lat, mySituation.Lng, altM, ts.Format("2006-01-02T15:04:05.000Z"))
+	if isGPSGroundTrackValid() {
+		gpx += fmt.Sprintf("<course>%.1f</course><speed>%.2f</speed>", mySituation.TrueCourse, float64(mySituation.GroundSpeedF)/1.94384)
+	}
+	gpx += "</trkpt>\n"
+	kml = fmt.Sprintf("%.7f,%.7f,%.1f\n", mySituation.Lng, mySituation.Lat, altM)
+	return gpx, kml, ts, true
+}
+
+/*
+	trackLogger().
+		Samples mySituation every TrackLog_Interval seconds while TrackLog_Enabled is set, and appends
+		 the valid points to a GPX file (and a KML file if TrackLog_KML is set) in logDir. A new pair of
+		 files, named from the time of the first point, is started each time logging is switched on.
+*/
+
+func trackLogger() {
+	var gpxFile, kmlFile *trackFile
+	for {
+		interval := globalSettings.TrackLog_Interval
+		if interval < 1 {
+			interval = 1
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		if !globalSettings.TrackLog_Enabled {
+			if gpxFile != nil {
+				log.Printf("Track log closed.\n")
+			}
+			gpxFile.close()
+			kmlFile.close()
+			gpxFile, kmlFile = nil, nil
+			continue
+		}
+
+		gpx, kml, ts, ok := makeTrackPoints()
+		if !ok {
+			continue
+		}
+
+		if gpxFile == nil {
+			name := "track_" + ts.Format("20060102_150405")
+			os.MkdirAll(logDir, 0755)
+			var err error
+			gpxFile, err = openTrackFile(logDir+name+".gpx", fmt.Sprintf(gpxHeader, name), gpxFooter)
+			if err != nil {
+				log.Printf("Failed to open track log '%s': %s\n", logDir+name+".gpx", err.Error())
+				continue
+			}
+			log.Printf("Logging track to %s.gpx\n", logDir+name)
+			if globalSettings.TrackLog_KML {
+				kmlFile, err = openTrackFile(logDir+name+".kml", fmt.Sprintf(kmlHeader, name, name), kmlFooter)
+				if err != nil {
+					log.Printf("Failed to open track log '%s': %s\n", logDir+name+".kml", err.Error())
+				}
+			}
+		}
+
+		if err := gpxFile.append(gpx); err != nil {
+			log.Printf("track log write error: %s\n", err.Error())
+		}
+		if kmlFile != nil {
+			if err := kmlFile.append(kml); err != nil {
+				log.Printf("track log write error: %s\n", err.Error())
+			}
+		}
+	}
+}